@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/checker"
+	"github.com/cybertec-postgresql/vip-manager/ipmanager"
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// checkDCSTimeout is how long the check subcommand waits for the DCS
+const checkDCSTimeout = 15 * time.Second
+
+// runCheck verifies that the DCS and the backend can be reached with the configured
+// credentials and privileges, without changing the state of the VIP.
+// It prints a line per check and returns the exit code.
+func runCheck(conf *vipconfig.Config) int {
+	failed := 0
+	report := func(r ipmanager.CheckResult) {
+		if r.Err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %s\n", r.Name, strings.TrimSpace(r.Err.Error()))
+			return
+		}
+		fmt.Printf("PASS  %s: %s\n", r.Name, r.Detail)
+	}
+
+	report(ipmanager.CheckResult{Name: "config", Detail: "valid, hosting-type " + conf.HostingType})
+	report(checkDCS(conf))
+
+	// checked by Config.Validate
+	vips, _ := conf.VIPs()
+	iface, err := checkInterface(conf, vips[0].IP)
+	if err != nil {
+		report(ipmanager.CheckResult{Name: "interface", Err: err})
+	} else {
+		for _, r := range ipmanager.Check(conf.HostingType, newIPConfiguration(conf, vips, *iface)) {
+			report(r)
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("%d check(s) failed\n", failed)
+		return 1
+	}
+	fmt.Println("All checks passed")
+	return 0
+}
+
+// checkDCS reads the leader from the DCS once
+func checkDCS(conf *vipconfig.Config) ipmanager.CheckResult {
+	result := ipmanager.CheckResult{Name: conf.EndpointType + " " + conf.Key}
+	if conf.EndpointType == "patroni" {
+		// there is no key, the REST API is asked
+		result.Name = "patroni " + conf.Endpoints[0]
+	}
+	lc, err := checker.NewLeaderChecker(conf)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	prober, ok := lc.(checker.Prober)
+	if !ok {
+		result.Err = fmt.Errorf("checking dcs-type %s is not supported", conf.EndpointType)
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkDCSTimeout)
+	defer cancel()
+	leader, err := prober.Probe(ctx)
+	switch {
+	case err != nil:
+		result.Err = err
+	case leader == "":
+		result.Detail = "reachable, there is no leader"
+	default:
+		result.Detail = fmt.Sprintf("reachable, the leader is %q, this node is %q", leader, conf.Nodename)
+	}
+	return result
+}
+
+// checkInterface returns the interface the VIP is managed on, detecting it if it isn't set
+func checkInterface(conf *vipconfig.Config, vip net.IP) (*net.Interface, error) {
+	name := conf.Iface
+	if name == "" {
+		detected, err := ipmanager.DetectInterface(vip, conf.InterfaceTieBreak, conf.InterfaceNamePattern)
+		if err != nil {
+			return nil, fmt.Errorf("no interface is set and it can't be detected: %w", err)
+		}
+		name = detected
+	}
+	return net.InterfaceByName(name)
+}
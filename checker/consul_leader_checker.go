@@ -2,7 +2,9 @@ package checker
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/url"
 	"time"
 
@@ -15,9 +17,16 @@ type ConsulLeaderChecker struct {
 	key       string
 	nodename  string
 	apiClient *api.Client
+	// nil without dcs-fallback-endpoints
+	fallback *api.Client
+	// whether the last answer came from the dcs-fallback-endpoints
+	onFallback bool
 }
 
-//naming this cConf to avoid conflict with conf in etcd_leader_checker.go
+// consulWaitTime is how long a blocking query waits for a change of the key
+const consulWaitTime = time.Second
+
+// naming this cConf to avoid conflict with conf in etcd_leader_checker.go
 var cConf *vipconfig.Config
 
 // NewConsulLeaderChecker returns a new instance
@@ -28,7 +37,23 @@ func NewConsulLeaderChecker(con *vipconfig.Config) (*ConsulLeaderChecker, error)
 		nodename: cConf.Nodename,
 	}
 
-	url, err := url.Parse(cConf.Endpoints[0])
+	apiClient, err := newConsulClient(cConf, cConf.Endpoints[0])
+	if err != nil {
+		return nil, err
+	}
+	lc.apiClient = apiClient
+	if len(cConf.FallbackEndpoints) > 0 {
+		lc.fallback, err = newConsulClient(cConf, cConf.FallbackEndpoints[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return lc, nil
+}
+
+func newConsulClient(conf *vipconfig.Config, endpoint string) (*api.Client, error) {
+	url, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -37,52 +62,140 @@ func NewConsulLeaderChecker(con *vipconfig.Config) (*ConsulLeaderChecker, error)
 	config := &api.Config{
 		Address:  address,
 		Scheme:   url.Scheme,
-		WaitTime: time.Second,
+		WaitTime: consulWaitTime,
+		// only a CA verifies the server, a client certificate and key enable mutual TLS
+		TLSConfig: api.TLSConfig{
+			CAFile:   conf.ConsulCAFile,
+			CertFile: conf.ConsulCertFile,
+			KeyFile:  conf.ConsulKeyFile,
+		},
 	}
 
-	if cConf.ConsulToken != "" {
-		config.Token = cConf.ConsulToken
+	if conf.ConsulToken != "" {
+		config.Token = conf.ConsulToken
 	}
 
 	apiClient, err := api.NewClient(config)
 	if err != nil {
 		return nil, err
 	}
+	// validated by vipconfig.NewConfig
+	config.Transport.TLSClientConfig.MinVersion, _ = vipconfig.ParseTLSVersion(conf.TLSMinVersion)
+	config.Transport.DialContext = (&net.Dialer{
+		Timeout:   time.Duration(conf.DCSDialTimeout) * time.Millisecond,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	return apiClient, nil
+}
 
-	lc.apiClient = apiClient
+// get reads key, usually the trigger-key, from the first of the dcs-endpoints and, only if it
+// didn't answer within one interval (plus the wait of a blocking query), from
+// the first of the dcs-fallback-endpoints. An answer is final, including that
+// the key doesn't exist, no matter which one gave it.
+func (c *ConsulLeaderChecker) get(ctx context.Context, key string, queryOptions *api.QueryOptions) (*api.KVPair, error) {
+	if c.fallback == nil {
+		return c.getFrom(ctx, c.apiClient, key, queryOptions)
+	}
+	primaryCtx, cancel := context.WithTimeout(ctx, consulWaitTime+time.Duration(cConf.Interval)*time.Millisecond)
+	resp, err := c.getFrom(primaryCtx, c.apiClient, key, queryOptions)
+	cancel()
+	if err == nil || ctx.Err() != nil {
+		if c.onFallback && ctx.Err() == nil {
+			slog.Info("dcs-endpoints are reachable again, leaving dcs-fallback-endpoints")
+			c.onFallback = false
+		}
+		return resp, err
+	}
 
-	return lc, nil
+	resp, fallbackErr := c.getFrom(ctx, c.fallback, key, queryOptions)
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("dcs-endpoints: %v, dcs-fallback-endpoints: %w", err, fallbackErr)
+	}
+	if !c.onFallback {
+		slog.Warn("dcs-endpoints can't be reached, using dcs-fallback-endpoints", "err", err)
+		c.onFallback = true
+	}
+	return resp, nil
+}
+
+// getFrom reads key, giving up after the wait of a blocking query
+// plus dcs-request-timeout, so a consul that accepts connections but never
+// answers can't block the loop.
+func (c *ConsulLeaderChecker) getFrom(ctx context.Context, apiClient *api.Client, key string, queryOptions *api.QueryOptions) (*api.KVPair, error) {
+	ctx, cancel := context.WithTimeout(ctx, consulWaitTime+time.Duration(cConf.DCSRequestTimeout)*time.Millisecond)
+	defer cancel()
+	resp, _, err := apiClient.KV().Get(key, queryOptions.WithContext(ctx))
+	return resp, err
 }
 
 // GetChangeNotificationStream checks the status in the loop
 func (c *ConsulLeaderChecker) GetChangeNotificationStream(ctx context.Context, out chan<- bool) error {
-	kv := c.apiClient.KV()
-
+	// serializable reads may be answered by any server and can be stale
 	queryOptions := &api.QueryOptions{
-		RequireConsistent: true,
+		RequireConsistent: cConf.ConsensusReadConsistency != "serializable",
+		AllowStale:        cConf.ConsensusReadConsistency == "serializable",
 	}
 
+	// the first read is retried on its own, see retryInitialRead
+	initialized := false
+	initialAttempts := 0
+	// consecutive failures to reach consul after the first read, see dcsBackoff
+	failures := 0
+
 checkLoop:
 	for {
-		resp, _, err := kv.Get(c.key, queryOptions)
+		resp, err := c.get(ctx, c.key, queryOptions)
 		if err != nil {
 			if ctx.Err() != nil {
 				break checkLoop
 			}
-			log.Printf("consul error: %s", err)
-			out <- false
-			time.Sleep(time.Duration(cConf.Interval) * time.Millisecond)
+			if !initialized && retryInitialRead(ctx, cConf, &initialAttempts, err) {
+				continue
+			}
+			if initialized {
+				// consul didn't say that leadership was lost, don't release the VIP because of it
+				failures++
+				backoff := dcsBackoff(cConf, failures)
+				slog.Error("consul error, holding the current state", "err", err, "failures", failures, "backoff", backoff)
+				sleepCtx(ctx, backoff)
+				continue
+			}
+			initialized = true
+			slog.Error("consul error", "err", err)
+			select {
+			case <-ctx.Done():
+				break checkLoop
+			case out <- false:
+			}
+			sleepCtx(ctx, time.Duration(cConf.Interval)*time.Millisecond)
 			continue
 		}
+		if failures > 0 {
+			slog.Info("consul is reachable again", "failures", failures)
+			failures = 0
+		}
+		initialized = true
 		if resp == nil {
-			log.Printf("Cannot get variable for key %s. Will try again in a second.", c.key)
+			if cConf.OnKeyDelete == "hold" {
+				slog.Warn("Key does not exist, holding the current state", "key", c.key)
+				time.Sleep(time.Duration(cConf.Interval) * time.Millisecond)
+				continue
+			}
+			slog.Warn("Cannot get variable for key, releasing. Will try again in a second", "key", c.key)
 			out <- false
 			time.Sleep(time.Duration(cConf.Interval) * time.Millisecond)
 			continue
 		}
 
-		state := string(resp.Value) == c.nodename
 		queryOptions.WaitIndex = resp.ModifyIndex
+		logLeaderValue(cConf, c.key, string(resp.Value))
+		valueErr := checkLeaderValue(string(resp.Value))
+		if valueErr != nil && holdOnInvalidLeaderValue(cConf, c.key, string(resp.Value), valueErr) {
+			time.Sleep(time.Duration(cConf.Interval) * time.Millisecond)
+			continue
+		}
+
+		state := valueErr == nil && string(resp.Value) == c.nodename
 
 		select {
 		case <-ctx.Done():
@@ -95,3 +208,43 @@ checkLoop:
 
 	return ctx.Err()
 }
+
+// WriteDepartureMarker sets a key that is bound to a session which is never renewed,
+// so consul deletes the key once the session's TTL of departure-marker-ttl seconds expired.
+func (c *ConsulLeaderChecker) WriteDepartureMarker(ctx context.Context) error {
+	writeOptions := (&api.WriteOptions{}).WithContext(ctx)
+
+	session, _, err := c.apiClient.Session().Create(&api.SessionEntry{
+		Name:     "vip-manager departure marker for " + c.nodename,
+		TTL:      fmt.Sprintf("%ds", cConf.DepartureMarkerTTL),
+		Behavior: api.SessionBehaviorDelete,
+	}, writeOptions)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = c.apiClient.KV().Acquire(&api.KVPair{
+		Key:     cConf.DepartureMarkerPrefix + c.nodename,
+		Value:   []byte(time.Now().Format(time.RFC3339)),
+		Session: session,
+	}, writeOptions)
+	return err
+}
+
+// Probe reads the trigger-key once
+func (c *ConsulLeaderChecker) Probe(ctx context.Context) (string, error) {
+	return c.ReadKey(ctx, c.key)
+}
+
+// ReadKey reads key once, see KeyReader
+func (c *ConsulLeaderChecker) ReadKey(ctx context.Context, key string) (string, error) {
+	queryOptions := &api.QueryOptions{
+		RequireConsistent: cConf.ConsensusReadConsistency != "serializable",
+		AllowStale:        cConf.ConsensusReadConsistency == "serializable",
+	}
+	resp, err := c.get(ctx, key, queryOptions)
+	if err != nil || resp == nil {
+		return "", err
+	}
+	return string(resp.Value), nil
+}
@@ -4,9 +4,10 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"time"
@@ -20,9 +21,13 @@ type EtcdLeaderChecker struct {
 	key      string
 	nodename string
 	kapi     client.KeysAPI
+	// nil without dcs-fallback-endpoints
+	fallback client.KeysAPI
+	// whether the last answer came from the dcs-fallback-endpoints
+	onFallback bool
 }
 
-//naming this c_conf to avoid conflict with conf in etcd_leader_checker.go
+// naming this c_conf to avoid conflict with conf in etcd_leader_checker.go
 var eConf *vipconfig.Config
 
 func getTransport(conf *vipconfig.Config) (client.CancelableTransport, error) {
@@ -52,6 +57,8 @@ func getTransport(conf *vipconfig.Config) (client.CancelableTransport, error) {
 	}
 
 	tlsClientConfig := new(tls.Config)
+	// validated by vipconfig.NewConfig
+	tlsClientConfig.MinVersion, _ = vipconfig.ParseTLSVersion(conf.TLSMinVersion)
 
 	if caCertPool != nil {
 		tlsClientConfig.RootCAs = caCertPool
@@ -60,11 +67,10 @@ func getTransport(conf *vipconfig.Config) (client.CancelableTransport, error) {
 		}
 	}
 
-	// TODO: make these timeouts adjustable
 	return &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		Dial: (&net.Dialer{
-			Timeout:   30 * time.Second,
+			Timeout:   time.Duration(conf.DCSDialTimeout) * time.Millisecond,
 			KeepAlive: 30 * time.Second,
 		}).Dial,
 		TLSClientConfig:     tlsClientConfig,
@@ -82,43 +88,141 @@ func NewEtcdLeaderChecker(con *vipconfig.Config) (*EtcdLeaderChecker, error) {
 		return nil, err
 	}
 
+	e.kapi, err = newEtcdKeysAPI(eConf, eConf.Endpoints, transport)
+	if err != nil {
+		return nil, err
+	}
+	if len(eConf.FallbackEndpoints) > 0 {
+		e.fallback, err = newEtcdKeysAPI(eConf, eConf.FallbackEndpoints, transport)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func newEtcdKeysAPI(conf *vipconfig.Config, endpoints []string, transport client.CancelableTransport) (client.KeysAPI, error) {
 	cfg := client.Config{
-		Endpoints:               eConf.Endpoints,
+		Endpoints:               endpoints,
 		Transport:               transport,
 		HeaderTimeoutPerRequest: time.Second,
-		Username:                eConf.EtcdUser,
-		Password:                eConf.EtcdPassword,
+		Username:                conf.EtcdUser,
+		Password:                conf.EtcdPassword,
 	}
 	c, err := client.New(cfg)
 	if err != nil {
 		return nil, err
 	}
-	e.kapi = client.NewKeysAPI(c)
-	return e, nil
+	return client.NewKeysAPI(c), nil
+}
+
+// get reads key, usually the trigger-key, from the dcs-endpoints and, only if none of them
+// answered within one interval, from the dcs-fallback-endpoints. An answer is
+// final, including that the key doesn't exist, no matter which group gave it.
+func (e *EtcdLeaderChecker) get(ctx context.Context, key string, opts *client.GetOptions) (*client.Response, error) {
+	if e.fallback == nil {
+		return e.getFrom(ctx, e.kapi, key, opts)
+	}
+	primaryCtx, cancel := context.WithTimeout(ctx, time.Duration(eConf.Interval)*time.Millisecond)
+	resp, err := e.getFrom(primaryCtx, e.kapi, key, opts)
+	cancel()
+	if err == nil || client.IsKeyNotFound(err) || ctx.Err() != nil {
+		if e.onFallback && ctx.Err() == nil {
+			slog.Info("dcs-endpoints are reachable again, leaving dcs-fallback-endpoints")
+			e.onFallback = false
+		}
+		return resp, err
+	}
+
+	resp, fallbackErr := e.getFrom(ctx, e.fallback, key, opts)
+	if fallbackErr != nil && !client.IsKeyNotFound(fallbackErr) {
+		return nil, fmt.Errorf("dcs-endpoints: %v, dcs-fallback-endpoints: %w", err, fallbackErr)
+	}
+	if !e.onFallback {
+		slog.Warn("dcs-endpoints can't be reached, using dcs-fallback-endpoints", "err", err)
+		e.onFallback = true
+	}
+	return resp, fallbackErr
+}
+
+// getFrom reads key, giving up after dcs-request-timeout, so an etcd
+// that accepts connections but never answers can't block the loop.
+func (e *EtcdLeaderChecker) getFrom(ctx context.Context, kapi client.KeysAPI, key string, opts *client.GetOptions) (*client.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(eConf.DCSRequestTimeout)*time.Millisecond)
+	defer cancel()
+	return kapi.Get(ctx, key, opts)
 }
 
 // GetChangeNotificationStream checks the status in the loop
 func (e *EtcdLeaderChecker) GetChangeNotificationStream(ctx context.Context, out chan<- bool) error {
 	clientOptions := &client.GetOptions{
-		Quorum:    true,
+		Quorum:    eConf.ConsensusReadConsistency != "serializable",
 		Recursive: false,
 	}
 
+	// the first read is retried on its own, see retryInitialRead
+	initialized := false
+	initialAttempts := 0
+	// consecutive failures to reach etcd after the first read, see dcsBackoff
+	failures := 0
+
 checkLoop:
 	for {
-		resp, err := e.kapi.Get(ctx, e.key, clientOptions)
+		resp, err := e.get(ctx, e.key, clientOptions)
 
 		if err != nil {
 			if ctx.Err() != nil {
 				break checkLoop
 			}
-			log.Printf("etcd error: %s", err)
-			out <- false
+			if client.IsKeyNotFound(err) && eConf.OnKeyDelete == "hold" {
+				slog.Warn("Key does not exist, holding the current state", "key", e.key)
+				time.Sleep(time.Duration(eConf.Interval) * time.Millisecond)
+				continue
+			}
+			if !initialized && !client.IsKeyNotFound(err) && retryInitialRead(ctx, eConf, &initialAttempts, err) {
+				continue
+			}
+			if initialized && !client.IsKeyNotFound(err) {
+				// etcd didn't say that leadership was lost, don't release the VIP because of it
+				failures++
+				backoff := dcsBackoff(eConf, failures)
+				slog.Error("etcd error, holding the current state", "err", err, "failures", failures, "backoff", backoff)
+				sleepCtx(ctx, backoff)
+				continue
+			}
+			initialized = true
+			slog.Error("etcd error", "err", err)
+			select {
+			case <-ctx.Done():
+				break checkLoop
+			case out <- false:
+			}
+			sleepCtx(ctx, time.Duration(eConf.Interval)*time.Millisecond)
+			continue
+		}
+
+		if failures > 0 {
+			slog.Info("etcd is reachable again", "failures", failures)
+			failures = 0
+		}
+		initialized = true
+		logLeaderValue(eConf, e.key, resp.Node.Value)
+		valueErr := checkLeaderValue(resp.Node.Value)
+		if resp.Node.Dir {
+			valueErr = errors.New("is a directory")
+		}
+		if valueErr != nil && holdOnInvalidLeaderValue(eConf, e.key, resp.Node.Value, valueErr) {
 			time.Sleep(time.Duration(eConf.Interval) * time.Millisecond)
 			continue
 		}
 
-		state := resp.Node.Value == e.nodename
+		state := valueErr == nil && resp.Node.Value == e.nodename
+
+		if state && eConf.MinLeaseTTL > 0 && resp.Node.TTL > 0 && resp.Node.TTL < int64(eConf.MinLeaseTTL) {
+			slog.Warn("Key has too little of its lease left, deferring until it has been renewed", "key", e.key, "ttl_seconds", resp.Node.TTL)
+			time.Sleep(time.Duration(eConf.Interval) * time.Millisecond)
+			continue
+		}
 
 		select {
 		case <-ctx.Done():
@@ -131,3 +235,29 @@ checkLoop:
 
 	return ctx.Err()
 }
+
+// Probe reads the trigger-key once
+func (e *EtcdLeaderChecker) Probe(ctx context.Context) (string, error) {
+	return e.ReadKey(ctx, e.key)
+}
+
+// ReadKey reads key once, see KeyReader
+func (e *EtcdLeaderChecker) ReadKey(ctx context.Context, key string) (string, error) {
+	resp, err := e.get(ctx, key, &client.GetOptions{Quorum: eConf.ConsensusReadConsistency != "serializable"})
+	if client.IsKeyNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.Node.Value, nil
+}
+
+// WriteDepartureMarker sets a key that expires after departure-marker-ttl seconds
+func (e *EtcdLeaderChecker) WriteDepartureMarker(ctx context.Context) error {
+	key := eConf.DepartureMarkerPrefix + e.nodename
+	_, err := e.kapi.Set(ctx, key, time.Now().Format(time.RFC3339), &client.SetOptions{
+		TTL: time.Duration(eConf.DepartureMarkerTTL) * time.Second,
+	})
+	return err
+}
@@ -0,0 +1,118 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// kubernetesNamespaceFile holds the namespace of the pod's service account
+const kubernetesNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// KubernetesLeaderChecker takes part in a leader election through a Lease object,
+// instead of following a leader key written by e.g. Patroni.
+// The Lease is named by the trigger-key, the trigger-value is the identity of this node.
+type KubernetesLeaderChecker struct {
+	con    *vipconfig.Config
+	config leaderelection.LeaderElectionConfig
+}
+
+// NewKubernetesLeaderChecker returns a new instance, using the service account of the pod
+func NewKubernetesLeaderChecker(con *vipconfig.Config) (*KubernetesLeaderChecker, error) {
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("dcs-type kubernetes must run inside a pod: %w", err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	namespace := con.KubernetesNamespace
+	if namespace == "" {
+		b, err := ioutil.ReadFile(kubernetesNamespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes-namespace is not set and the namespace of the pod is unknown: %w", err)
+		}
+		namespace = strings.TrimSpace(string(b))
+	}
+
+	lc := &KubernetesLeaderChecker{con: con}
+	leaseDuration := time.Duration(con.KubernetesLeaseDuration) * time.Millisecond
+	lc.config = leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: con.Key, Namespace: namespace},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: con.Nodename},
+		},
+		LeaseDuration: leaseDuration,
+		// the leader gives up if it couldn't renew for this long, well before others may take over
+		RenewDeadline:   leaseDuration * 2 / 3,
+		RetryPeriod:     time.Duration(con.Interval) * time.Millisecond,
+		ReleaseOnCancel: true,
+		Name:            "vip-manager",
+	}
+	// checks the durations
+	if _, err := leaderelection.NewLeaderElector(lc.config); err != nil {
+		return nil, fmt.Errorf("kubernetes-lease-duration %d and interval %d don't fit: %w", con.KubernetesLeaseDuration, con.Interval, err)
+	}
+	slog.Info("Using Kubernetes leader election", "lease", con.Key, "namespace", namespace, "identity", con.Nodename)
+	return lc, nil
+}
+
+// GetChangeNotificationStream takes part in the election until ctx is cancelled.
+// Acquiring the Lease configures the VIP, losing it releases the VIP,
+// after which this node stands for election again.
+func (c *KubernetesLeaderChecker) GetChangeNotificationStream(ctx context.Context, out chan<- bool) error {
+	send := func(state bool) {
+		select {
+		case <-ctx.Done():
+		case out <- state:
+		}
+	}
+
+	config := c.config
+	config.Callbacks = leaderelection.LeaderCallbacks{
+		OnStartedLeading: func(context.Context) { send(true) },
+		OnStoppedLeading: func() { send(false) },
+		OnNewLeader: func(identity string) {
+			logLeaderValue(c.con, c.con.Key, identity)
+			// tells the manager the initial role of a node that doesn't lead
+			if identity != c.con.Nodename {
+				send(false)
+			}
+		},
+	}
+	for ctx.Err() == nil {
+		elector, err := leaderelection.NewLeaderElector(config)
+		if err != nil {
+			return err
+		}
+		// returns once leadership was lost or ctx is cancelled, releasing the Lease in that case
+		elector.Run(ctx)
+	}
+	return ctx.Err()
+}
+
+// Probe reads the Lease once, without standing for election
+func (c *KubernetesLeaderChecker) Probe(ctx context.Context) (string, error) {
+	record, _, err := c.config.Lock.Get(ctx)
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return record.HolderIdentity, nil
+}
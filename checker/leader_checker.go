@@ -3,6 +3,13 @@ package checker
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/cybertec-postgresql/vip-manager/vipconfig"
 )
@@ -10,24 +17,169 @@ import (
 // ErrUnsupportedEndpointType is returned for an unsupported endpoint
 var ErrUnsupportedEndpointType = errors.New("given endpoint type not supported")
 
+// maxInitialReadBackoff caps the doubling backoff of retryInitialRead
+const maxInitialReadBackoff = time.Minute
+
+// maxLoggedValueLength limits how much of an invalid leader value is logged
+const maxLoggedValueLength = 64
+
 // LeaderChecker is the interface for checking leadership
 type LeaderChecker interface {
 	GetChangeNotificationStream(ctx context.Context, out chan<- bool) error
 }
 
+// DepartureMarker is implemented by LeaderCheckers that can leave a short-lived
+// marker in the DCS, announcing that this node is shutting down gracefully.
+type DepartureMarker interface {
+	WriteDepartureMarker(ctx context.Context) error
+}
+
+// Prober is implemented by LeaderCheckers that can read the leader once,
+// reporting errors instead of releasing, without taking part in the election.
+// Probe returns the current leader, or an empty string if there is none.
+type Prober interface {
+	Probe(ctx context.Context) (string, error)
+}
+
+// KeyReader is implemented by LeaderCheckers that can read any key of the DCS
+// once, e.g. vip-list-key. ReadKey returns an empty string if the key doesn't exist.
+type KeyReader interface {
+	ReadKey(ctx context.Context, key string) (string, error)
+}
+
 // NewLeaderChecker returns a new LeaderChecker instance depending on the configuration
 func NewLeaderChecker(con *vipconfig.Config) (LeaderChecker, error) {
 	var lc LeaderChecker
 	var err error
 
+	// patroni doesn't read a key
+	if con.EndpointType != "patroni" {
+		if err = validateKey(con.Key); err != nil {
+			return nil, err
+		}
+	}
+
 	switch con.EndpointType {
 	case "consul":
 		lc, err = NewConsulLeaderChecker(con)
 	case "etcd":
 		lc, err = NewEtcdLeaderChecker(con)
+	case "kubernetes":
+		lc, err = NewKubernetesLeaderChecker(con)
+	case "patroni":
+		lc, err = NewPatroniLeaderChecker(con)
 	default:
 		err = ErrUnsupportedEndpointType
 	}
 
 	return lc, err
 }
+
+// validateKey makes sure the trigger-key can be used with etcd and consul.
+// Both accept keys with or without a leading slash, consul strips it.
+func validateKey(key string) error {
+	switch {
+	case strings.TrimSpace(key) == "":
+		return errors.New("trigger-key must not be empty")
+	case strings.ContainsAny(key, " \t\n"):
+		return fmt.Errorf("trigger-key %q must not contain whitespace", key)
+	case strings.HasSuffix(key, "/"):
+		return fmt.Errorf("trigger-key %q must not end with a slash, as it has to point to a key rather than a directory", key)
+	}
+	return nil
+}
+
+// checkLeaderValue returns an error if the value of the trigger-key
+// can't be a node name, e.g. because it is corrupted.
+func checkLeaderValue(value string) error {
+	if !utf8.ValidString(value) {
+		return errors.New("not valid UTF-8")
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return errors.New("contains control characters")
+		}
+	}
+	return nil
+}
+
+// logLeaderValue logs the observed leader of every check at debug level.
+func logLeaderValue(con *vipconfig.Config, key, value string) {
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	if len(value) > maxLoggedValueLength {
+		value = value[:maxLoggedValueLength] + "..."
+	}
+	slog.Debug("decision", "key", key, "leader", value, "nodename", con.Nodename, "match", value == con.Nodename)
+}
+
+// holdOnInvalidLeaderValue logs an invalid leader value and returns
+// whether the current state should be kept instead of releasing the VIP.
+func holdOnInvalidLeaderValue(con *vipconfig.Config, key, value string, reason error) bool {
+	if len(value) > maxLoggedValueLength {
+		value = value[:maxLoggedValueLength] + "..."
+	}
+	if con.OnInvalidLeaderValue == "hold" {
+		slog.Warn("Key holds an invalid leader value, holding the current state", "key", key, "value", value, "reason", reason)
+		return true
+	}
+	slog.Warn("Key holds an invalid leader value, releasing", "key", key, "value", value, "reason", reason)
+	return false
+}
+
+// dcsBackoff returns how long to wait after the given number of consecutive
+// failures to reach the DCS: interval, doubled on every further failure up to
+// dcs-max-backoff, plus up to a fifth of random jitter, so the nodes don't
+// retry in lockstep.
+func dcsBackoff(con *vipconfig.Config, failures int) time.Duration {
+	backoff := time.Duration(con.Interval) * time.Millisecond
+	maxBackoff := time.Duration(con.DCSMaxBackoff) * time.Millisecond
+	for i := 1; i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	if backoff > 0 {
+		backoff += time.Duration(rand.Int63n(int64(backoff)/5 + 1))
+	}
+	return backoff
+}
+
+// sleepCtx waits for d, returning false if ctx is cancelled in the meantime
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// retryInitialRead waits before retrying a failed first read of the trigger-key,
+// so a brief DCS hiccup at startup doesn't release the VIP. It returns false once
+// initial-read-retries are exhausted or ctx is cancelled, and the failure must be handled as usual.
+func retryInitialRead(ctx context.Context, con *vipconfig.Config, attempt *int, err error) bool {
+	if *attempt >= con.InitialReadRetries {
+		if *attempt > 0 {
+			slog.Error("Initial read of key failed, giving up", "key", con.Key, "attempts", *attempt+1, "err", err)
+		}
+		return false
+	}
+	backoff := time.Duration(con.InitialReadRetryAfter) * time.Millisecond
+	for i := 0; i < *attempt && backoff < maxInitialReadBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxInitialReadBackoff {
+		backoff = maxInitialReadBackoff
+	}
+	*attempt++
+	slog.Warn("Initial read of key failed, retrying", "key", con.Key, "err", err, "backoff", backoff, "retry", *attempt, "retries", con.InitialReadRetries)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(backoff):
+		return true
+	}
+}
@@ -0,0 +1,140 @@
+package checker
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// patroniMaxResponseBytes limits the responses read from the Patroni REST API
+const patroniMaxResponseBytes = 1 << 20
+
+// PatroniLeaderChecker asks the REST API of the local Patroni whether this node
+// is the leader, instead of reading the leader key from the DCS. Patroni's view
+// takes e.g. nofailover tags and the health of PostgreSQL into account.
+type PatroniLeaderChecker struct {
+	con      *vipconfig.Config
+	endpoint string
+	client   *http.Client
+}
+
+// NewPatroniLeaderChecker returns a new instance, using the first of the dcs-endpoints
+func NewPatroniLeaderChecker(con *vipconfig.Config) (*PatroniLeaderChecker, error) {
+	endpoint := strings.TrimSuffix(con.Endpoints[0], "/")
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("dcs-endpoints %q must be the http:// or https:// URL of the Patroni REST API", endpoint)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{}
+	// validated by vipconfig.NewConfig
+	transport.TLSClientConfig.MinVersion, _ = vipconfig.ParseTLSVersion(con.TLSMinVersion)
+
+	return &PatroniLeaderChecker{
+		con:      con,
+		endpoint: endpoint,
+		// a check must not take longer than the interval between checks
+		client: &http.Client{Transport: transport, Timeout: time.Duration(con.Interval) * time.Millisecond},
+	}, nil
+}
+
+// get calls the REST API and returns the status code and the body
+func (c *PatroniLeaderChecker) get(ctx context.Context, path string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, patroniMaxResponseBytes))
+	return resp.StatusCode, out, err
+}
+
+// isLeader returns whether Patroni reports this node as the leader.
+// /leader returns 200 on the leader (or the standby leader) and 503 on all other nodes.
+func (c *PatroniLeaderChecker) isLeader(ctx context.Context) (bool, error) {
+	status, _, err := c.get(ctx, "/leader")
+	if err != nil {
+		return false, err
+	}
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusServiceUnavailable:
+		return false, nil
+	}
+	return false, fmt.Errorf("Patroni REST API returned %d for /leader", status)
+}
+
+// GetChangeNotificationStream checks the status in the loop.
+// If the REST API can't be reached, the VIP is released, as Patroni may have stopped.
+func (c *PatroniLeaderChecker) GetChangeNotificationStream(ctx context.Context, out chan<- bool) error {
+	// the first read is retried on its own, see retryInitialRead
+	initialized := false
+	initialAttempts := 0
+
+	for {
+		state, err := c.isLeader(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if !initialized && retryInitialRead(ctx, c.con, &initialAttempts, err) {
+				continue
+			}
+			slog.Error("Patroni REST API error, releasing", "endpoint", c.endpoint, "err", err)
+		}
+		initialized = true
+		leader := ""
+		if state {
+			leader = c.con.Nodename
+		}
+		logLeaderValue(c.con, c.endpoint+"/leader", leader)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- state:
+		}
+		if !sleepCtx(ctx, time.Duration(c.con.Interval)*time.Millisecond) {
+			return ctx.Err()
+		}
+	}
+}
+
+// Probe asks Patroni for the leader of the cluster once
+func (c *PatroniLeaderChecker) Probe(ctx context.Context) (string, error) {
+	status, out, err := c.get(ctx, "/cluster")
+	if err != nil {
+		return "", err
+	}
+	if status != http.StatusOK {
+		return "", fmt.Errorf("Patroni REST API returned %d for /cluster", status)
+	}
+	var cluster struct {
+		Members []struct {
+			Name string `json:"name"`
+			Role string `json:"role"`
+		} `json:"members"`
+	}
+	if err := json.Unmarshal(out, &cluster); err != nil {
+		return "", fmt.Errorf("unexpected response from the Patroni REST API: %w", err)
+	}
+	for _, m := range cluster.Members {
+		if m.Role == "leader" || m.Role == "standby_leader" {
+			return m.Name, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,77 @@
+package checker
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"log/slog"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+
+	// registers the postgres driver for database/sql
+	_ "github.com/lib/pq"
+)
+
+// PrimaryChecker periodically connects to Postgres through the virtual IP
+// and verifies that it reaches a primary, not a replica.
+// It is purely observational and never moves the virtual IP.
+type PrimaryChecker struct {
+	dsn      string
+	interval time.Duration
+
+	// 1 if the VIP points to a primary, 0 if it points to a replica,
+	// -1 if that could not be determined.
+	pointsToPrimary *expvar.Int
+}
+
+// NewPrimaryChecker returns a new instance
+func NewPrimaryChecker(con *vipconfig.Config) *PrimaryChecker {
+	p := &PrimaryChecker{
+		dsn:             con.PrimaryCheckDSN,
+		interval:        time.Duration(con.PrimaryCheckInterval) * time.Millisecond,
+		pointsToPrimary: expvar.NewInt("vipmanager_vip_points_to_primary"),
+	}
+	p.pointsToPrimary.Set(-1)
+	return p
+}
+
+// Run checks the database behind the VIP until ctx is cancelled
+func (p *PrimaryChecker) Run(ctx context.Context) {
+	db, err := sql.Open("postgres", p.dsn)
+	if err != nil {
+		slog.Warn("Cannot check whether the virtual IP points to a primary", "err", err)
+		return
+	}
+	defer db.Close()
+	// always open a new connection, so we notice when the VIP moves
+	db.SetMaxIdleConns(0)
+
+	for {
+		p.check(ctx, db)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.interval):
+		}
+	}
+}
+
+func (p *PrimaryChecker) check(ctx context.Context, db *sql.DB) {
+	ctx, cancel := context.WithTimeout(ctx, p.interval)
+	defer cancel()
+
+	var inRecovery bool
+	err := db.QueryRowContext(ctx, "SELECT pg_is_in_recovery()").Scan(&inRecovery)
+	switch {
+	case err != nil:
+		slog.Warn("Cannot check whether the virtual IP points to a primary", "err", err)
+		p.pointsToPrimary.Set(-1)
+	case inRecovery:
+		slog.Error("The virtual IP points to a replica instead of the primary!")
+		p.pointsToPrimary.Set(0)
+	default:
+		p.pointsToPrimary.Set(1)
+	}
+}
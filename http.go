@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cybertec-postgresql/vip-manager/ipmanager"
+)
+
+// debugVarsHandler serves the published expvar variables like expvar.Handler,
+// but leaves out the command line, which may contain passwords passed as flags.
+func debugVarsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" {
+			return
+		}
+		if !first {
+			fmt.Fprintf(w, ",\n")
+		}
+		first = false
+		key, _ := json.Marshal(kv.Key)
+		fmt.Fprintf(w, "%s: %s", key, kv.Value)
+	})
+	fmt.Fprintf(w, "\n}\n")
+}
+
+// statusHandler serves a human-readable snapshot of the manager's state.
+func statusHandler(manager *ipmanager.IPManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(manager.Status())
+	}
+}
+
+// metricsHandler serves the numeric vipmanager_* variables in the Prometheus
+// text format, labelled with the backend specific vipmanager_labels.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var labels []string
+	if m, ok := expvar.Get("vipmanager_labels").(*expvar.Map); ok {
+		m.Do(func(kv expvar.KeyValue) {
+			if s, ok := kv.Value.(*expvar.String); ok {
+				labels = append(labels, fmt.Sprintf("%s=%s", kv.Key, strconv.Quote(s.Value())))
+			}
+		})
+	}
+	labelSet := ""
+	if len(labels) > 0 {
+		labelSet = "{" + strings.Join(labels, ",") + "}"
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	expvar.Do(func(kv expvar.KeyValue) {
+		if h, ok := kv.Value.(*ipmanager.Histogram); ok && strings.HasPrefix(kv.Key, "vipmanager_") {
+			writeHistogram(w, kv.Key, labels, h)
+			return
+		}
+		if g, ok := kv.Value.(*ipmanager.VIPGauge); ok && strings.HasPrefix(kv.Key, "vipmanager_") {
+			writeVIPGauge(w, kv.Key, labels, g)
+			return
+		}
+		v, ok := kv.Value.(*expvar.Int)
+		if !ok || !strings.HasPrefix(kv.Key, "vipmanager_") {
+			return
+		}
+		metricType := "gauge"
+		if strings.HasSuffix(kv.Key, "_total") {
+			metricType = "counter"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n%s%s %d\n", kv.Key, metricType, kv.Key, labelSet, v.Value())
+	})
+}
+
+// writeVIPGauge writes g in the Prometheus text format, a series per VIP with the vip and interface labels
+func writeVIPGauge(w io.Writer, name string, labels []string, g *ipmanager.VIPGauge) {
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	g.Do(func(l ipmanager.VIPLabels, v int64) {
+		var labelSet []string
+		for _, label := range labels {
+			// the backend may label the instance with its interface already
+			if !strings.HasPrefix(label, "vip=") && !strings.HasPrefix(label, "interface=") {
+				labelSet = append(labelSet, label)
+			}
+		}
+		labelSet = append(labelSet, "vip="+strconv.Quote(l.VIP), "interface="+strconv.Quote(l.Interface))
+		fmt.Fprintf(w, "%s{%s} %d\n", name, strings.Join(labelSet, ","), v)
+	})
+}
+
+// writeHistogram writes h in the Prometheus text format, adding the le label of each bucket
+func writeHistogram(w io.Writer, name string, labels []string, h *ipmanager.Histogram) {
+	labelSet := ""
+	if len(labels) > 0 {
+		labelSet = "{" + strings.Join(labels, ",") + "}"
+	}
+	bucketLabels := func(le string) string {
+		return "{" + strings.Join(append(append([]string(nil), labels...), "le="+strconv.Quote(le)), ",") + "}"
+	}
+
+	bounds, counts, sum, count := h.Snapshot()
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for i, bound := range bounds {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucketLabels(strconv.FormatFloat(bound, 'g', -1, 64)), counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, bucketLabels("+Inf"), count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labelSet, sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labelSet, count)
+}
+
+// requireToken rejects requests that don't carry the bearer token.
+// An empty token disables authentication.
+func requireToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveHTTP starts the optional HTTP listener used for introspection.
+func serveHTTP(address, token string, manager *ipmanager.IPManager) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", debugVarsHandler)
+	mux.HandleFunc("/status", statusHandler(manager))
+	handler := requireToken(token, mux)
+
+	go func() {
+		slog.Info("Serving HTTP endpoints", "address", address)
+		err := http.ListenAndServe(address, handler)
+		slog.Error("HTTP listener stopped", "address", address, "err", err)
+	}()
+}
+
+// servePrometheus starts the optional HTTP listener serving metrics on /metrics.
+func servePrometheus(address, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	handler := requireToken(token, mux)
+
+	go func() {
+		slog.Info("Serving Prometheus metrics", "address", address)
+		err := http.ListenAndServe(address, handler)
+		slog.Error("Prometheus listener stopped", "address", address, "err", err)
+	}()
+}
@@ -0,0 +1,36 @@
+package ipmanager
+
+// ArpOnlyConfigurer can be used when the virtual ip is managed
+// externally (e.g. through a DHCP reservation or a cloud provider),
+// but the leader still needs to send gratuitous ARP messages to
+// update the tables of nearby routers and other devices.
+// The virtual ip is never added to or removed from the interface.
+type ArpOnlyConfigurer struct {
+	*BasicConfigurer
+	announced bool
+}
+
+func newArpOnlyConfigurer(config *IPConfiguration) (*ArpOnlyConfigurer, error) {
+	b, err := newBasicConfigurer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &ArpOnlyConfigurer{BasicConfigurer: b}, nil
+}
+
+// queryAddress returns if the address has been announced by this machine
+func (c *ArpOnlyConfigurer) queryAddress() bool {
+	return c.announced
+}
+
+// deconfigureAddress only forgets about the announcement,
+// the address itself is managed externally.
+func (c *ArpOnlyConfigurer) deconfigureAddress() bool {
+	c.announced = false
+	return true
+}
+
+// verifyRelease always succeeds, as there is nothing to release.
+func (c *ArpOnlyConfigurer) verifyRelease() (bool, error) {
+	return true, nil
+}
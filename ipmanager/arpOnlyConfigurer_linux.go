@@ -0,0 +1,45 @@
+package ipmanager
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// configureAddress announces the virtual IP address using gratuitous ARP
+func (c *ArpOnlyConfigurer) configureAddress() bool {
+	if err := c.ensureArpClient(); err != nil {
+		slog.Error("Couldn't create an Arp client", "err", err)
+		c.failure = err
+		return false
+	}
+
+	slog.Info("Announcing address", "vip", c.VIP, "interface", c.Iface.Name)
+
+	err := c.announce()
+	if err != nil && !errors.Is(err, errArpBurstSuppressed) {
+		c.failure = err
+		return false
+	}
+	if c.VIP.To4() != nil && err == nil {
+		c.arpSendDirected()
+	}
+	c.failure = nil
+	c.announced = true
+	return true
+}
+
+// describeAction returns what would be done, see dryRunConfigurer
+func (c *ArpOnlyConfigurer) describeAction(configure bool) string {
+	if configure {
+		return "announce " + c.VIP.String() + " on " + c.Iface.Name + " via gratuitous ARP"
+	}
+	return "nothing, the address is managed externally"
+}
+
+// preflight checks that gratuitous ARP messages can be sent, see Check
+func (c *ArpOnlyConfigurer) preflight() (string, error) {
+	if err := c.verifyArpCapability(); err != nil {
+		return "", err
+	}
+	return "interface " + c.Iface.Name + ", gratuitous ARP available", nil
+}
@@ -0,0 +1,17 @@
+package ipmanager
+
+import (
+	"errors"
+	"log/slog"
+)
+
+// configureAddress is not supported on Windows, as sending gratuitous ARP isn't.
+func (c *ArpOnlyConfigurer) configureAddress() bool {
+	slog.Warn("Announcing address is not supported on Windows", "vip", c.VIP)
+	return false
+}
+
+// preflight fails, as sending gratuitous ARP isn't supported on Windows.
+func (c *ArpOnlyConfigurer) preflight() (string, error) {
+	return "", errors.New("announcing addresses is not supported on Windows")
+}
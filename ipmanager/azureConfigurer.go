@@ -0,0 +1,566 @@
+package ipmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// azureMetadataURL is the base URL of the Instance Metadata Service, reachable from every VM
+const azureMetadataURL = "http://169.254.169.254/metadata/"
+
+// azureMaxResponseBytes limits the responses read from the metadata service and the Resource Manager API
+const azureMaxResponseBytes = 1 << 20
+
+// API versions of the Resource Manager providers that are used
+const (
+	azureComputeAPIVersion = "2023-03-01"
+	azureNetworkAPIVersion = "2023-05-01"
+)
+
+// azurePollInterval is the time between checks whether an asynchronous operation finished
+const azurePollInterval = 2 * time.Second
+
+// The AzureConfigurer can be used to enable vip-management on VMs in Azure,
+// whenever hosting type `azure` is set. The vip is a secondary private IP
+// configuration of the leader's network interface (NIC), which is moved
+// between the NICs of the resource group through the Resource Manager API.
+// Like with Hetzner, the vip has to be configured on all VMs,
+// Azure only delivers it to the NIC it is assigned to.
+type AzureConfigurer struct {
+	*IPConfiguration
+	apiHost  string
+	client   *http.Client
+	metadata *http.Client
+
+	// serializes all operations, verifyRelease runs in the background
+	mu sync.Mutex
+
+	// this VM and its primary NIC, resolved through the metadata service
+	subscription  string
+	resourceGroup string
+	vm            string
+	nicID         string
+
+	// access token of the VM's managed identity
+	token       string
+	tokenExpiry time.Time
+
+	// why the last change of the ip configurations failed, see failureReporter
+	failure error
+}
+
+// azureNIC is a network interface as returned by the API. It is kept as a whole,
+// as an update replaces the network interface with what is sent.
+type azureNIC map[string]interface{}
+
+func newAzureConfigurer(config *IPConfiguration) (*AzureConfigurer, error) {
+	apiHost, err := apiEndpoint("azure", config.Region)
+	if err != nil {
+		return nil, err
+	}
+	if config.AzureIPConfigurationName == "" {
+		return nil, errors.New("manager-type azure requires azure-ip-configuration-name")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: config.TLSMinVersion}
+
+	return &AzureConfigurer{
+		IPConfiguration: config,
+		apiHost:         apiHost,
+		client:          &http.Client{Transport: transport},
+		// the metadata service must never be reached through a proxy
+		metadata: &http.Client{Transport: &http.Transport{}},
+	}, nil
+}
+
+// metadataGet returns a response of the metadata service
+func (c *AzureConfigurer) metadataGet(ctx context.Context, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, azureMetadataURL+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	release, err := acquireMetadataSlot(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	resp, err := c.metadata.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach the metadata service: %w", err)
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, azureMaxResponseBytes))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata service returned %s for %s: %s", resp.Status, key, truncate(string(out), maxLoggedResponseLength))
+	}
+	return out, nil
+}
+
+// accessToken returns the access token of the VM's managed identity,
+// which is renewed shortly before it expires.
+func (c *AzureConfigurer) accessToken(ctx context.Context) (string, error) {
+	if c.token != "" && time.Until(c.tokenExpiry) > time.Minute {
+		return c.token, nil
+	}
+	query := url.Values{"api-version": {"2018-02-01"}, "resource": {"https://" + c.apiHost + "/"}}
+	if c.AzureClientID != "" {
+		// selects one of several user-assigned identities
+		query.Set("client_id", c.AzureClientID)
+	}
+	out, err := c.metadataGet(ctx, "identity/oauth2/token?"+query.Encode())
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return "", fmt.Errorf("unexpected access token from the metadata service: %w", err)
+	}
+	expiresOn, err := strconv.ParseInt(result.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("unexpected expiry %q of the access token", result.ExpiresOn)
+	}
+	c.token = result.AccessToken
+	c.tokenExpiry = time.Unix(expiresOn, 0)
+	return c.token, nil
+}
+
+// request calls the Resource Manager API and decodes the JSON response into result, if any.
+// resource is either a path, or a URL returned by the API, e.g. of an asynchronous operation.
+func (c *AzureConfigurer) request(ctx context.Context, method, resource string, header http.Header, body interface{}, result interface{}) (http.Header, error) {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	apiURL := resource
+	if strings.HasPrefix(resource, "/") {
+		apiURL = "https://" + c.apiHost + resource
+	} else if u, err := url.Parse(resource); err != nil || u.Scheme != "https" || u.Host != c.apiHost {
+		// the token must never be sent anywhere else
+		return nil, fmt.Errorf("unexpected URL %q returned by the Resource Manager API", truncate(resource, maxLoggedResponseLength))
+	}
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, reader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, azureMaxResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > azureMaxResponseBytes {
+		return nil, fmt.Errorf("Azure Resource Manager API response is too large: more than %d bytes", azureMaxResponseBytes)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("Azure Resource Manager API returned %s: %s", resp.Status, truncate(string(out), maxLoggedResponseLength))
+	}
+	if result == nil || len(out) == 0 {
+		return resp.Header, nil
+	}
+	return resp.Header, json.Unmarshal(out, result)
+}
+
+// resolveVM looks up this VM and its primary NIC, once.
+func (c *AzureConfigurer) resolveVM(ctx context.Context) error {
+	if c.nicID != "" {
+		return nil
+	}
+	out, err := c.metadataGet(ctx, "instance/compute?api-version=2021-02-01")
+	if err != nil {
+		return err
+	}
+	var compute struct {
+		SubscriptionID    string `json:"subscriptionId"`
+		ResourceGroupName string `json:"resourceGroupName"`
+		Name              string `json:"name"`
+	}
+	if err := json.Unmarshal(out, &compute); err != nil {
+		return fmt.Errorf("unexpected response from the metadata service: %w", err)
+	}
+
+	var vm struct {
+		Properties struct {
+			NetworkProfile struct {
+				NetworkInterfaces []struct {
+					ID         string `json:"id"`
+					Properties struct {
+						Primary bool `json:"primary"`
+					} `json:"properties"`
+				} `json:"networkInterfaces"`
+			} `json:"networkProfile"`
+		} `json:"properties"`
+	}
+	vmPath := "/subscriptions/" + url.PathEscape(compute.SubscriptionID) +
+		"/resourceGroups/" + url.PathEscape(compute.ResourceGroupName) +
+		"/providers/Microsoft.Compute/virtualMachines/" + url.PathEscape(compute.Name)
+	if _, err := c.request(ctx, http.MethodGet, vmPath+"?api-version="+azureComputeAPIVersion, nil, nil, &vm); err != nil {
+		return err
+	}
+	nics := vm.Properties.NetworkProfile.NetworkInterfaces
+	for _, nic := range nics {
+		// a VM with a single NIC doesn't necessarily flag it as primary
+		if nic.Properties.Primary || len(nics) == 1 {
+			c.nicID = nic.ID
+		}
+	}
+	if c.nicID == "" {
+		return fmt.Errorf("VM %s has no primary network interface", compute.Name)
+	}
+	c.subscription, c.resourceGroup, c.vm = compute.SubscriptionID, compute.ResourceGroupName, compute.Name
+	slog.Info("This is an Azure VM", "vm", c.vm, "resource_group", c.resourceGroup, "nic", c.nicID)
+	return nil
+}
+
+// ownNIC returns the primary NIC of this VM
+func (c *AzureConfigurer) ownNIC(ctx context.Context) (azureNIC, error) {
+	if err := c.resolveVM(ctx); err != nil {
+		return nil, err
+	}
+	var nic azureNIC
+	_, err := c.request(ctx, http.MethodGet, c.nicID+"?api-version="+azureNetworkAPIVersion, nil, nil, &nic)
+	return nic, err
+}
+
+// nics returns all NICs of the resource group of this VM
+func (c *AzureConfigurer) nics(ctx context.Context) ([]azureNIC, error) {
+	if err := c.resolveVM(ctx); err != nil {
+		return nil, err
+	}
+	var nics []azureNIC
+	next := "/subscriptions/" + url.PathEscape(c.subscription) +
+		"/resourceGroups/" + url.PathEscape(c.resourceGroup) +
+		"/providers/Microsoft.Network/networkInterfaces?api-version=" + azureNetworkAPIVersion
+	for next != "" {
+		var result struct {
+			Value    []azureNIC `json:"value"`
+			NextLink string     `json:"nextLink"`
+		}
+		if _, err := c.request(ctx, http.MethodGet, next, nil, nil, &result); err != nil {
+			return nil, err
+		}
+		nics = append(nics, result.Value...)
+		next = result.NextLink
+	}
+	return nics, nil
+}
+
+// ipConfigurations returns the ip configurations of nic
+func (nic azureNIC) ipConfigurations() []interface{} {
+	properties, _ := nic["properties"].(map[string]interface{})
+	configs, _ := properties["ipConfigurations"].([]interface{})
+	return configs
+}
+
+// setIPConfigurations replaces the ip configurations of nic
+func (nic azureNIC) setIPConfigurations(configs []interface{}) {
+	if properties, ok := nic["properties"].(map[string]interface{}); ok {
+		properties["ipConfigurations"] = configs
+	}
+}
+
+// id returns the resource ID of nic
+func (nic azureNIC) id() string {
+	id, _ := nic["id"].(string)
+	return id
+}
+
+// azureIPConfigProperties returns the properties of an ip configuration
+func azureIPConfigProperties(config interface{}) map[string]interface{} {
+	m, _ := config.(map[string]interface{})
+	properties, _ := m["properties"].(map[string]interface{})
+	return properties
+}
+
+// isVIP returns whether an ip configuration holds the vip
+func (c *AzureConfigurer) isVIP(config interface{}) bool {
+	address, _ := azureIPConfigProperties(config)["privateIPAddress"].(string)
+	return sameIP(net.ParseIP(address), c.VIP)
+}
+
+// hasVIP returns whether the vip is an ip configuration of nic
+func (c *AzureConfigurer) hasVIP(nic azureNIC) bool {
+	for _, config := range nic.ipConfigurations() {
+		if c.isVIP(config) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeVIP removes the ip configuration of the vip from nic, and returns whether it was there
+func (c *AzureConfigurer) removeVIP(nic azureNIC) bool {
+	configs := nic.ipConfigurations()
+	kept := []interface{}{}
+	for _, config := range configs {
+		if !c.isVIP(config) {
+			kept = append(kept, config)
+		}
+	}
+	nic.setIPConfigurations(kept)
+	return len(kept) != len(configs)
+}
+
+// addVIP adds an ip configuration of the vip to nic, in the subnet of its primary ip configuration
+func (c *AzureConfigurer) addVIP(nic azureNIC) error {
+	configs := nic.ipConfigurations()
+	var subnet interface{}
+	for _, config := range configs {
+		if primary, _ := azureIPConfigProperties(config)["primary"].(bool); primary || subnet == nil {
+			subnet = azureIPConfigProperties(config)["subnet"]
+		}
+	}
+	if subnet == nil {
+		return fmt.Errorf("network interface %s has no subnet", nic.id())
+	}
+	version := "IPv4"
+	if c.VIP.To4() == nil {
+		version = "IPv6"
+	}
+	nic.setIPConfigurations(append(configs, map[string]interface{}{
+		"name": c.AzureIPConfigurationName,
+		"properties": map[string]interface{}{
+			"privateIPAddress":          c.VIP.String(),
+			"privateIPAllocationMethod": "Static",
+			"privateIPAddressVersion":   version,
+			"subnet":                    subnet,
+		},
+	}))
+	return nil
+}
+
+// updateNIC replaces nic and waits for the asynchronous operation to finish.
+// The etag makes the update fail if the NIC was changed in the meantime.
+func (c *AzureConfigurer) updateNIC(ctx context.Context, nic azureNIC) error {
+	header := http.Header{}
+	if etag, ok := nic["etag"].(string); ok {
+		header.Set("If-Match", etag)
+	}
+	respHeader, err := c.request(ctx, http.MethodPut, nic.id()+"?api-version="+azureNetworkAPIVersion, header, nic, nil)
+	if err != nil {
+		return err
+	}
+	if operation := respHeader.Get("Azure-AsyncOperation"); operation != "" {
+		return c.waitOperation(ctx, operation)
+	}
+	return nil
+}
+
+// waitOperation polls an asynchronous operation until it is done or ctx expires.
+func (c *AzureConfigurer) waitOperation(ctx context.Context, operation string) error {
+	for {
+		var result struct {
+			Status string `json:"status"`
+			Error  *struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if _, err := c.request(ctx, http.MethodGet, operation, nil, nil, &result); err != nil {
+			return err
+		}
+		switch result.Status {
+		case "Succeeded":
+			return nil
+		case "Failed", "Canceled":
+			if result.Error != nil {
+				return fmt.Errorf("operation %s: %s: %s", strings.ToLower(result.Status), result.Error.Code, result.Error.Message)
+			}
+			return fmt.Errorf("operation %s", strings.ToLower(result.Status))
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("operation didn't finish in time: %w", ctx.Err())
+		case <-time.After(azurePollInterval):
+		}
+	}
+}
+
+// move removes the vip from any other NIC of the resource group, then adds it to this VM's NIC.
+func (c *AzureConfigurer) move(ctx context.Context) error {
+	nics, err := c.nics(ctx)
+	if err != nil {
+		return err
+	}
+	var own azureNIC
+	for _, nic := range nics {
+		if strings.EqualFold(nic.id(), c.nicID) {
+			own = nic
+			continue
+		}
+		if c.removeVIP(nic) {
+			slog.Info("Removing ip configuration from the previous network interface", "vip", c.VIP, "nic", nic.id())
+			if err := c.updateNIC(ctx, nic); err != nil {
+				return err
+			}
+		}
+	}
+	if own == nil {
+		return fmt.Errorf("network interface %s not found in resource group %s", c.nicID, c.resourceGroup)
+	}
+	if c.hasVIP(own) {
+		// already there
+		return nil
+	}
+	slog.Info("Adding ip configuration", "vip", c.VIP, "nic", c.nicID)
+	if err := c.addVIP(own); err != nil {
+		return err
+	}
+	return c.updateNIC(ctx, own)
+}
+
+// configured returns whether the vip is an ip configuration of this VM's NIC
+func (c *AzureConfigurer) configured() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.QueryTimeout)*time.Millisecond)
+	defer cancel()
+
+	var nic azureNIC
+	err := c.retryQuery("Azure Resource Manager API query", func() (err error) {
+		nic, err = c.ownNIC(ctx)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return c.hasVIP(nic), nil
+}
+
+// queryAddress returns whether the vip is an ip configuration of this VM's NIC
+func (c *AzureConfigurer) queryAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	configured, err := c.configured()
+	if err != nil {
+		slog.Error("Error while querying Azure ip configurations", "err", err)
+		return false
+	}
+	return configured
+}
+
+// preflight reads this VM's NIC without changing it, see Check
+func (c *AzureConfigurer) preflight() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	configured, err := c.configured()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("VM %s, network interface %s, vip configured here: %t", c.vm, c.nicID, configured), nil
+}
+
+// configureAddress moves the ip configuration of the vip to this VM's NIC
+func (c *AzureConfigurer) configureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ConfigureTimeout)*time.Millisecond)
+	defer cancel()
+
+	err := c.retryConfigure("Azure ip configuration move", func() error {
+		return c.move(ctx)
+	})
+	if err != nil {
+		slog.Error("Error while moving Azure ip configuration", "err", err)
+		c.failure = err
+		return false
+	}
+	c.failure = nil
+	return true
+}
+
+// deconfigureAddress removes the ip configuration of the vip from this VM's NIC,
+// so the new leader doesn't have to.
+func (c *AzureConfigurer) deconfigureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ConfigureTimeout)*time.Millisecond)
+	defer cancel()
+
+	err := c.retryDeconfigure("Azure ip configuration removal", func() error {
+		nic, err := c.ownNIC(ctx)
+		if err != nil || !c.removeVIP(nic) {
+			return err
+		}
+		slog.Info("Removing ip configuration", "vip", c.VIP, "nic", c.nicID)
+		return c.updateNIC(ctx, nic)
+	})
+	if err != nil {
+		slog.Error("Error while removing Azure ip configuration", "err", err)
+		c.failure = err
+		return false
+	}
+	c.failure = nil
+	return true
+}
+
+// describeAction returns what would be done, see dryRunConfigurer
+func (c *AzureConfigurer) describeAction(configure bool) string {
+	if configure {
+		return "remove the ip configuration of " + c.VIP.String() + " from other network interfaces, then add it as " +
+			c.AzureIPConfigurationName + " to the primary network interface of this VM"
+	}
+	return "remove the ip configuration of " + c.VIP.String() + " from the primary network interface of this VM"
+}
+
+func (c *AzureConfigurer) lastFailure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failure
+}
+
+func (c *AzureConfigurer) cleanupArp() {
+	// Azure delivers the vip to the NIC, no ARP involved.
+}
+
+// labels identifies this VM, once it is resolved
+func (c *AzureConfigurer) labels() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.vm == "" {
+		return nil
+	}
+	return map[string]string{"vm": c.vm, "resource_group": c.resourceGroup}
+}
@@ -1,9 +1,14 @@
 package ipmanager
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net"
 	"strings"
+	"text/template"
+	"time"
 
 	arp "github.com/mdlayher/arp"
 )
@@ -16,10 +21,37 @@ import (
 // nearby routers and other devices.
 type BasicConfigurer struct {
 	*IPConfiguration
-	arpClient  *arp.Client
-	ntecontext uint32 //used by Windows to delete IP address
+	arpClient *arp.Client
+	// sends the gratuitous ARP messages on arp-interface, nil without it
+	announceConn net.PacketConn
+	ntecontext   uint32 //used by Windows to delete IP address
+	label        string
+	// why the last change of the address failed, see failureReporter
+	failure error
+	// start of the last round of announcements, see min-arp-burst-interval
+	lastBurst time.Time
 }
 
+// errArpBurstSuppressed is returned instead of announcing the VIP,
+// if the last round of announcements started less than min-arp-burst-interval ago.
+var errArpBurstSuppressed = errors.New("announcement suppressed by min-arp-burst-interval")
+
+// startBurst returns whether a round of announcements may start now, and records it if so.
+func (c *BasicConfigurer) startBurst() bool {
+	if c.MinArpBurstInterval > 0 && !c.lastBurst.IsZero() {
+		if since := time.Since(c.lastBurst); since < time.Duration(c.MinArpBurstInterval)*time.Millisecond {
+			slog.Info("Suppressing the announcement of the virtual ip, the last one was sent too recently",
+				"vip", c.VIP, "since", since.Round(time.Millisecond), "min_interval_ms", c.MinArpBurstInterval)
+			return false
+		}
+	}
+	c.lastBurst = time.Now()
+	return true
+}
+
+// maxLabelLength is the longest address label the kernel accepts (IFNAMSIZ - 1)
+const maxLabelLength = 15
+
 func newBasicConfigurer(config *IPConfiguration) (*BasicConfigurer, error) {
 	c := &BasicConfigurer{IPConfiguration: config, ntecontext: 0}
 	if c.Iface.HardwareAddr == nil || c.Iface.HardwareAddr.String() == "00:00:00:00:00:00" {
@@ -27,9 +59,108 @@ func newBasicConfigurer(config *IPConfiguration) (*BasicConfigurer, error) {
 as its hardware address is the local address (00:00:00:00:00:00),
 which prohibits sending of gratuitous ARP messages`)
 	}
+	label, err := renderLabel(config)
+	if err != nil {
+		return nil, err
+	}
+	c.label = label
+	warnVIPOnOtherInterface(config)
+	if config.VerifyArpCapability && config.GratuitousArp {
+		if err := c.verifyArpCapability(); err != nil {
+			return nil, err
+		}
+	}
 	return c, nil
 }
 
+func (c *BasicConfigurer) lastFailure() error {
+	return c.failure
+}
+
+// checkHostAddress guards against configuring the host's own address as
+// virtual IP, as releasing it would cut the machine off the network.
+// This is assumed if the VIP is already assigned to the interface at startup
+// and is the only address of its family there.
+// The arp_only configurer never removes the address, so it isn't checked there.
+func checkHostAddress(config *IPConfiguration) error {
+	addrs, err := config.Iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	isVIP := false
+	others := 0
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || (ipnet.IP.To4() == nil) != (config.VIP.To4() == nil) || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.Equal(config.VIP) {
+			isVIP = true
+		} else {
+			others++
+		}
+	}
+	if isVIP && others == 0 {
+		err = fmt.Errorf("virtual IP %s is the only address of %s, it looks like the host's own address and releasing it would cut this machine off; use host-address-check=warn if that's intended", config.VIP, config.Iface.Name)
+		if config.HostAddressCheck == "warn" {
+			slog.Warn(err.Error())
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// warnVIPOnOtherInterface warns if the VIP is assigned to another interface than
+// the configured one, e.g. by a run with a different interface setting. It is
+// added to the configured interface as usual, but not removed from the other one.
+func warnVIPOnOtherInterface(config *IPConfiguration) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, iface := range ifaces {
+		if iface.Name == config.Iface.Name {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(config.VIP) {
+				slog.Warn("The virtual ip is assigned to another interface, it has to be removed there by hand",
+					"vip", config.VIP, "interface", iface.Name, "configured_interface", config.Iface.Name)
+			}
+		}
+	}
+}
+
+// renderLabel returns the address label generated from the alias template,
+// or an empty string if no template is set.
+func renderLabel(config *IPConfiguration) (string, error) {
+	if config.AliasTemplate == "" {
+		return "", nil
+	}
+	tmpl, err := template.New("alias").Parse(config.AliasTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid alias-template: %w", err)
+	}
+	var b bytes.Buffer
+	err = tmpl.Execute(&b, struct{ Iface, VIPName string }{config.Iface.Name, config.VIPName})
+	if err != nil {
+		return "", fmt.Errorf("invalid alias-template: %w", err)
+	}
+	label := b.String()
+	if len(label) > maxLabelLength {
+		return "", fmt.Errorf("address label %q is longer than %d characters", label, maxLabelLength)
+	}
+	if !strings.HasPrefix(label, config.Iface.Name) {
+		return "", fmt.Errorf("address label %q must start with the interface name %s", label, config.Iface.Name)
+	}
+	return label, nil
+}
+
 // queryAddress returns if the address is assigned
 func (c *BasicConfigurer) queryAddress() bool {
 	iface, err := net.InterfaceByName(c.Iface.Name)
@@ -51,5 +182,15 @@ func (c *BasicConfigurer) queryAddress() bool {
 func (c *BasicConfigurer) cleanupArp() {
 	if c.arpClient != nil {
 		c.arpClient.Close()
+		c.arpClient = nil
+	}
+	if c.announceConn != nil {
+		c.announceConn.Close()
+		c.announceConn = nil
 	}
 }
+
+// labels identifies the interface the virtual IP is configured on
+func (c *BasicConfigurer) labels() map[string]string {
+	return map[string]string{"interface": c.Iface.Name}
+}
@@ -1,12 +1,26 @@
 package ipmanager
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
 	"net"
+	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	arp "github.com/mdlayher/arp"
+	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/raw"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv6"
 )
 
 const (
@@ -20,22 +34,25 @@ var (
 
 // configureAddress assigns virtual IP address
 func (c *BasicConfigurer) configureAddress() bool {
-	if c.arpClient == nil {
-		err := c.createArpClient()
-		if err != nil {
-			log.Fatalf("Couldn't create an Arp client: %s", err)
+	if c.GratuitousArp {
+		if err := c.ensureArpClient(); err != nil {
+			slog.Error("Couldn't create an Arp client", "err", err)
+			os.Exit(1)
 		}
 	}
 
-	log.Printf("Configuring address %s on %s", c.getCIDR(), c.Iface.Name)
+	slog.Info("Configuring address", "vip", c.getCIDR(), "interface", c.Iface.Name)
 
 	result := c.runAddressConfiguration("add")
 
-	if result {
+	if result && c.GratuitousArp {
 		// For now it is save to say that also working even if a
 		// gratuitous arp message could not be send but logging an
 		// errror should be enough.
-		_ = c.arpSendGratuitous()
+		err := c.announce()
+		if c.VIP.To4() != nil && !errors.Is(err, errArpBurstSuppressed) {
+			c.arpSendDirected()
+		}
 	}
 
 	return result
@@ -43,28 +60,228 @@ func (c *BasicConfigurer) configureAddress() bool {
 
 // deconfigureAddress drops virtual IP address
 func (c *BasicConfigurer) deconfigureAddress() bool {
-	log.Printf("Removing address %s on %s", c.getCIDR(), c.Iface.Name)
+	slog.Info("Removing address", "vip", c.getCIDR(), "interface", c.Iface.Name)
 	return c.runAddressConfiguration("delete")
 }
 
 func (c *BasicConfigurer) runAddressConfiguration(action string) bool {
-	cmd := exec.Command("ip", "addr", action,
-		c.getCIDR(),
-		"dev", c.Iface.Name)
+	retry := c.retryConfigure
+	if action == "delete" {
+		retry = c.retryDeconfigure
+		if c.RoutingTable > 0 {
+			// removed first, the route may outlive its source address;
+			// this only fails if the route is gone already
+			if err := c.runIP(c.ipRouteArgs("delete")); err != nil {
+				slog.Debug("Couldn't remove the route of the virtual ip", "vip", c.VIP, "table", c.RoutingTable, "err", err)
+			}
+		}
+	}
+	what := "ip address " + action
+	err := retry(what, func() error {
+		return c.runIP(c.ipAddressArgs(action))
+	})
+	if err == nil && action == "add" && c.RoutingTable > 0 {
+		what = "ip route replace"
+		err = retry(what, func() error {
+			return c.runIP(c.ipRouteArgs("replace"))
+		})
+	}
+	c.failure = err
+	if err != nil {
+		slog.Error("Error running "+what, "vip", c.VIP, "interface", c.Iface.Name, "err", err)
+		return false
+	}
+	return true
+}
+
+// runIP runs the ip command with args
+func (c *BasicConfigurer) runIP(args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ConfigureTimeout)*time.Millisecond)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "ip", args...)
 	output, err := cmd.CombinedOutput()
 
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %d ms", c.ConfigureTimeout)
+	}
+
 	switch err.(type) {
 	case *exec.ExitError:
-		log.Printf("Got error %s", output)
+		if strings.Contains(string(output), "Operation not permitted") {
+			// retrying won't help
+			return fmt.Errorf("%w: missing CAP_NET_ADMIN to run ip %s %s on %s: %s",
+				errPermanent, args[0], args[1], c.Iface.Name, strings.TrimSpace(string(output)))
+		}
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
+	}
+	return err
+}
 
-		return false
+// ipAddressArgs returns the arguments of the ip command that adds or deletes the VIP
+func (c *BasicConfigurer) ipAddressArgs(action string) []string {
+	args := []string{"addr", action,
+		c.getCIDR(),
+		"dev", c.Iface.Name}
+	if c.label != "" {
+		// on delete, the kernel only removes the address if the label matches,
+		// so an address of the same name configured by someone else is left alone
+		args = append(args, "label", c.label)
+	}
+	if action == "add" && (c.NoPrefixRoute || c.RoutingTable > 0) {
+		// the route for the subnet stays with the host's own address,
+		// so adding and removing the VIP never changes routing,
+		// or it is added to routing-table by ipRouteArgs
+		args = append(args, "noprefixroute")
+	} else if action == "add" && c.RouteMetric > 0 {
+		args = append(args, "metric", strconv.Itoa(c.RouteMetric))
 	}
+	if action == "add" && c.SkipDAD && c.VIP.To4() == nil {
+		// sets IFA_F_NODAD, so the address is usable right away
+		args = append(args, "nodad")
+	}
+	return args
+}
+
+// ipRouteArgs returns the arguments of the ip command that adds or deletes
+// the route for the subnet of the VIP in routing-table
+func (c *BasicConfigurer) ipRouteArgs(action string) []string {
+	subnet := net.IPNet{IP: c.VIP.Mask(c.Netmask), Mask: c.Netmask}
+	args := []string{"route", action,
+		subnet.String(),
+		"dev", c.Iface.Name,
+		"src", c.VIP.String(),
+		"table", strconv.Itoa(c.RoutingTable)}
+	if c.RouteMetric > 0 {
+		args = append(args, "metric", strconv.Itoa(c.RouteMetric))
+	}
+	return args
+}
+
+// DetectInterface returns the interface with the most specific route to vip,
+// i.e. the route of its subnet or else the default route. It is used if no
+// interface is configured. If several interfaces qualify, tieBreak decides:
+// "error" fails, "address" prefers the one with an address of its own in the
+// subnet and "name" the one matching namePattern.
+func DetectInterface(vip net.IP, tieBreak, namePattern string) (string, error) {
+	family := "-4"
+	if vip.To4() == nil {
+		family = "-6"
+	}
+	output, err := exec.Command("ip", family, "-o", "route", "show", "table", "main", "match", vip.String()).CombinedOutput()
 	if err != nil {
-		log.Printf("Error running ip address %s %s on %s: %s",
-			action, c.VIP, c.Iface.Name, err)
-		return false
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(string(output)))
 	}
-	return true
+	return pickInterface(vip, string(output), tieBreak, namePattern)
+}
+
+// routeCandidate is an interface with a route to the VIP. src is the source
+// address of the route, set if the interface has an address in the subnet.
+type routeCandidate struct {
+	dev string
+	src string
+}
+
+// pickInterface selects the interface for vip from routes, the output of
+// ip -o route show match, see DetectInterface
+func pickInterface(vip net.IP, routes, tieBreak, namePattern string) (string, error) {
+	bits := 32
+	if vip.To4() == nil {
+		bits = 128
+	}
+	best := -1
+	var candidates []routeCandidate
+	for _, line := range strings.Split(routes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		prefix := bits
+		if fields[0] == "default" {
+			prefix = 0
+		} else if _, dst, err := net.ParseCIDR(fields[0]); err == nil {
+			prefix, _ = dst.Mask.Size()
+		}
+		var candidate routeCandidate
+		for i := 1; i < len(fields)-1; i++ {
+			switch fields[i] {
+			case "dev":
+				candidate.dev = fields[i+1]
+			case "src":
+				candidate.src = fields[i+1]
+			}
+		}
+		if candidate.dev == "" || prefix < best {
+			continue
+		}
+		if prefix > best {
+			best, candidates = prefix, nil
+		}
+		candidates = appendCandidate(candidates, candidate)
+	}
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("no route to %s", vip)
+	case 1:
+		return candidates[0].dev, nil
+	}
+
+	names := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		names[i] = candidate.dev
+	}
+	slog.Info("Several interfaces have a route to the virtual ip", "vip", vip, "candidates", names, "interface-tie-break", tieBreak)
+	var preferred []string
+	for _, candidate := range candidates {
+		switch tieBreak {
+		case "address":
+			if candidate.src != "" {
+				preferred = append(preferred, candidate.dev)
+			}
+		case "name":
+			if ok, _ := path.Match(namePattern, candidate.dev); ok {
+				preferred = append(preferred, candidate.dev)
+			}
+		}
+	}
+	switch {
+	case len(preferred) == 1:
+		return preferred[0], nil
+	case tieBreak == "address" || tieBreak == "name":
+		return "", fmt.Errorf("several interfaces have a route to %s: %s, interface-tie-break %s prefers %d of them",
+			vip, strings.Join(names, ", "), tieBreak, len(preferred))
+	default:
+		return "", fmt.Errorf("several interfaces have a route to %s: %s", vip, strings.Join(names, ", "))
+	}
+}
+
+// appendCandidate appends candidate unless its interface is listed already,
+// in which case a source address is kept
+func appendCandidate(list []routeCandidate, candidate routeCandidate) []routeCandidate {
+	for i, l := range list {
+		if l.dev == candidate.dev {
+			if l.src == "" {
+				list[i].src = candidate.src
+			}
+			return list
+		}
+	}
+	return append(list, candidate)
+}
+
+// describeAction returns the ip command that would be run, see dryRunConfigurer
+func (c *BasicConfigurer) describeAction(configure bool) string {
+	if configure {
+		action := "ip " + strings.Join(c.ipAddressArgs("add"), " ")
+		if c.RoutingTable > 0 {
+			action += ", ip " + strings.Join(c.ipRouteArgs("replace"), " ")
+		}
+		if !c.GratuitousArp {
+			return action
+		}
+		return action + ", then announce it via gratuitous ARP"
+	}
+	return "ip " + strings.Join(c.ipAddressArgs("delete"), " ")
 }
 
 func (c *BasicConfigurer) createArpClient() error {
@@ -72,39 +289,369 @@ func (c *BasicConfigurer) createArpClient() error {
 	var arpClient *arp.Client
 	for i := 0; i < c.RetryNum; i++ {
 		arpClient, err = arp.Dial(&c.Iface)
+		if errors.Is(err, os.ErrPermission) {
+			return arpDialError(c.Iface.Name, err)
+		}
 		if err != nil {
-			log.Printf("Problems with producing the arp client: %s", err)
+			slog.Warn("Problems with producing the arp client", "err", err)
 		} else {
 			break
 		}
 		time.Sleep(time.Duration(c.RetryAfter) * time.Millisecond)
 	}
 	if err != nil {
-		log.Print("too many retries")
+		slog.Error("too many retries")
 		return err
 	}
 	c.arpClient = arpClient
+	if c.ArpInterface != "" {
+		return c.createAnnounceConn()
+	}
+	return nil
+}
+
+// createAnnounceConn opens a raw socket on arp-interface for the gratuitous ARP
+// messages. arp.Client can't be used there, as it requires an IPv4 address on
+// the interface, which e.g. the members of a bond or bridge usually don't have.
+func (c *BasicConfigurer) createAnnounceConn() error {
+	if c.announceConn != nil {
+		c.announceConn.Close()
+		c.announceConn = nil
+	}
+	iface, err := net.InterfaceByName(c.ArpInterface)
+	if err != nil {
+		return fmt.Errorf("arp-interface %s: %w", c.ArpInterface, err)
+	}
+	conn, err := raw.ListenPacket(iface, uint16(ethernet.EtherTypeARP), nil)
+	if err != nil {
+		return fmt.Errorf("arp-interface: %w", arpDialError(c.ArpInterface, err))
+	}
+	c.announceConn = conn
+	return nil
+}
+
+// arpSourceMAC returns the sender hardware address of the ARP announcements,
+// arp-source-mac or the hardware address of the interface
+func (c *BasicConfigurer) arpSourceMAC() net.HardwareAddr {
+	if c.ArpSourceMAC != nil {
+		return c.ArpSourceMAC
+	}
+	return c.Iface.HardwareAddr
+}
+
+// writeAnnouncement sends an ARP announcement to dst, on arp-interface if it is set
+func (c *BasicConfigurer) writeAnnouncement(p *arp.Packet, dst net.HardwareAddr) error {
+	if c.announceConn == nil {
+		return c.arpClient.WriteTo(p, dst)
+	}
+	pb, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	f := &ethernet.Frame{
+		Destination: dst,
+		Source:      p.SenderHardwareAddr,
+		EtherType:   ethernet.EtherTypeARP,
+		Payload:     pb,
+	}
+	fb, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = c.announceConn.WriteTo(fb, &raw.Addr{HardwareAddr: dst})
+	return err
+}
+
+// verifyArpCapability opens the raw socket used for gratuitous ARP,
+// without sending anything, to catch missing privileges at startup.
+func (c *BasicConfigurer) verifyArpCapability() error {
+	arpClient, err := arp.Dial(&c.Iface)
+	if err != nil {
+		return arpDialError(c.Iface.Name, err)
+	}
+	c.arpClient = arpClient
+	return nil
+}
+
+// arpDialError explains why the raw socket for gratuitous ARP couldn't be opened,
+// naming the missing capability if that was the reason
+func arpDialError(iface string, err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("missing CAP_NET_RAW to send gratuitous ARP messages on %s: %w", iface, err)
+	}
+	return fmt.Errorf("cannot send gratuitous ARP messages on %s: %w", iface, err)
+}
+
+// bits of the capability sets, see capabilities(7)
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+)
+
+// effectiveCapabilities returns the effective capability set of this process
+func effectiveCapabilities() (uint64, error) {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		return strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+	}
+	return 0, errors.New("no effective capabilities in /proc/self/status")
+}
+
+// checkCapabilities fails if this process lacks CAP_NET_ADMIN to add the VIP or,
+// with gratuitous-arp, CAP_NET_RAW to announce it, so that is noticed at startup
+// rather than on the first failover. If the capabilities can't be read, it only warns.
+func (c *BasicConfigurer) checkCapabilities() error {
+	caps, err := effectiveCapabilities()
+	if err != nil {
+		slog.Warn("Couldn't check the capabilities of this process", "err", err)
+		return nil
+	}
+	if caps&(1<<capNetAdmin) == 0 {
+		return fmt.Errorf("missing CAP_NET_ADMIN to add addresses to %s, run vip-manager as root or grant it, e.g. with AmbientCapabilities in the systemd unit", c.Iface.Name)
+	}
+	if c.GratuitousArp && caps&(1<<capNetRaw) == 0 {
+		return fmt.Errorf("missing CAP_NET_RAW to send gratuitous ARP messages on %s, run vip-manager as root or grant it, e.g. with AmbientCapabilities in the systemd unit", c.Iface.Name)
+	}
+	return nil
+}
+
+// preflight checks the privileges needed to configure the VIP, without configuring it, see Check
+func (c *BasicConfigurer) preflight() (string, error) {
+	caps, err := effectiveCapabilities()
+	if err != nil {
+		return "", fmt.Errorf("cannot read the capabilities of this process: %w", err)
+	}
+	if caps&(1<<capNetAdmin) == 0 {
+		return "", fmt.Errorf("cannot add addresses to %s, missing CAP_NET_ADMIN", c.Iface.Name)
+	}
+	if !c.GratuitousArp {
+		return fmt.Sprintf("interface %s, CAP_NET_ADMIN available", c.Iface.Name), nil
+	}
+	if err := c.verifyArpCapability(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("interface %s, CAP_NET_ADMIN and gratuitous ARP available", c.Iface.Name), nil
+}
+
+// arpSenderIP returns the sender protocol address used in ARP announcements.
+// Depending on arp-announce-from, this is either the VIP (the default)
+// or the interface's own IPv4 address, as some switches expect one or the other.
+func (c *BasicConfigurer) arpSenderIP() net.IP {
+	if c.ArpAnnounceFrom == "host" {
+		if ip := interfaceIPv4(&c.Iface); ip != nil {
+			return ip
+		}
+		slog.Warn("Interface has no IPv4 address, announcing from the virtual ip instead", "interface", c.Iface.Name, "vip", c.VIP)
+	}
+	return c.VIP
+}
+
+// announce sends arp-repeat-count announcements of the virtual IP,
+// it only fails if none of them could be sent.
+func (c *BasicConfigurer) announce() error {
+	if !c.startBurst() {
+		return errArpBurstSuppressed
+	}
+	err := c.sendAnnouncement()
+	sent := err == nil
+	for i := 1; i < c.ArpRepeatCount; i++ {
+		time.Sleep(time.Duration(c.ArpRepeatInterval) * time.Millisecond)
+		if err = c.sendAnnouncement(); err == nil {
+			sent = true
+		}
+	}
+	if sent {
+		return nil
+	}
+	return err
+}
+
+// sendAnnouncement sends a gratuitous ARP request and reply for an IPv4 VIP,
+// and an unsolicited neighbor advertisement for an IPv6 VIP.
+func (c *BasicConfigurer) sendAnnouncement() error {
+	if c.VerifyArpSent {
+		return c.verifySent(c.sendAnnouncementOnce)
+	}
+	return c.sendAnnouncementOnce()
+}
+
+func (c *BasicConfigurer) sendAnnouncementOnce() error {
+	if c.VIP.To4() == nil {
+		err := c.ndpSendUnsolicited()
+		if err != nil {
+			slog.Error("Couldn't send unsolicited neighbor advertisement", "err", err)
+		}
+		return err
+	}
+	return c.arpSendGratuitous()
+}
+
+// verifySent compares the transmit counter of the interface before and after send,
+// and warns if it didn't change although send succeeded. Writing to the socket
+// succeeds even if the packets are dropped before they leave, e.g. if the link is down.
+func (c *BasicConfigurer) verifySent(send func() error) error {
+	before, err := txPackets(c.Iface.Name)
+	if err != nil {
+		slog.Warn("Couldn't verify that the announcement was sent", "err", err)
+		return send()
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	after, err := txPackets(c.Iface.Name)
+	if err != nil {
+		slog.Warn("Couldn't verify that the announcement was sent", "err", err)
+		return nil
+	}
+	if after == before {
+		slog.Warn("No packets were transmitted while announcing the virtual ip, neighbors might still use a stale address", "interface", c.Iface.Name, "vip", c.VIP)
+	}
+	return nil
+}
+
+// txPackets returns the number of packets transmitted on an interface
+func txPackets(iface string) (uint64, error) {
+	out, err := ioutil.ReadFile(filepath.Join("/sys/class/net", iface, "statistics/tx_packets"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// promoteSecondaries enables promote_secondaries on an interface, so that deleting
+// the primary address of an IPv4 subnet promotes one of its secondary addresses
+// instead of deleting them all, see multiConfigurer.keepSharedSubnet.
+func promoteSecondaries(iface string) error {
+	return ioutil.WriteFile(filepath.Join("/proc/sys/net/ipv4/conf", iface, "promote_secondaries"), []byte("1\n"), 0644)
+}
+
+// ensureArpClient creates the ARP client, unless the VIP is an IPv6 address
+// which is announced through NDP instead.
+func (c *BasicConfigurer) ensureArpClient() error {
+	if c.VIP.To4() == nil || c.arpClient != nil {
+		return nil
+	}
+	return c.createArpClient()
+}
+
+// refreshArp repeats the announcement of the virtual IP
+func (c *BasicConfigurer) refreshArp() error {
+	if !c.GratuitousArp {
+		return nil
+	}
+	if err := c.ensureArpClient(); err != nil {
+		return err
+	}
+	if !c.startBurst() {
+		return errArpBurstSuppressed
+	}
+	return c.sendAnnouncement()
+}
+
+// ndpSendUnsolicited sends an unsolicited neighbor advertisement (RFC 4861, section 7.2.6)
+// for the VIP to all nodes on the link, the IPv6 equivalent of gratuitous ARP.
+func (c *BasicConfigurer) ndpSendUnsolicited() error {
+	conn, err := icmp.ListenPacket("ip6:ipv6-icmp", "::")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	pc := conn.IPv6PacketConn()
+	if err = pc.SetMulticastInterface(&c.Iface); err != nil {
+		return err
+	}
+	// receivers drop neighbor discovery messages with any other hop limit
+	if err = pc.SetMulticastHopLimit(255); err != nil {
+		return err
+	}
+
+	// flags and reserved, target address, target link-layer address option
+	body := make([]byte, 4+net.IPv6len+8)
+	body[0] = 0x20 // override, neither router nor solicited
+	copy(body[4:], c.VIP.To16())
+	body[4+net.IPv6len] = 2   // option type: target link-layer address
+	body[4+net.IPv6len+1] = 1 // option length in units of 8 octets
+	copy(body[4+net.IPv6len+2:], c.Iface.HardwareAddr)
+
+	msg := icmp.Message{Type: ipv6.ICMPTypeNeighborAdvertisement, Body: &icmp.RawBody{Data: body}}
+	// the kernel computes the checksum of ICMPv6 messages
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err = conn.WriteTo(b, &net.IPAddr{IP: net.IPv6linklocalallnodes, Zone: c.Iface.Name}); err != nil {
+		return err
+	}
+	slog.Info("Sent unsolicited neighbor advertisement")
 	return nil
 }
 
 // sends a gratuitous ARP request and reply
 func (c *BasicConfigurer) arpSendGratuitous() error {
+	gratuitousReplyPackage, gratuitousRequestPackage, err := c.gratuitousArpPackets()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < c.RetryNum; i++ {
+		errReply := c.writeAnnouncement(gratuitousReplyPackage, ethernetBroadcast)
+		if err != nil {
+			slog.Warn("Couldn't write to the arpClient", "err", errReply)
+		} else {
+			slog.Info("Sent gratuitous ARP reply")
+		}
+
+		errRequest := c.writeAnnouncement(gratuitousRequestPackage, ethernetBroadcast)
+		if err != nil {
+			slog.Warn("Couldn't write to the arpClient", "err", errRequest)
+		} else {
+			slog.Info("Sent gratuitous ARP request")
+		}
+
+		if errReply != nil || errRequest != nil {
+			/* If something went wrong while sending the packages, we'll recreate the ARP client for the next try,
+			 * to avoid having a stale client that gives "network is down" error.
+			 */
+			err = c.createArpClient()
+		} else {
+			//TODO: think about whether to leave this out to achieve simple repeat sending of GARP packages
+			break
+		}
+		time.Sleep(time.Duration(c.RetryAfter) * time.Millisecond)
+	}
+	if err != nil {
+		slog.Error("too many retries")
+		return err
+	}
+
+	return nil
+}
+
+// gratuitousArpPackets builds the gratuitous ARP reply and request announcing the VIP
+func (c *BasicConfigurer) gratuitousArpPackets() (*arp.Packet, *arp.Packet, error) {
 	/* While RFC 2002 does not say whether a gratuitous ARP request or reply is preferred
 	 * to update ones neighbours' MAC tables, the Wireshark Wiki recommends sending both.
 	 *		https://wiki.wireshark.org/Gratuitous_ARP
 	 * This site also recommends sending a reply, as requests might be ignored by some hardware:
 	 *		https://support.citrix.com/article/CTX112701
 	 */
+	senderIP := c.arpSenderIP()
 	gratuitousReplyPackage, err := arp.NewPacket(
 		arpReplyOp,
-		c.Iface.HardwareAddr,
-		c.VIP,
-		c.Iface.HardwareAddr,
+		c.arpSourceMAC(),
+		senderIP,
+		c.arpSourceMAC(),
 		c.VIP,
 	)
 	if err != nil {
-		log.Printf("Gratuitous arp reply package is malformed: %s", err)
-		return err
+		slog.Error("Gratuitous arp reply package is malformed", "err", err)
+		return nil, nil, err
 	}
 
 	/* RFC 2002 specifies (in section 4.6) that a gratuitous ARP request
@@ -116,51 +663,105 @@ func (c *BasicConfigurer) arpSendGratuitous() error {
 	arpRequestDestMac, err := net.ParseMAC("00:00:00:00:00:00")
 	if err != nil {
 		// not entirely RFC-2002 conform but better then nothing.
-		arpRequestDestMac = c.Iface.HardwareAddr
+		arpRequestDestMac = c.arpSourceMAC()
 	}
 
 	gratuitousRequestPackage, err := arp.NewPacket(
 		arpRequestOp,
-		c.Iface.HardwareAddr,
-		c.VIP,
+		c.arpSourceMAC(),
+		senderIP,
 		arpRequestDestMac,
 		c.VIP,
 	)
 	if err != nil {
-		log.Printf("Gratuitous arp request package is malformed: %s", err)
-		return err
+		slog.Error("Gratuitous arp request package is malformed", "err", err)
+		return nil, nil, err
 	}
+	return gratuitousReplyPackage, gratuitousRequestPackage, nil
+}
 
-	for i := 0; i < c.RetryNum; i++ {
-		errReply := c.arpClient.WriteTo(gratuitousReplyPackage, ethernetBroadcast)
+// sends an ARP reply directly to each of the configured ARP targets,
+// so that e.g. gateways update their tables without relying on the broadcast.
+func (c *BasicConfigurer) arpSendDirected() {
+	for _, target := range c.ArpTargets {
+		_ = c.arpClient.SetReadDeadline(time.Now().Add(time.Second))
+		targetMac, err := c.arpClient.Resolve(target)
+		_ = c.arpClient.SetReadDeadline(time.Time{})
 		if err != nil {
-			log.Printf("Couldn't write to the arpClient: %s", errReply)
-		} else {
-			log.Println("Sent gratuitous ARP reply")
+			slog.Warn("Couldn't resolve hardware address of ARP target", "target", target, "err", err)
+			continue
 		}
 
-		errRequest := c.arpClient.WriteTo(gratuitousRequestPackage, ethernetBroadcast)
+		replyPackage, err := arp.NewPacket(
+			arpReplyOp,
+			c.arpSourceMAC(),
+			c.arpSenderIP(),
+			targetMac,
+			target,
+		)
 		if err != nil {
-			log.Printf("Couldn't write to the arpClient: %s", errRequest)
-		} else {
-			log.Println("Sent gratuitous ARP request")
+			slog.Error("Directed arp reply package is malformed", "target", target, "err", err)
+			continue
 		}
 
-		if errReply != nil || errRequest != nil {
-			/* If something went wrong while sending the packages, we'll recreate the ARP client for the next try,
-			 * to avoid having a stale client that gives "network is down" error.
-			 */
-			err = c.createArpClient()
+		if err := c.arpClient.WriteTo(replyPackage, targetMac); err != nil {
+			slog.Warn("Couldn't send ARP reply", "target", target, "mac", targetMac, "err", err)
 		} else {
-			//TODO: think about whether to leave this out to achieve simple repeat sending of GARP packages
-			break
+			slog.Info("Sent ARP reply", "target", target, "mac", targetMac)
 		}
-		time.Sleep(time.Duration(c.RetryAfter) * time.Millisecond)
 	}
+}
+
+// splitBrainProbeWait is how long checkSplitBrain waits for replies to its ARP probe
+const splitBrainProbeWait = time.Second
+
+// checkSplitBrain sends an ARP probe (RFC 5227) for the VIP and returns the
+// hardware address of another machine that answers for it, if any.
+// The kernel doesn't answer probes sent by this machine itself.
+func (c *BasicConfigurer) checkSplitBrain() (string, error) {
+	if !c.GratuitousArp || c.VIP.To4() == nil {
+		// no raw socket without gratuitous-arp, IPv6 relies on DAD instead
+		return "", nil
+	}
+	if err := c.ensureArpClient(); err != nil {
+		return "", err
+	}
+	// the sender IP of a probe is unset, so it doesn't update the caches of the neighbors
+	probe, err := arp.NewPacket(arpRequestOp, c.Iface.HardwareAddr, net.IPv4zero, net.HardwareAddr{0, 0, 0, 0, 0, 0}, c.VIP)
 	if err != nil {
-		log.Print("too many retries")
-		return err
+		return "", err
+	}
+	if err = c.arpClient.WriteTo(probe, ethernetBroadcast); err != nil {
+		return "", err
+	}
+	defer c.arpClient.SetReadDeadline(time.Time{})
+	if err = c.arpClient.SetReadDeadline(time.Now().Add(splitBrainProbeWait)); err != nil {
+		return "", err
+	}
+	for {
+		p, _, err := c.arpClient.Read()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return "", nil
+			}
+			return "", err
+		}
+		if p.Operation == arpReplyOp && p.SenderIP.Equal(c.VIP) &&
+			!bytes.Equal(p.SenderHardwareAddr, c.Iface.HardwareAddr) && !bytes.Equal(p.SenderHardwareAddr, c.arpSourceMAC()) {
+			return p.SenderHardwareAddr.String(), nil
+		}
 	}
+}
 
-	return nil
+// reassert announces the VIP again, so neighbors switch back to this machine
+func (c *BasicConfigurer) reassert() bool {
+	if !c.GratuitousArp {
+		return false
+	}
+	if err := c.ensureArpClient(); err != nil {
+		slog.Error("Couldn't create an Arp client", "err", err)
+		return false
+	}
+	return c.sendAnnouncement() == nil
 }
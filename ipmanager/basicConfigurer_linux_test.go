@@ -0,0 +1,99 @@
+package ipmanager
+
+import (
+	"net"
+	"testing"
+
+	arp "github.com/mdlayher/arp"
+)
+
+func TestGratuitousArpSenderIP(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface:", err)
+	}
+	vip := net.ParseIP("192.0.2.10").To4()
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+
+	tests := []struct {
+		name  string
+		from  string
+		iface net.Interface
+		want  net.IP
+	}{
+		{"default", "", *lo, vip},
+		{"vip", "vip", *lo, vip},
+		{"host", "host", *lo, net.IPv4(127, 0, 0, 1)},
+		{"host without IPv4 address", "host", net.Interface{Name: "none"}, vip},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &BasicConfigurer{IPConfiguration: &IPConfiguration{
+				VIP:             vip,
+				Netmask:         net.CIDRMask(24, 32),
+				Iface:           tt.iface,
+				ArpAnnounceFrom: tt.from,
+				ArpSourceMAC:    mac,
+			}}
+			reply, request, err := c.gratuitousArpPackets()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, p := range map[string]*arp.Packet{"reply": reply, "request": request} {
+				if !p.SenderIP.Equal(tt.want) {
+					t.Errorf("%s: got sender IP %v, want %v", name, p.SenderIP, tt.want)
+				}
+				if !p.TargetIP.Equal(vip) {
+					t.Errorf("%s: got target IP %v, want %v", name, p.TargetIP, vip)
+				}
+			}
+			if reply.Operation != arpReplyOp || request.Operation != arpRequestOp {
+				t.Errorf("got operations %v and %v", reply.Operation, request.Operation)
+			}
+		})
+	}
+}
+
+func TestPickInterface(t *testing.T) {
+	const (
+		twoDefaults = "default via 192.0.2.1 dev eth0 proto dhcp src 192.0.2.5 metric 100 \n" +
+			"default via 198.51.100.1 dev eth1 proto static metric 200 \n"
+		twoSubnets = "192.0.2.0/24 dev eth0 proto kernel scope link \n" +
+			"192.0.2.0/24 dev bond0 proto kernel scope link src 192.0.2.5 \n" +
+			"default via 198.51.100.1 dev eth1 proto static metric 200 \n"
+	)
+	vip := net.ParseIP("192.0.2.10")
+
+	tests := []struct {
+		name     string
+		routes   string
+		tieBreak string
+		pattern  string
+		want     string
+		wantErr  bool
+	}{
+		{"no route", "", "error", "", "", true},
+		{"default route", "default via 192.0.2.1 dev eth0 proto dhcp src 192.0.2.5 metric 100 \n", "error", "", "eth0", false},
+		{"subnet route before default route", "192.0.2.0/24 dev bond0 proto kernel scope link src 192.0.2.5 \ndefault via 198.51.100.1 dev eth1 proto static metric 200 \n", "error", "", "bond0", false},
+		{"same interface twice", "default via 192.0.2.1 dev eth0 metric 100 \ndefault via 192.0.2.2 dev eth0 metric 200 \n", "error", "", "eth0", false},
+		{"two default routes, error", twoDefaults, "error", "", "", true},
+		{"two default routes, address", twoDefaults, "address", "", "eth0", false},
+		{"two default routes, name", twoDefaults, "name", "eth1", "eth1", false},
+		{"two subnet routes, address", twoSubnets, "address", "", "bond0", false},
+		{"two subnet routes, name", twoSubnets, "name", "eth*", "eth0", false},
+		{"no interface with an address", "default via 192.0.2.1 dev eth0 \ndefault via 198.51.100.1 dev eth1 \n", "address", "", "", true},
+		{"pattern matches both", twoDefaults, "name", "eth*", "", true},
+		{"pattern matches none", twoDefaults, "name", "bond*", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pickInterface(vip, tt.routes, tt.tieBreak, tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pickInterface() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("pickInterface() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
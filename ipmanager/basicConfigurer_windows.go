@@ -2,15 +2,44 @@ package ipmanager
 
 import (
 	"encoding/binary"
-	"log"
+	"errors"
+	"log/slog"
 	"net"
 
 	"github.com/cybertec-postgresql/vip-manager/iphlpapi"
 )
 
+// DetectInterface isn't supported on Windows, the interface must be configured
+func DetectInterface(vip net.IP, tieBreak, namePattern string) (string, error) {
+	return "", errors.New("detecting the interface is not supported on Windows")
+}
+
+// promoteSecondaries does nothing, deleting an address on Windows leaves the others of its subnet alone
+func promoteSecondaries(iface string) error {
+	return nil
+}
+
+// verifyArpCapability does nothing, as no gratuitous ARP messages are sent on Windows
+func (c *BasicConfigurer) verifyArpCapability() error {
+	return nil
+}
+
+// checkCapabilities does nothing, privileges are only checked when configuring
+func (c *BasicConfigurer) checkCapabilities() error {
+	return nil
+}
+
+// preflight checks that the interface exists, privileges are only checked when configuring, see Check
+func (c *BasicConfigurer) preflight() (string, error) {
+	if _, err := net.InterfaceByName(c.Iface.Name); err != nil {
+		return "", err
+	}
+	return "interface " + c.Iface.Name, nil
+}
+
 // configureAddress assigns virtual IP address
 func (c *BasicConfigurer) configureAddress() bool {
-	log.Printf("Configuring address %s on %s", c.getCIDR(), c.Iface.Name)
+	slog.Info("Configuring address", "vip", c.getCIDR(), "interface", c.Iface.Name)
 	var (
 		ip          uint32 = binary.LittleEndian.Uint32(c.VIP.To4())
 		mask        uint32 = binary.LittleEndian.Uint32(c.Netmask)
@@ -18,12 +47,14 @@ func (c *BasicConfigurer) configureAddress() bool {
 	)
 	iface, err := net.InterfaceByName(c.Iface.Name)
 	if err != nil {
-		log.Printf("Got error: %v", err)
+		slog.Error("Got error", "err", err)
+		c.failure = err
 		return false
 	}
 	err = iphlpapi.AddIPAddress(ip, mask, uint32(iface.Index), &c.ntecontext, &nteinstance)
 	if err != nil {
-		log.Printf("Got error: %v", err)
+		slog.Error("Got error", "err", err)
+		c.failure = err
 		return false
 	}
 	// For now it is save to say that also working even if a
@@ -35,10 +66,11 @@ func (c *BasicConfigurer) configureAddress() bool {
 
 // deconfigureAddress drops virtual IP address
 func (c *BasicConfigurer) deconfigureAddress() bool {
-	log.Printf("Removing address %s on %s", c.getCIDR(), c.Iface.Name)
+	slog.Info("Removing address", "vip", c.getCIDR(), "interface", c.Iface.Name)
 	err := iphlpapi.DeleteIPAddress(c.ntecontext)
 	if err != nil {
-		log.Printf("Got error: %v", err)
+		slog.Error("Got error", "err", err)
+		c.failure = err
 		return false
 	}
 	return true
@@ -0,0 +1,37 @@
+package ipmanager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// checkCanary verifies that the connectivity canary is reachable, so a node
+// that lost its network connection doesn't grab the VIP based on a stale leader key.
+// Without a canary, nothing is checked.
+func checkCanary(config *IPConfiguration) error {
+	if config.ConnectivityCanary == "" {
+		return nil
+	}
+	timeout := time.Duration(config.ConnectivityCanaryTimeout) * time.Millisecond
+
+	if config.ConnectivityCanaryMethod == "ping" {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		// -W expects whole seconds, the context enforces the actual timeout
+		wait := strconv.Itoa(int(timeout/time.Second) + 1)
+		if err := exec.CommandContext(ctx, "ping", "-c", "1", "-W", wait, config.ConnectivityCanary).Run(); err != nil {
+			return fmt.Errorf("connectivity canary %s doesn't answer to ping: %w", config.ConnectivityCanary, err)
+		}
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", config.ConnectivityCanary, timeout)
+	if err != nil {
+		return fmt.Errorf("connectivity canary %s is unreachable: %w", config.ConnectivityCanary, err)
+	}
+	return conn.Close()
+}
@@ -0,0 +1,50 @@
+package ipmanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// preflightChecker is implemented by configurers that can verify,
+// without changing anything, that they are able to manage the VIP.
+// preflight returns a short description of what was verified.
+type preflightChecker interface {
+	preflight() (string, error)
+}
+
+// CheckResult is the outcome of a single check, see Check
+type CheckResult struct {
+	Name   string
+	Detail string
+	Err    error
+}
+
+// Check verifies that the backend of hostingType can be reached with the configured
+// credentials and privileges, for every VIP. The state of the VIPs isn't changed.
+func Check(hostingType string, config *IPConfiguration) []CheckResult {
+	config.resolveTimeouts(hostingType)
+	vips := append([]net.IPNet{{IP: config.VIP, Mask: config.Netmask}}, config.AdditionalVIPs...)
+	var results []CheckResult
+	for _, vip := range vips {
+		memberConfig := *config
+		memberConfig.VIP = vip.IP
+		memberConfig.Netmask = vip.Mask
+		memberConfig.AdditionalVIPs = nil
+		memberConfig.VerifyArpCapability = false
+
+		result := CheckResult{Name: fmt.Sprintf("%s backend for %s", hostingType, vip.IP)}
+		configurer, err := newConfigurer(hostingType, &memberConfig)
+		if err == nil {
+			if p, ok := configurer.(preflightChecker); ok {
+				result.Detail, err = p.preflight()
+			} else {
+				err = errors.New("checking this backend is not supported")
+			}
+			configurer.cleanupArp()
+		}
+		result.Err = err
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,274 @@
+package ipmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cloudflareMaxResponseBytes caps the responses of the Cloudflare API,
+// which only ever returns the single record that is managed.
+const cloudflareMaxResponseBytes = 1 << 20
+
+// The CloudflareConfigurer can be used for DNS based failover, whenever
+// hosting type `dns_cloudflare` is set. Instead of a routable VIP, a DNS record
+// points to the leader: the vip is the address of this machine, and configuring
+// it means pointing the A (or AAAA) record to it through the Cloudflare API.
+type CloudflareConfigurer struct {
+	*IPConfiguration
+	apiHost string
+	client  *http.Client
+
+	// serializes all operations, verifyRelease runs in the background
+	mu sync.Mutex
+
+	recordID string // resolved from the record name and type
+	// set after losing leadership, until the new leader took over
+	released bool
+	// why the last update failed, see failureReporter
+	failure error
+}
+
+func newCloudflareConfigurer(config *IPConfiguration) (*CloudflareConfigurer, error) {
+	apiHost, err := apiEndpoint("dns_cloudflare", config.Region)
+	if err != nil {
+		return nil, err
+	}
+	if config.CloudflareAPIToken == "" || config.CloudflareZoneID == "" || config.CloudflareRecordName == "" {
+		return nil, errors.New("manager-type dns_cloudflare requires cloudflare-api-token, cloudflare-zone-id and cloudflare-record-name")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: config.TLSMinVersion}
+
+	return &CloudflareConfigurer{
+		IPConfiguration: config,
+		apiHost:         apiHost,
+		client:          &http.Client{Transport: transport},
+	}, nil
+}
+
+// recordType returns the type of the record that can point to the vip
+func (c *CloudflareConfigurer) recordType() string {
+	if c.VIP.To4() != nil {
+		return "A"
+	}
+	return "AAAA"
+}
+
+type cloudflareRecord struct {
+	ID      string `json:"id"`
+	Content string `json:"content"`
+	TTL     int    `json:"ttl"`
+}
+
+// request calls the Cloudflare API and decodes the result of the JSON response into result.
+func (c *CloudflareConfigurer) request(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+c.apiHost+"/client/v4/zones/"+url.PathEscape(c.CloudflareZoneID)+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.CloudflareAPIToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, cloudflareMaxResponseBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(out) > cloudflareMaxResponseBytes {
+		return fmt.Errorf("%w: more than %d bytes", errResponseTooLarge, cloudflareMaxResponseBytes)
+	}
+	var envelope struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(out, &envelope); err != nil || resp.StatusCode/100 != 2 || !envelope.Success {
+		messages := []string{}
+		for _, e := range envelope.Errors {
+			messages = append(messages, fmt.Sprintf("%d %s", e.Code, e.Message))
+		}
+		if len(messages) == 0 {
+			messages = append(messages, truncate(string(out), maxLoggedResponseLength))
+		}
+		return fmt.Errorf("Cloudflare API returned %s: %s", resp.Status, strings.Join(messages, "; "))
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
+
+// record looks up the managed record, remembering its ID
+func (c *CloudflareConfigurer) record(ctx context.Context) (cloudflareRecord, error) {
+	query := url.Values{"name": {c.CloudflareRecordName}, "type": {c.recordType()}}
+	var records []cloudflareRecord
+	err := c.retryQuery("Cloudflare API query", func() error {
+		return c.request(ctx, http.MethodGet, "/dns_records?"+query.Encode(), nil, &records)
+	})
+	if err != nil {
+		return cloudflareRecord{}, err
+	}
+	switch len(records) {
+	case 0:
+		return cloudflareRecord{}, fmt.Errorf("no %s record %s in zone %s", c.recordType(), c.CloudflareRecordName, c.CloudflareZoneID)
+	case 1:
+	default:
+		return cloudflareRecord{}, fmt.Errorf("%d %s records %s in zone %s, only a single one can point to the leader", len(records), c.recordType(), c.CloudflareRecordName, c.CloudflareZoneID)
+	}
+	if c.recordID != records[0].ID {
+		c.recordID = records[0].ID
+		slog.Info("Resolved DNS record", "record", c.CloudflareRecordName, "type", c.recordType(), "record_id", c.recordID)
+	}
+	return records[0], nil
+}
+
+func (c *CloudflareConfigurer) pointsHere() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.QueryTimeout)*time.Millisecond)
+	defer cancel()
+
+	r, err := c.record(ctx)
+	if err != nil {
+		return false, err
+	}
+	return sameIP(net.ParseIP(r.Content), c.VIP), nil
+}
+
+// preflight looks up the record without changing it, see Check
+func (c *CloudflareConfigurer) preflight() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.QueryTimeout)*time.Millisecond)
+	defer cancel()
+
+	r, err := c.record(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s record %s points to %s", c.recordType(), c.CloudflareRecordName, r.Content), nil
+}
+
+// queryAddress returns whether the record points to this machine.
+// After deconfigureAddress, it is considered released even while
+// it still points here, until another machine took over.
+func (c *CloudflareConfigurer) queryAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	here, err := c.pointsHere()
+	if err != nil {
+		slog.Error("Error while querying Cloudflare DNS record", "err", err)
+		return false
+	}
+	if !here {
+		c.released = false
+	}
+	return here && !c.released
+}
+
+// verifyRelease checks whether the record points to another machine.
+func (c *CloudflareConfigurer) verifyRelease() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	here, err := c.pointsHere()
+	return !here, err
+}
+
+// configureAddress points the record to this machine, with a low TTL
+// so resolvers pick up the next failover quickly.
+func (c *CloudflareConfigurer) configureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ConfigureTimeout)*time.Millisecond)
+	defer cancel()
+
+	if c.recordID == "" {
+		if _, err := c.record(ctx); err != nil {
+			slog.Error("Error while updating Cloudflare DNS record", "err", err)
+			c.failure = err
+			return false
+		}
+	}
+	slog.Info("Pointing DNS record to this machine", "record", c.CloudflareRecordName, "vip", c.VIP, "ttl", c.CloudflareRecordTTL)
+	var result cloudflareRecord
+	err := c.retryConfigure("Cloudflare DNS record update", func() error {
+		return c.request(ctx, http.MethodPatch, "/dns_records/"+url.PathEscape(c.recordID),
+			map[string]interface{}{"content": c.VIP.String(), "ttl": c.CloudflareRecordTTL}, &result)
+	})
+	if err != nil {
+		slog.Error("Error while updating Cloudflare DNS record", "err", err)
+		c.failure = err
+		return false
+	}
+	c.failure = nil
+	c.released = false
+	return true
+}
+
+// deconfigureAddress does nothing, the record is pointed
+// to another machine by the new leader.
+func (c *CloudflareConfigurer) deconfigureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.released = true
+	return true
+}
+
+// describeAction returns the request that would be sent, see dryRunConfigurer
+func (c *CloudflareConfigurer) describeAction(configure bool) string {
+	if !configure {
+		return "nothing, the new leader updates the DNS record"
+	}
+	return fmt.Sprintf("PATCH %s record %s to %s with ttl %d", c.recordType(), c.CloudflareRecordName, c.VIP, c.CloudflareRecordTTL)
+}
+
+func (c *CloudflareConfigurer) lastFailure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failure
+}
+
+func (c *CloudflareConfigurer) cleanupArp() {
+	// only DNS changes, no ARP involved.
+}
+
+// labels identifies the zone and the record, once it is resolved
+func (c *CloudflareConfigurer) labels() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l := map[string]string{"zone_id": c.CloudflareZoneID}
+	if c.recordID != "" {
+		l["record_id"] = c.recordID
+	}
+	return l
+}
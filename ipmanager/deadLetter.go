@@ -0,0 +1,92 @@
+package ipmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+// failureReporter is implemented by configurers that remember why
+// the last configureAddress or deconfigureAddress failed.
+type failureReporter interface {
+	lastFailure() error
+}
+
+// deadLetter is a record of a failover that failed after all retries,
+// see dead-letter-file
+type deadLetter struct {
+	Time       time.Time         `json:"time"`
+	VIP        string            `json:"vip"`
+	Backend    string            `json:"backend"`
+	Operation  string            `json:"operation"`
+	Error      string            `json:"error"`
+	ErrorChain []string          `json:"error_chain,omitempty"`
+	Leader     bool              `json:"leader"`
+	Failures   int               `json:"consecutive_failures"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// errorChain returns the messages of err and all errors it wraps, outermost first
+func errorChain(err error) []string {
+	var chain []string
+	var walk func(error)
+	walk = func(err error) {
+		if err == nil {
+			return
+		}
+		chain = append(chain, err.Error())
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, e := range joined.Unwrap() {
+				walk(e)
+			}
+			return
+		}
+		walk(errors.Unwrap(err))
+	}
+	walk(err)
+	return chain
+}
+
+// recordDeadLetter appends a record of the failed operation to dead-letter-file,
+// as a line of JSON. Registered secrets are masked, as in the logs.
+func (m *IPManager) recordDeadLetter(operation string, leader bool) {
+	if m.config.DeadLetterFile == "" {
+		return
+	}
+	r := deadLetter{
+		Time:      time.Now(),
+		VIP:       m.configurer.getCIDR(),
+		Backend:   m.hostingType,
+		Operation: operation,
+		Error:     "unknown, see the log",
+		Leader:    leader,
+		Failures:  m.configureFailures,
+		Labels:    m.configurer.labels(),
+	}
+	if f, ok := m.configurer.(failureReporter); ok {
+		if err := f.lastFailure(); err != nil {
+			r.Error = err.Error()
+			r.ErrorChain = errorChain(err)
+		}
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		slog.Error("Couldn't encode the dead letter record", "err", err)
+		return
+	}
+
+	file, err := os.OpenFile(m.config.DeadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		slog.Error("Couldn't open the dead letter file", "file", m.config.DeadLetterFile, "err", err)
+		return
+	}
+	defer file.Close()
+	// a single write, so concurrent records aren't interleaved
+	if _, err := vipconfig.NewSanitizingWriter(file).Write(append(line, '\n')); err != nil {
+		slog.Error("Couldn't write to the dead letter file", "file", m.config.DeadLetterFile, "err", err)
+	}
+}
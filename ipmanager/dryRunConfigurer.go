@@ -0,0 +1,120 @@
+package ipmanager
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// actionDescriber is implemented by configurers that can tell in detail
+// what configureAddress or deconfigureAddress would do, see dryRunConfigurer.
+type actionDescriber interface {
+	describeAction(configure bool) string
+}
+
+// describeAction returns what c would do to configure or release the VIP
+func describeAction(c ipConfigurer, configure bool) string {
+	if d, ok := c.(actionDescriber); ok {
+		return d.describeAction(configure)
+	}
+	if configure {
+		return "configure " + c.getCIDR()
+	}
+	return "release " + c.getCIDR()
+}
+
+// dryRunConfigurer wraps the configurer of the manager-type when dry-run is set.
+// The state of the VIP is still queried, e.g. through the Hetzner API, but
+// configuring and releasing it are only logged and reported as successful.
+// As nothing changes, the manager loop goes by the simulated state instead.
+type dryRunConfigurer struct {
+	ipConfigurer
+	hostingType string
+
+	mu        sync.Mutex
+	simulated bool
+	// the first query tells whether this machine holds the VIP at startup
+	queried bool
+}
+
+func newDryRunConfigurer(c ipConfigurer, hostingType string) *dryRunConfigurer {
+	slog.Warn("Dry run: the virtual ip is never configured or released", "vip", c.getCIDR(), "backend", hostingType)
+	return &dryRunConfigurer{ipConfigurer: c, hostingType: hostingType}
+}
+
+// queryAddress queries the actual state, but returns the simulated one
+func (c *dryRunConfigurer) queryAddress() bool {
+	actual := c.ipConfigurer.queryAddress()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.queried {
+		c.queried = true
+		c.simulated = actual
+	} else if actual != c.simulated {
+		slog.Debug("Dry run: actual state differs from the simulated one", "vip", c.getCIDR(), "state", actual, "simulated", c.simulated)
+	}
+	return c.simulated
+}
+
+func (c *dryRunConfigurer) configureAddress() bool {
+	slog.Info("Dry run: would configure the virtual ip", "vip", c.getCIDR(), "backend", c.hostingType, "action", describeAction(c.ipConfigurer, true))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.simulated = true
+	return true
+}
+
+func (c *dryRunConfigurer) deconfigureAddress() bool {
+	slog.Info("Dry run: would release the virtual ip", "vip", c.getCIDR(), "backend", c.hostingType, "action", describeAction(c.ipConfigurer, false))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.simulated = false
+	return true
+}
+
+// reloadConfig passes on the reloaded settings, see configReloader
+func (c *dryRunConfigurer) reloadConfig(update *IPConfiguration) {
+	if r, ok := c.ipConfigurer.(configReloader); ok {
+		r.reloadConfig(update)
+	}
+}
+
+// releaseOnShutdown only logs, see shutdownReleaser
+func (c *dryRunConfigurer) releaseOnShutdown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.simulated {
+		slog.Info("Dry run: would release the virtual ip on shutdown", "vip", c.getCIDR(), "backend", c.hostingType)
+		c.simulated = false
+	}
+	return true
+}
+
+// verifyRelease goes by the simulated state, see releaseVerifier
+func (c *dryRunConfigurer) verifyRelease() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.simulated, nil
+}
+
+// failoverDetails passes on the details of the failover-ip, see failoverReporter
+func (c *dryRunConfigurer) failoverDetails() *HetznerFailover {
+	if r, ok := c.ipConfigurer.(failoverReporter); ok {
+		return r.failoverDetails()
+	}
+	return nil
+}
+
+// status reports the actual state where the configurer tracks it, see statusReporter
+func (c *dryRunConfigurer) status() (string, time.Time) {
+	if r, ok := c.ipConfigurer.(statusReporter); ok {
+		return r.status()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.simulated {
+		return "configured", time.Time{}
+	}
+	return "released", time.Time{}
+}
@@ -0,0 +1,387 @@
+package ipmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// equinixMetadataURL returns the metadata of the device it is called from
+const equinixMetadataURL = "https://metadata.platformequinix.com/metadata"
+
+// equinixMaxResponseBytes limits the responses read from the metadata service and the Metal API
+const equinixMaxResponseBytes = 1 << 20
+
+// equinixPollInterval is the time between checks whether a new assignment is in place
+const equinixPollInterval = time.Second
+
+// The EquinixConfigurer can be used to enable vip-management on devices
+// in Equinix Metal, where the vip is an elastic IP that is assigned to
+// a device through the Metal API, whenever hosting type `equinix` is set.
+// Like with Hetzner, the elastic IP has to be configured on all devices,
+// Equinix only routes it to the one it is assigned to.
+type EquinixConfigurer struct {
+	*IPConfiguration
+	apiHost string
+	client  *http.Client
+
+	// serializes all operations, verifyRelease runs in the background
+	mu sync.Mutex
+
+	deviceID string // this device, resolved through the metadata service
+
+	// set after losing leadership, until the new leader took over
+	released bool
+	// why the last assignment failed, see failureReporter
+	failure error
+}
+
+// equinixAssignment is the assignment of an elastic IP to a device
+type equinixAssignment struct {
+	ID         string `json:"id"`
+	Address    string `json:"address"`
+	AssignedTo struct {
+		Href string `json:"href"`
+	} `json:"assigned_to"`
+}
+
+// device returns the ID of the device the IP is assigned to
+func (a equinixAssignment) device() string {
+	return path.Base(a.AssignedTo.Href)
+}
+
+func newEquinixConfigurer(config *IPConfiguration) (*EquinixConfigurer, error) {
+	apiHost, err := apiEndpoint("equinix", config.Region)
+	if err != nil {
+		return nil, err
+	}
+	if config.EquinixAPIToken == "" || config.EquinixProjectID == "" {
+		return nil, errors.New("manager-type equinix requires equinix-api-token and equinix-project-id")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: config.TLSMinVersion}
+
+	return &EquinixConfigurer{
+		IPConfiguration: config,
+		apiHost:         apiHost,
+		client:          &http.Client{Transport: transport},
+	}, nil
+}
+
+// request calls the Metal API and decodes the JSON response into result, if any.
+func (c *EquinixConfigurer) request(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+c.apiHost+"/metal/v1"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", c.EquinixAPIToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, equinixMaxResponseBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(out) > equinixMaxResponseBytes {
+		return fmt.Errorf("%w: more than %d bytes", errResponseTooLarge, equinixMaxResponseBytes)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Equinix Metal API returned %s: %s", resp.Status, truncate(string(out), maxLoggedResponseLength))
+	}
+	if result == nil || len(out) == 0 {
+		return nil
+	}
+	return json.Unmarshal(out, result)
+}
+
+// resolveDevice looks up the ID of this device, once.
+func (c *EquinixConfigurer) resolveDevice(ctx context.Context) error {
+	if c.deviceID != "" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, equinixMetadataURL, nil)
+	if err != nil {
+		return err
+	}
+	release, err := acquireMetadataSlot(ctx, "metadata")
+	if err != nil {
+		return err
+	}
+	defer release()
+	// the metadata service must never be reached through a proxy
+	resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach the metadata service: %w", err)
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, equinixMaxResponseBytes))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("metadata service returned %s", resp.Status)
+	}
+	var metadata struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(out, &metadata); err != nil {
+		return fmt.Errorf("unexpected response from the metadata service: %w", err)
+	}
+	if metadata.ID == "" {
+		return errors.New("the metadata service returned no device id")
+	}
+	c.deviceID = metadata.ID
+	slog.Info("This is an Equinix Metal device", "device_id", c.deviceID)
+	return nil
+}
+
+// assignments returns the assignments of the vip in the project, to any device
+func (c *EquinixConfigurer) assignments(ctx context.Context) ([]equinixAssignment, error) {
+	var result struct {
+		IPAddresses []struct {
+			Assignments []equinixAssignment `json:"assignments"`
+		} `json:"ip_addresses"`
+	}
+	if err := c.request(ctx, http.MethodGet, "/projects/"+url.PathEscape(c.EquinixProjectID)+"/ips?include=assignments", nil, &result); err != nil {
+		return nil, err
+	}
+	var assignments []equinixAssignment
+	for _, reservation := range result.IPAddresses {
+		for _, a := range reservation.Assignments {
+			if sameIP(net.ParseIP(a.Address), c.VIP) {
+				assignments = append(assignments, a)
+			}
+		}
+	}
+	return assignments, nil
+}
+
+// deviceAssignment returns whether the vip is assigned to this device
+func (c *EquinixConfigurer) deviceAssignment(ctx context.Context) (bool, error) {
+	if err := c.resolveDevice(ctx); err != nil {
+		return false, err
+	}
+	var result struct {
+		IPAddresses []equinixAssignment `json:"ip_addresses"`
+	}
+	if err := c.request(ctx, http.MethodGet, "/devices/"+url.PathEscape(c.deviceID)+"/ips", nil, &result); err != nil {
+		return false, err
+	}
+	for _, a := range result.IPAddresses {
+		if sameIP(net.ParseIP(a.Address), c.VIP) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *EquinixConfigurer) assigned() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.QueryTimeout)*time.Millisecond)
+	defer cancel()
+
+	var assigned bool
+	err := c.retryQuery("Equinix Metal API query", func() (err error) {
+		assigned, err = c.deviceAssignment(ctx)
+		return err
+	})
+	return assigned, err
+}
+
+// queryAddress returns whether the elastic IP is assigned to this device.
+// After deconfigureAddress, it is considered released even while
+// it is still assigned to this device, until another device took over.
+func (c *EquinixConfigurer) queryAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assigned, err := c.assigned()
+	if err != nil {
+		slog.Error("Error while querying Equinix Metal elastic IP", "err", err)
+		return false
+	}
+	if !assigned {
+		c.released = false
+	}
+	return assigned && !c.released
+}
+
+// verifyRelease checks whether the elastic IP was assigned to another device.
+func (c *EquinixConfigurer) verifyRelease() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assigned, err := c.assigned()
+	return !assigned, err
+}
+
+// preflight looks up the elastic IP without assigning it, see Check
+func (c *EquinixConfigurer) preflight() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.QueryTimeout)*time.Millisecond)
+	defer cancel()
+
+	if err := c.resolveDevice(ctx); err != nil {
+		return "", err
+	}
+	assignments, err := c.assignments(ctx)
+	if err != nil {
+		return "", err
+	}
+	devices := "no device"
+	for i, a := range assignments {
+		if i == 0 {
+			devices = a.device()
+		} else {
+			devices += ", " + a.device()
+		}
+	}
+	return fmt.Sprintf("elastic IP is assigned to %s, this device is %s", devices, c.deviceID), nil
+}
+
+// prefixLength returns the length of the single address block assigned to the device
+func (c *EquinixConfigurer) prefixLength() int {
+	if c.VIP.To4() != nil {
+		return 32
+	}
+	return 128
+}
+
+// assign moves the elastic IP to this device, removing it from any other device first,
+// and waits until the assignment is in place.
+func (c *EquinixConfigurer) assign(ctx context.Context) error {
+	if err := c.resolveDevice(ctx); err != nil {
+		return err
+	}
+	assignments, err := c.assignments(ctx)
+	if err != nil {
+		return err
+	}
+	for _, a := range assignments {
+		if a.device() == c.deviceID {
+			// already there
+			return nil
+		}
+		slog.Info("Unassigning elastic IP from the previous device", "vip", c.VIP, "device_id", a.device())
+		if err := c.request(ctx, http.MethodDelete, "/ips/"+url.PathEscape(a.ID), nil, nil); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Assigning elastic IP", "vip", c.VIP, "device_id", c.deviceID)
+	err = c.request(ctx, http.MethodPost, "/devices/"+url.PathEscape(c.deviceID)+"/ips",
+		map[string]string{"address": c.VIP.String() + "/" + strconv.Itoa(c.prefixLength())}, nil)
+	if err != nil {
+		return err
+	}
+	return c.waitAssigned(ctx)
+}
+
+// waitAssigned polls the assignments of this device until the vip shows up or ctx expires.
+func (c *EquinixConfigurer) waitAssigned(ctx context.Context) error {
+	for {
+		assigned, err := c.deviceAssignment(ctx)
+		if err != nil {
+			return err
+		}
+		if assigned {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("elastic IP %s wasn't assigned to device %s in time: %w", c.VIP, c.deviceID, ctx.Err())
+		case <-time.After(equinixPollInterval):
+		}
+	}
+}
+
+// configureAddress assigns the elastic IP to this device
+func (c *EquinixConfigurer) configureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ConfigureTimeout)*time.Millisecond)
+	defer cancel()
+
+	err := c.retryConfigure("Equinix Metal elastic IP assignment", func() error {
+		return c.assign(ctx)
+	})
+	if err != nil {
+		slog.Error("Error while assigning Equinix Metal elastic IP", "err", err)
+		c.failure = err
+		return false
+	}
+	c.failure = nil
+	c.released = false
+	return true
+}
+
+// deconfigureAddress does nothing, the elastic IP is assigned
+// to another device by the new leader.
+func (c *EquinixConfigurer) deconfigureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.released = true
+	return true
+}
+
+// describeAction returns the requests that would be sent, see dryRunConfigurer
+func (c *EquinixConfigurer) describeAction(configure bool) string {
+	if !configure {
+		return "nothing, the new leader assigns the elastic IP to itself"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("DELETE the assignments of %s to other devices, then POST /devices/%s/ips address=%s/%d",
+		c.VIP, c.deviceID, c.VIP, c.prefixLength())
+}
+
+func (c *EquinixConfigurer) lastFailure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failure
+}
+
+func (c *EquinixConfigurer) cleanupArp() {
+	// Equinix routes the elastic IP, no ARP involved.
+}
+
+// labels identifies the project and this device, once it is resolved
+func (c *EquinixConfigurer) labels() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l := map[string]string{"project_id": c.EquinixProjectID}
+	if c.deviceID != "" {
+		l["device_id"] = c.deviceID
+	}
+	return l
+}
@@ -0,0 +1,391 @@
+package ipmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gcpMetadataURL is the base URL of the metadata server, reachable from every instance
+const gcpMetadataURL = "http://metadata.google.internal/computeMetadata/v1/"
+
+// gcpMaxResponseBytes limits the responses read from the metadata server and the Compute API
+const gcpMaxResponseBytes = 1 << 20
+
+// The GCPConfigurer can be used to enable vip-management on instances in the
+// Google Cloud, whenever hosting type `gcp` is set. The vip is an alias IP
+// of the leader's network interface, which is moved through the Compute API.
+// GCP routes alias IPs to the instance, so, like with Hetzner, nothing is
+// configured on the interface by vip-manager.
+type GCPConfigurer struct {
+	*IPConfiguration
+	apiHost  string
+	client   *http.Client
+	metadata *http.Client
+
+	// serializes all operations, verifyRelease runs in the background
+	mu sync.Mutex
+
+	// this instance, resolved through the metadata server
+	project  string
+	zone     string
+	instance string
+
+	// access token of the instance's service account
+	token       string
+	tokenExpiry time.Time
+
+	// why the last change of the alias IPs failed, see failureReporter
+	failure error
+}
+
+type gcpAliasIPRange struct {
+	IPCidrRange         string `json:"ipCidrRange"`
+	SubnetworkRangeName string `json:"subnetworkRangeName,omitempty"`
+}
+
+type gcpNetworkInterface struct {
+	Name          string            `json:"name"`
+	Fingerprint   string            `json:"fingerprint"`
+	AliasIPRanges []gcpAliasIPRange `json:"aliasIpRanges"`
+}
+
+type gcpOperation struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+func newGCPConfigurer(config *IPConfiguration) (*GCPConfigurer, error) {
+	apiHost, err := apiEndpoint("gcp", config.Region)
+	if err != nil {
+		return nil, err
+	}
+	if config.VIP.To4() == nil {
+		return nil, errors.New("manager-type gcp only supports IPv4 virtual IPs")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: config.TLSMinVersion}
+
+	return &GCPConfigurer{
+		IPConfiguration: config,
+		apiHost:         apiHost,
+		client:          &http.Client{Transport: transport},
+		// the metadata server must never be reached through a proxy
+		metadata: &http.Client{Transport: &http.Transport{}},
+	}, nil
+}
+
+// metadataGet returns a value from the metadata server
+func (c *GCPConfigurer) metadataGet(ctx context.Context, key string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataURL+key, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	release, err := acquireMetadataSlot(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	resp, err := c.metadata.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot reach the metadata server: %w", err)
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, gcpMaxResponseBytes))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s for %s", resp.Status, key)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// resolveInstance looks up the project, zone and name of this instance, once.
+func (c *GCPConfigurer) resolveInstance(ctx context.Context) error {
+	if c.instance != "" {
+		return nil
+	}
+	project, err := c.metadataGet(ctx, "project/project-id")
+	if err != nil {
+		return err
+	}
+	// projects/<number>/zones/<zone>
+	zone, err := c.metadataGet(ctx, "instance/zone")
+	if err != nil {
+		return err
+	}
+	instance, err := c.metadataGet(ctx, "instance/name")
+	if err != nil {
+		return err
+	}
+	c.project, c.zone, c.instance = project, path.Base(zone), instance
+	slog.Info("This is a GCP instance", "instance", c.instance, "project", c.project, "zone", c.zone)
+	return nil
+}
+
+// accessToken returns the access token of the instance's default service account,
+// which is renewed shortly before it expires.
+func (c *GCPConfigurer) accessToken(ctx context.Context) (string, error) {
+	if c.token != "" && time.Until(c.tokenExpiry) > time.Minute {
+		return c.token, nil
+	}
+	out, err := c.metadataGet(ctx, "instance/service-accounts/default/token")
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		return "", fmt.Errorf("unexpected access token from the metadata server: %w", err)
+	}
+	c.token = result.AccessToken
+	c.tokenExpiry = time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+// request calls the Compute API for this instance's zone and decodes the JSON response into result.
+func (c *GCPConfigurer) request(ctx context.Context, method, resource string, body interface{}, result interface{}) error {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	apiURL := "https://" + c.apiHost + "/compute/v1/projects/" + c.project + "/zones/" + c.zone + "/" + resource
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, gcpMaxResponseBytes+1))
+	if err != nil {
+		return err
+	}
+	if len(out) > gcpMaxResponseBytes {
+		return fmt.Errorf("GCP Compute API response is too large: more than %d bytes", gcpMaxResponseBytes)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("GCP Compute API returned %s: %s", resp.Status, truncate(string(out), maxLoggedResponseLength))
+	}
+	return json.Unmarshal(out, result)
+}
+
+// networkInterface returns the configured network interface of this instance.
+func (c *GCPConfigurer) networkInterface(ctx context.Context) (*gcpNetworkInterface, error) {
+	if err := c.resolveInstance(ctx); err != nil {
+		return nil, err
+	}
+	var result struct {
+		NetworkInterfaces []gcpNetworkInterface `json:"networkInterfaces"`
+	}
+	if err := c.request(ctx, http.MethodGet, "instances/"+c.instance, nil, &result); err != nil {
+		return nil, err
+	}
+	for i := range result.NetworkInterfaces {
+		if result.NetworkInterfaces[i].Name == c.GCPNetworkInterface {
+			return &result.NetworkInterfaces[i], nil
+		}
+	}
+	return nil, fmt.Errorf("instance %s has no network interface %s", c.instance, c.GCPNetworkInterface)
+}
+
+// preflight reads the network interface of this instance without changing it, see Check
+func (c *GCPConfigurer) preflight() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.QueryTimeout)*time.Millisecond)
+	defer cancel()
+
+	ni, err := c.networkInterface(ctx)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("instance %s, network interface %s with %d alias IP ranges", c.instance, ni.Name, len(ni.AliasIPRanges)), nil
+}
+
+// isVIP returns whether an alias IP range is the vip
+func (c *GCPConfigurer) isVIP(r gcpAliasIPRange) bool {
+	ip, _, err := net.ParseCIDR(r.IPCidrRange)
+	if err != nil {
+		ip = net.ParseIP(r.IPCidrRange)
+	}
+	return sameIP(ip, c.VIP)
+}
+
+// queryAddress returns whether the vip is an alias IP of this instance
+func (c *GCPConfigurer) queryAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.QueryTimeout)*time.Millisecond)
+	defer cancel()
+
+	var ni *gcpNetworkInterface
+	err := c.retryQuery("GCP Compute API query", func() (err error) {
+		ni, err = c.networkInterface(ctx)
+		return err
+	})
+	if err != nil {
+		slog.Error("Error while querying GCP alias IPs", "err", err)
+		return false
+	}
+	for _, r := range ni.AliasIPRanges {
+		if c.isVIP(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// configureAddress adds the vip to the alias IPs of this instance.
+// GCP refuses this while the vip is still an alias IP of another instance,
+// so it only succeeds once the previous leader released it.
+func (c *GCPConfigurer) configureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.retryConfigure("GCP alias IP assignment", func() error {
+		return c.updateAliasIPs(true)
+	})
+	if err != nil {
+		slog.Error("Error while adding GCP alias IP", "err", err)
+		c.failure = err
+		return false
+	}
+	c.failure = nil
+	return true
+}
+
+// deconfigureAddress removes the vip from the alias IPs of this instance,
+// so the new leader can add it.
+func (c *GCPConfigurer) deconfigureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.retryDeconfigure("GCP alias IP removal", func() error {
+		return c.updateAliasIPs(false)
+	})
+	if err != nil {
+		slog.Error("Error while removing GCP alias IP", "err", err)
+		c.failure = err
+		return false
+	}
+	c.failure = nil
+	return true
+}
+
+// updateAliasIPs adds or removes the vip, keeping all other alias IPs of the interface.
+func (c *GCPConfigurer) updateAliasIPs(add bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ConfigureTimeout)*time.Millisecond)
+	defer cancel()
+
+	ni, err := c.networkInterface(ctx)
+	if err != nil {
+		return err
+	}
+	ranges := []gcpAliasIPRange{}
+	for _, r := range ni.AliasIPRanges {
+		if c.isVIP(r) {
+			if add {
+				// already there
+				return nil
+			}
+			continue
+		}
+		ranges = append(ranges, r)
+	}
+	if add {
+		slog.Info("Adding alias IP", "vip", c.VIP, "instance", c.instance)
+		ranges = append(ranges, gcpAliasIPRange{IPCidrRange: c.VIP.String() + "/32"})
+	} else if len(ranges) == len(ni.AliasIPRanges) {
+		// already gone
+		return nil
+	} else {
+		slog.Info("Removing alias IP", "vip", c.VIP, "instance", c.instance)
+	}
+
+	// the fingerprint makes the update fail if the interface was changed in the meantime
+	var op gcpOperation
+	err = c.request(ctx, http.MethodPatch, "instances/"+c.instance+"/updateNetworkInterface?networkInterface="+ni.Name,
+		map[string]interface{}{"aliasIpRanges": ranges, "fingerprint": ni.Fingerprint}, &op)
+	if err != nil {
+		return err
+	}
+	return c.waitOperation(ctx, op)
+}
+
+// waitOperation polls an asynchronous zone operation until it is done or ctx expires.
+func (c *GCPConfigurer) waitOperation(ctx context.Context, op gcpOperation) error {
+	for op.Status != "DONE" {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("operation %s didn't finish in time: %w", op.Name, err)
+		}
+		// returns when the operation is done, or after at most two minutes
+		if err := c.request(ctx, http.MethodPost, "operations/"+op.Name+"/wait", nil, &op); err != nil {
+			return err
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("operation %s failed: %s: %s", op.Name, op.Error.Errors[0].Code, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+func (c *GCPConfigurer) lastFailure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failure
+}
+
+func (c *GCPConfigurer) cleanupArp() {
+	// GCP routes the alias IP, no ARP involved.
+}
+
+// labels identifies this instance, once it is resolved
+func (c *GCPConfigurer) labels() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.instance == "" {
+		return nil
+	}
+	return map[string]string{"instance": c.instance, "zone": c.zone}
+}
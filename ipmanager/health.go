@@ -0,0 +1,82 @@
+package ipmanager
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// checkHealth runs health-check-command or calls health-check-url, so a leader
+// that can't serve, e.g. because its disk is full, doesn't take the VIP.
+// Without either, nothing is checked.
+func checkHealth(config *IPConfiguration) error {
+	if config.HealthCheckCommand != "" {
+		return runHook("health check", config.HealthCheckCommand, config.HookTimeout, config)
+	}
+	if config.HealthCheckURL == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.HookTimeout)*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.HealthCheckURL, nil)
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: config.TLSMinVersion}
+	client := &http.Client{Transport: transport}
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("health check %s failed: %w", config.HealthCheckURL, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check %s returned %d", config.HealthCheckURL, resp.StatusCode)
+	}
+	return nil
+}
+
+// updateHealth evaluates the health check and tracks since when it passes,
+// logging each change. It runs on every check, also while this machine isn't
+// the leader, so it is known to be healthy by the time it becomes the leader.
+func (m *IPManager) updateHealth() {
+	if m.config.HealthCheckCommand == "" && m.config.HealthCheckURL == "" {
+		return
+	}
+	err := checkHealth(m.config)
+	if err != nil {
+		if !m.healthySince.IsZero() || !m.healthChecked {
+			slog.Warn("Health check failed, this machine won't take the virtual ip", "vip", m.configurer.getCIDR(), "err", err)
+		}
+		m.healthySince = time.Time{}
+		healthCheckPassing.Set(0)
+	} else {
+		if m.healthySince.IsZero() {
+			slog.Info("Health check passed", "vip", m.configurer.getCIDR(), "min_healthy_ms", m.config.HealthCheckMinHealthy)
+			m.healthySince = time.Now()
+		}
+		healthCheckPassing.Set(1)
+	}
+	m.healthChecked = true
+}
+
+// unhealthyFor returns how long to wait until this machine may take the VIP,
+// because the health check fails or hasn't passed for health-check-min-healthy yet.
+// It returns 0 if the VIP may be configured.
+func (m *IPManager) unhealthyFor() time.Duration {
+	if m.config.HealthCheckCommand == "" && m.config.HealthCheckURL == "" {
+		return 0
+	}
+	if m.healthySince.IsZero() {
+		return time.Duration(m.config.RecheckInterval) * time.Millisecond
+	}
+	return time.Duration(m.config.HealthCheckMinHealthy)*time.Millisecond - time.Since(m.healthySince)
+}
@@ -0,0 +1,289 @@
+package ipmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hetznerCloudMetadataURL returns the ID of the server it is called from
+const hetznerCloudMetadataURL = "http://169.254.169.254/hetzner/v1/metadata/instance-id"
+
+// The HetznerCloudConfigurer can be used to enable vip-management on servers
+// in the Hetzner Cloud, where the vip is a Floating IP that is assigned to
+// a server through the Cloud API, whenever hosting type `hetzner_cloud` is set.
+// Like with the robot failover API, the Floating IP has to be configured
+// on all servers, Hetzner only routes it to the one it is assigned to.
+type HetznerCloudConfigurer struct {
+	*IPConfiguration
+	apiHost string
+	token   string
+	client  *http.Client
+
+	// serializes all operations, verifyRelease runs in the background
+	mu sync.Mutex
+
+	serverID     int64 // this server, resolved through the metadata service
+	floatingIPID int64 // resolved from the vip, unless configured
+
+	// set after losing leadership, until the new leader took over
+	released bool
+	// why the last assignment failed, see failureReporter
+	failure error
+}
+
+func newHetznerCloudConfigurer(config *IPConfiguration) (*HetznerCloudConfigurer, error) {
+	apiHost, err := apiEndpoint("hetzner_cloud", config.Region)
+	if err != nil {
+		return nil, err
+	}
+	if config.HetznerCloudToken == "" {
+		return nil, errors.New("manager-type hetzner_cloud requires hetzner-cloud-token")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: config.TLSMinVersion}
+
+	return &HetznerCloudConfigurer{
+		IPConfiguration: config,
+		apiHost:         apiHost,
+		token:           config.HetznerCloudToken,
+		client:          &http.Client{Transport: transport},
+		floatingIPID:    config.HetznerCloudFloatingIPID,
+	}, nil
+}
+
+// request calls the Cloud API and decodes the JSON response into result.
+func (c *HetznerCloudConfigurer) request(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+c.apiHost+"/v1"+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(c.HetznerMaxResponseBytes)+1))
+	if err != nil {
+		return err
+	}
+	if len(out) > c.HetznerMaxResponseBytes {
+		return fmt.Errorf("%w: more than %d bytes", errResponseTooLarge, c.HetznerMaxResponseBytes)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Hetzner Cloud API returned %s: %s", resp.Status, truncate(string(out), maxLoggedResponseLength))
+	}
+	return json.Unmarshal(out, result)
+}
+
+// resolveIDs looks up the IDs of this server and the Floating IP, once.
+func (c *HetznerCloudConfigurer) resolveIDs(ctx context.Context) error {
+	if c.serverID == 0 {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, hetznerCloudMetadataURL, nil)
+		if err != nil {
+			return err
+		}
+		release, err := acquireMetadataSlot(ctx, "instance-id")
+		if err != nil {
+			return err
+		}
+		defer release()
+		// the metadata service must never be reached through a proxy
+		resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+		if err != nil {
+			return fmt.Errorf("cannot reach the metadata service: %w", err)
+		}
+		defer resp.Body.Close()
+		out, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+		if err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("unexpected server id %q from the metadata service", truncate(string(out), maxLoggedResponseLength))
+		}
+		c.serverID = id
+		slog.Info("This is a Hetzner Cloud server", "server_id", id)
+	}
+
+	for page := 1; c.floatingIPID == 0; {
+		var result struct {
+			FloatingIPs []struct {
+				ID int64  `json:"id"`
+				IP string `json:"ip"`
+			} `json:"floating_ips"`
+			Meta struct {
+				Pagination struct {
+					NextPage int `json:"next_page"`
+				} `json:"pagination"`
+			} `json:"meta"`
+		}
+		if err := c.request(ctx, http.MethodGet, "/floating_ips?per_page=50&page="+strconv.Itoa(page), nil, &result); err != nil {
+			return err
+		}
+		for _, f := range result.FloatingIPs {
+			// IPv6 Floating IPs are returned as network, e.g. 2001:db8::/64
+			ip, _, err := net.ParseCIDR(f.IP)
+			if err != nil {
+				ip = net.ParseIP(f.IP)
+			}
+			if sameIP(ip, c.VIP) {
+				c.floatingIPID = f.ID
+				slog.Info("Resolved Floating IP", "vip", c.VIP, "floating_ip_id", f.ID)
+			}
+		}
+		page = result.Meta.Pagination.NextPage
+		if c.floatingIPID == 0 && page == 0 {
+			return fmt.Errorf("no Floating IP %s in this Hetzner Cloud project", c.VIP)
+		}
+	}
+	return nil
+}
+
+// queryAddress returns whether the Floating IP is assigned to this server.
+// After deconfigureAddress, it is considered released even while
+// it is still assigned to this server, until another server took over.
+func (c *HetznerCloudConfigurer) queryAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assigned, err := c.assigned()
+	if err != nil {
+		slog.Error("Error while querying Hetzner Cloud Floating IP", "err", err)
+		return false
+	}
+	if !assigned {
+		c.released = false
+	}
+	return assigned && !c.released
+}
+
+// verifyRelease checks whether the Floating IP was assigned to another server.
+func (c *HetznerCloudConfigurer) verifyRelease() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assigned, err := c.assigned()
+	return !assigned, err
+}
+
+// preflight looks up the Floating IP without assigning it, see Check
+func (c *HetznerCloudConfigurer) preflight() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assigned, err := c.assigned()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Floating IP %d, assigned to this server %d: %t", c.floatingIPID, c.serverID, assigned), nil
+}
+
+func (c *HetznerCloudConfigurer) assigned() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.QueryTimeout)*time.Millisecond)
+	defer cancel()
+
+	if err := c.resolveIDs(ctx); err != nil {
+		return false, err
+	}
+	var result struct {
+		FloatingIP struct {
+			Server *int64 `json:"server"`
+		} `json:"floating_ip"`
+	}
+	err := c.retryQuery("Hetzner Cloud API query", func() error {
+		return c.request(ctx, http.MethodGet, "/floating_ips/"+strconv.FormatInt(c.floatingIPID, 10), nil, &result)
+	})
+	if err != nil {
+		return false, err
+	}
+	return result.FloatingIP.Server != nil && *result.FloatingIP.Server == c.serverID, nil
+}
+
+// configureAddress assigns the Floating IP to this server
+func (c *HetznerCloudConfigurer) configureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ConfigureTimeout)*time.Millisecond)
+	defer cancel()
+
+	if err := c.resolveIDs(ctx); err != nil {
+		slog.Error("Error while assigning Hetzner Cloud Floating IP", "err", err)
+		c.failure = err
+		return false
+	}
+	slog.Info("Assigning Floating IP", "vip", c.VIP, "server_id", c.serverID)
+	var result struct{}
+	err := c.retryConfigure("Hetzner Cloud Floating IP assignment", func() error {
+		return c.request(ctx, http.MethodPost, "/floating_ips/"+strconv.FormatInt(c.floatingIPID, 10)+"/actions/assign",
+			map[string]int64{"server": c.serverID}, &result)
+	})
+	if err != nil {
+		slog.Error("Error while assigning Hetzner Cloud Floating IP", "err", err)
+		c.failure = err
+		return false
+	}
+	c.failure = nil
+	c.released = false
+	return true
+}
+
+// deconfigureAddress does nothing, the Floating IP is assigned
+// to another server by the new leader.
+func (c *HetznerCloudConfigurer) deconfigureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.released = true
+	return true
+}
+
+func (c *HetznerCloudConfigurer) lastFailure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failure
+}
+
+func (c *HetznerCloudConfigurer) cleanupArp() {
+	// Hetzner routes the Floating IP, no ARP involved.
+}
+
+// labels identifies this server and the Floating IP, once they are resolved
+func (c *HetznerCloudConfigurer) labels() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l := make(map[string]string)
+	if c.serverID != 0 {
+		l["server_id"] = strconv.FormatInt(c.serverID, 10)
+	}
+	if c.floatingIPID != 0 {
+		l["floating_ip_id"] = strconv.FormatInt(c.floatingIPID, 10)
+	}
+	return l
+}
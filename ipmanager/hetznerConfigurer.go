@@ -2,13 +2,25 @@ package ipmanager
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
-	"log"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
 )
 
 const (
@@ -17,35 +29,375 @@ const (
 	released   = iota // c2 == 2
 )
 
+// maxLoggedResponseLength limits how much of an API response ends up in errors and logs.
+const maxLoggedResponseLength = 200
+
+// errUnexpectedResponse is returned when the Hetzner API response can't be interpreted.
+// It is treated like any other failed API call, i.e. the call is retried on the next check.
+var errUnexpectedResponse = errors.New("unexpected response from Hetzner API")
+
+var errResponseTooLarge = errors.New("response from Hetzner API is too large")
+
+// errServerError is returned for 5xx responses, Hetzner itself has problems
+// (e.g. during an outage), so the call is retried.
+var errServerError = errors.New("hetzner API server error")
+
+// defaultOutboundProbe6 replaces an IPv4 hetzner-outbound-probe for IPv6 failover nets
+const defaultOutboundProbe6 = "[2001:4860:4860::8888]:80"
+
+// defaultRateLimitBackoff is used if the API doesn't tell how long to wait
+const defaultRateLimitBackoff = time.Minute
+
+// convergeInterval is the time between queries while waiting for a failover
+// to take effect, see awaitConvergence
+const convergeInterval = 2 * time.Second
+
+// errServerLocked is returned while Hetzner doesn't allow routing the failover-ip,
+// e.g. during maintenance.
+var errServerLocked = errors.New("hetzner failover-ip is locked")
+
+// errIPNotFound is returned once the API reported that the failover-ip doesn't exist
+// on the account, e.g. because of a typo. The API isn't called again after that.
+var errIPNotFound = fmt.Errorf("%w: failover-ip not found on this Hetzner account", errPermanent)
+
+func stateString(state int) string {
+	switch state {
+	case configured:
+		return "configured"
+	case released:
+		return "released"
+	default:
+		return "unknown"
+	}
+}
+
+// sameIP compares two addresses in their canonical form, so that
+// an IPv4-mapped IPv6 address (::ffff:1.2.3.4) matches its IPv4 form.
+func sameIP(a, b net.IP) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		return a4.Equal(b4)
+	}
+	return a.To16().Equal(b.To16())
+}
+
 // The HetznerConfigurer can be used to enable vip-management on nodes
 // rented in a Hetzner Datacenter.
 // Since Hetzner provides an API that handles failover-ip routing,
 // this API is used to manage the vip, whenever hostintype `hetzner` is set.
 type HetznerConfigurer struct {
 	*IPConfiguration
+	// serializes all operations touching the state below and the API
+	mu sync.Mutex
+
+	// the base URL of the API, and its host name, see resolveAPIHost
+	apiURL       string
+	apiHost      string
+	user         string
+	password     string
 	cachedState  int
 	lastAPICheck time.Time
-	verbose      bool
+	lastFailover time.Time
+	lastError    error
+	client       *http.Client
+	vars         *expvar.Map
+	apiReachable *expvar.Int
+	serverLocked *expvar.Int
+	// set once the failover-ip wasn't found, see failoverIPNotFound
+	ipNotFound bool
+	// counts every request sent to the API
+	apiCallsTotal *expvar.Int
+	// count the failed calls by cause, so alerts can tell them apart:
+	// the API couldn't be reached, it returned an error, its response couldn't be
+	// parsed, or a failover was accepted but the failover-ip was routed elsewhere
+	networkErrors     *expvar.Int
+	apiErrors         *expvar.Int
+	parseErrors       *expvar.Int
+	convergenceErrors *expvar.Int
+
+	// used to sample routine log lines, see shouldLog
+	apiCalls     int
+	lastOwnIP    net.IP
+	lastActiveIP net.IP
+
+	// this machine's IP the failover-ip was last seen routed to
+	configuredOwnIP net.IP
+
+	// set once the API told where the failover-ip is routed, see adoptStartupState
+	startupChecked bool
+	// set if the route to this machine found at startup wasn't adopted,
+	// so configureAddress sends the failover request in any case
+	forceFailover bool
+
+	// the main IP of hetzner-server-number, resolved once, see serverIP
+	resolvedServerIP net.IP
+	// returns the preferred outbound IP for network and probe, getOutboundIP
+	// unless replaced, e.g. to run without network access
+	outboundIPFunc func(network, probe string) net.IP
+	// returns the interface an outbound IP belongs to, interfaceOf unless replaced
+	interfaceOfFunc func(ip net.IP) *net.Interface
+
+	// the view of the API from the last failover query, see publishState
+	failover *HetznerFailover
+	// the netmask of the failover-ip as reported by the API, nil if unknown
+	reportedNetmask net.IPMask
+
+	// adds the failover-ip to the interface as well, see hetzner-bind-local
+	local       *BasicConfigurer
+	localConfig *IPConfiguration
+
+	// last successful DNS resolution of apiHost, see resolveAPIHost
+	cachedAPIAddr net.IP
+	cachedAPITime time.Time
+
+	// recent API calls, see recordAPIInteraction
+	lastHTTPStatus int
+	lastRequestID  string
+	historyMu      sync.Mutex
+	history        []apiInteraction
 }
 
-func newHetznerConfigurer(config *IPConfiguration, verbose bool) (*HetznerConfigurer, error) {
+func newHetznerConfigurer(config *IPConfiguration) (*HetznerConfigurer, error) {
+	apiURL := strings.TrimSuffix(config.HetznerAPIURL, "/")
+	if apiURL == "" {
+		apiHost, err := apiEndpoint("hetzner", config.Region)
+		if err != nil {
+			return nil, err
+		}
+		apiURL = "https://" + apiHost
+	}
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hetzner-api-url: %w", err)
+	}
+
 	c := &HetznerConfigurer{
 		IPConfiguration: config,
+		apiURL:          apiURL,
+		apiHost:         u.Hostname(),
 		cachedState:     unknown,
 		lastAPICheck:    time.Unix(0, 0),
-		verbose:         verbose}
+		outboundIPFunc:  getOutboundIP,
+		interfaceOfFunc: interfaceOf,
+	}
+	if err := c.loadCredentials(); err != nil {
+		return nil, err
+	}
+	if config.HetznerBindLocal {
+		// a copy, the netmask is replaced by the one the API reports
+		localConfig := *config
+		c.localConfig = &localConfig
+		if c.local, err = newBasicConfigurer(c.localConfig); err != nil {
+			return nil, err
+		}
+	}
+	c.client = &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         c.dialAPI,
+		TLSClientConfig:     &tls.Config{MinVersion: config.TLSMinVersion},
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+
+	// published read-only on /debug/vars when http-listen-address is set,
+	// by failover-ip, as several configurers may run, see multiConfigurer
+	c.vars = new(expvar.Map).Init()
+	hetznerVars.Do(func() {
+		hetznerVars.state = expvar.NewMap("hetzner")
+		hetznerVars.history = map[string]*HetznerConfigurer{}
+		expvar.Publish("hetzner_api_history", expvar.Func(apiHistories))
+		expvar.Publish("vipmanager_hetzner_ip_not_found", hetznerIPNotFound)
+	})
+	hetznerVars.state.Set(c.VIP.String(), c.vars)
+	hetznerIPNotFound.Set(c.VIP.String(), c.Iface.Name, 0)
+	hetznerVars.Lock()
+	hetznerVars.history[c.VIP.String()] = c
+	hetznerVars.Unlock()
+
+	c.apiReachable = hetznerInt("vipmanager_api_reachable")
+	c.apiCallsTotal = hetznerInt("vipmanager_hetzner_api_calls_total")
+	c.serverLocked = hetznerInt("vipmanager_hetzner_server_locked")
+	c.networkErrors = hetznerInt("vipmanager_hetzner_network_errors_total")
+	c.apiErrors = hetznerInt("vipmanager_hetzner_api_errors_total")
+	c.parseErrors = hetznerInt("vipmanager_hetzner_parse_errors_total")
+	c.convergenceErrors = hetznerInt("vipmanager_hetzner_convergence_errors_total")
+	c.publishState()
 
 	return c, nil
 }
 
+// hetznerIPNotFound is 1 for each failover-ip the API reported not to exist, see failoverIPNotFound
+var hetznerIPNotFound = newVIPGauge()
+
+// hetznerVars holds the variables published for all failover IPs managed by
+// this process, keyed by failover-ip.
+var hetznerVars struct {
+	sync.Once
+	sync.Mutex
+	state   *expvar.Map
+	history map[string]*HetznerConfigurer
+}
+
+// unpublish removes the variables of the failover-ip, see unpublisher
+func (c *HetznerConfigurer) unpublish() {
+	vip := c.VIP.String()
+	hetznerVars.state.Delete(vip)
+	hetznerVars.Lock()
+	delete(hetznerVars.history, vip)
+	hetznerVars.Unlock()
+	hetznerIPNotFound.Delete(vip, c.Iface.Name)
+}
+
+// hetznerInt returns the published expvar.Int name if it exists, or a new one,
+// as the counters are shared by all configurers, see multiConfigurer.
+func hetznerInt(name string) *expvar.Int {
+	// configurers may be created concurrently, see multiConfigurer.initMembers
+	hetznerVars.Lock()
+	defer hetznerVars.Unlock()
+	if v, ok := expvar.Get(name).(*expvar.Int); ok {
+		return v
+	}
+	return expvar.NewInt(name)
+}
+
+// labels identifies the server the failover-ip belongs to, once it is known
+func (c *HetznerConfigurer) labels() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failover == nil || c.failover.ServerNumber == 0 {
+		return nil
+	}
+	return map[string]string{"server_number": strconv.FormatInt(c.failover.ServerNumber, 10)}
+}
+
+// status returns the cached state of the failover-ip and when it was last queried
+func (c *HetznerConfigurer) status() (string, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return stateString(c.cachedState), c.lastAPICheck
+}
+
+// publishState exports the configurer's internal state via expvar.
+func (c *HetznerConfigurer) publishState() {
+	state := new(expvar.String)
+	state.Set(stateString(c.cachedState))
+	c.vars.Set("cached_state", state)
+
+	lastAPICheck := new(expvar.String)
+	lastAPICheck.Set(c.lastAPICheck.Format(time.RFC3339))
+	c.vars.Set("last_api_check", lastAPICheck)
+
+	lastError := new(expvar.String)
+	if c.lastError != nil {
+		lastError.Set(c.lastError.Error())
+	}
+	c.vars.Set("last_error", lastError)
+
+	activeServerIP := new(expvar.String)
+	if c.lastActiveIP != nil {
+		activeServerIP.Set(c.lastActiveIP.String())
+	}
+	c.vars.Set("active_server_ip", activeServerIP)
+
+	var failover HetznerFailover
+	if c.failover != nil {
+		failover = *c.failover
+	}
+	serverNumber := new(expvar.Int)
+	serverNumber.Set(failover.ServerNumber)
+	c.vars.Set("server_number", serverNumber)
+	for name, value := range map[string]string{"failover_ip": failover.IP, "netmask": failover.Netmask, "server_ip": failover.ServerIP} {
+		v := new(expvar.String)
+		v.Set(value)
+		c.vars.Set(name, v)
+	}
+}
+
+// failoverDetails returns the failover-ip as last reported by the API, see failoverReporter
+func (c *HetznerConfigurer) failoverDetails() *HetznerFailover {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failover == nil {
+		return nil
+	}
+	failover := *c.failover
+	return &failover
+}
+
+// apiInteraction is a record of a single call to the Hetzner API, kept for debugging
+type apiInteraction struct {
+	Time           time.Time `json:"time"`
+	Type           string    `json:"type"`
+	HTTPStatus     int       `json:"http_status"`
+	RequestID      string    `json:"request_id,omitempty"`
+	ActiveServerIP string    `json:"active_server_ip,omitempty"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// setRequestHeaders sets the user agent and a random request ID, so that calls
+// can be attributed to this instance, e.g. by Hetzner support. It returns the ID.
+func (c *HetznerConfigurer) setRequestHeaders(req *http.Request) string {
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	id := randomHex(8)
+	req.Header.Set("X-Request-ID", id)
+	return id
+}
+
+// recordAPIInteraction keeps the last hetzner-api-history-size API calls,
+// published on /debug/vars as hetzner_api_history.
+func (c *HetznerConfigurer) recordAPIInteraction(post bool, activeIP net.IP, err error) {
+	if c.HetznerAPIHistorySize <= 0 {
+		return
+	}
+	i := apiInteraction{Time: time.Now(), Type: "read", HTTPStatus: c.lastHTTPStatus, RequestID: c.lastRequestID}
+	if post {
+		i.Type = "write"
+	}
+	if activeIP != nil {
+		i.ActiveServerIP = activeIP.String()
+	}
+	if err != nil {
+		i.Error = err.Error()
+	}
+
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	if len(c.history) >= c.HetznerAPIHistorySize {
+		copy(c.history, c.history[len(c.history)-c.HetznerAPIHistorySize+1:])
+		c.history = c.history[:c.HetznerAPIHistorySize-1]
+	}
+	c.history = append(c.history, i)
+}
+
+func (c *HetznerConfigurer) apiHistory() []apiInteraction {
+	c.historyMu.Lock()
+	defer c.historyMu.Unlock()
+	return append([]apiInteraction(nil), c.history...)
+}
+
+// apiHistories returns the recent API calls of every failover-ip, see recordAPIInteraction
+func apiHistories() interface{} {
+	hetznerVars.Lock()
+	defer hetznerVars.Unlock()
+	histories := make(map[string][]apiInteraction, len(hetznerVars.history))
+	for vip, c := range hetznerVars.history {
+		histories[vip] = c.apiHistory()
+	}
+	return histories
+}
+
 /**
  * In order to tell the Hetzner API to route the failover-ip to
  * this machine, we must attach our own IP address to the API request.
  */
-func getOutboundIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+func getOutboundIP(network, probe string) net.IP {
+	conn, err := net.Dial(network, probe)
 	if err != nil || conn == nil {
-		log.Println("error dialing 8.8.8.8 to retrieve preferred outbound IP", err)
+		slog.Warn("Error dialing probe to retrieve preferred outbound IP", "probe", probe, "err", err)
 		return nil
 	}
 	defer conn.Close()
@@ -55,156 +407,755 @@ func getOutboundIP() net.IP {
 	return localAddr.IP
 }
 
-func (c *HetznerConfigurer) curlQueryFailover(post bool) (string, error) {
-	/**
-	 * The credentials for the API are loaded from a file stored in /etc/hetzner .
-	 */
-	//TODO: make credentialsFile dynamically changeable?
-	credentialsFile := "/etc/hetzner"
-	f, err := os.Open(credentialsFile)
+// outboundIP retries outboundIPFunc, as routing might be briefly unavailable
+// e.g. during boot or while an interface is flapping.
+// The result is checked against the addresses of the configured interface.
+func (c *HetznerConfigurer) outboundIP() net.IP {
+	if c.HetznerActiveServerIP != nil {
+		return c.HetznerActiveServerIP
+	}
+	if c.HetznerServerNumber > 0 {
+		return c.serverIP()
+	}
+	// an IPv6 failover net must be routed to an IPv6 address of this machine
+	network, probe := "udp4", c.HetznerOutboundProbe
+	if c.VIP.To4() == nil {
+		network = "udp6"
+		if host, _, err := net.SplitHostPort(probe); err == nil && net.ParseIP(host).To4() != nil {
+			probe = defaultOutboundProbe6
+		}
+	}
+
+	if c.PreferInterfaceAddress {
+		if network == "udp6" {
+			if ip := interfaceIPv6(&c.Iface); ip != nil {
+				return ip
+			}
+			slog.Warn("Interface has no global IPv6 address, falling back to the preferred outbound IP", "interface", c.Iface.Name)
+		} else {
+			if ip := interfaceIPv4(&c.Iface); ip != nil {
+				return ip
+			}
+			slog.Warn("Interface has no IPv4 address, falling back to the preferred outbound IP", "interface", c.Iface.Name)
+		}
+	}
+
+	for i := 0; ; i++ {
+		ip := c.outboundIPFunc(network, probe)
+		if ip != nil {
+			return c.checkSource(ip)
+		}
+		if i >= c.OutboundIPRetries {
+			return nil
+		}
+		slog.Info("Retrying to retrieve preferred outbound IP", "retry_after_ms", c.RetryAfter, "retry", i+1, "retries", c.OutboundIPRetries)
+		time.Sleep(time.Duration(c.RetryAfter) * time.Millisecond)
+	}
+}
+
+// serverIP returns the main IP of hetzner-server-number, which the failover-ip is
+// routed to, looking it up through the API once. The source address of this
+// machine may differ, e.g. when using additional subnets.
+func (c *HetznerConfigurer) serverIP() net.IP {
+	if c.resolvedServerIP != nil {
+		return c.resolvedServerIP
+	}
+	ip, err := c.queryServerIP()
 	if err != nil {
-		log.Println("can't open passwordfile", err)
-		return "", err
+		slog.Error("Couldn't look up the main IP of this server", "server_number", c.HetznerServerNumber, "err", err)
+		return nil
+	}
+	slog.Info("Resolved the main IP of this server", "server_number", c.HetznerServerNumber, "server_ip", ip)
+	c.resolvedServerIP = ip
+	return ip
+}
+
+// queryServerIP asks the API for the main IP of hetzner-server-number
+func (c *HetznerConfigurer) queryServerIP() (net.IP, error) {
+	if wait := rateLimitWait(); wait > 0 {
+		return nil, fmt.Errorf("hetzner API: %w, not calling it for another %s", errRateLimited, wait.Round(time.Second))
+	}
+	user, password := c.user, c.password
+	if user == "" {
+		var err error
+		if user, password, err = readCredentialsFile(); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.QueryTimeout)*time.Millisecond)
+	defer cancel()
+
+	apiURL := c.apiURL + "/server/" + strconv.Itoa(c.HetznerServerNumber)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(user, password)
+	requestID := c.setRequestHeaders(req)
+	slog.Debug("Hetzner API request", "method", http.MethodGet, "url", apiURL, "user", user, "request_id", requestID)
+
+	c.apiCallsTotal.Add(1)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.networkErrors.Add(1)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(c.HetznerMaxResponseBytes)+1))
+	if err != nil {
+		c.networkErrors.Add(1)
+		return nil, err
+	}
+	if len(out) > c.HetznerMaxResponseBytes {
+		c.parseErrors.Add(1)
+		return nil, fmt.Errorf("%w: more than %d bytes", errResponseTooLarge, c.HetznerMaxResponseBytes)
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.apiErrors.Add(1)
+		return nil, fmt.Errorf("hetzner API returned %s: %s", resp.Status, truncate(string(out), maxLoggedResponseLength))
+	}
+	var result struct {
+		Server struct {
+			ServerIP string `json:"server_ip"`
+		} `json:"server"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		c.parseErrors.Add(1)
+		return nil, fmt.Errorf("%w: %v", errUnexpectedResponse, err)
+	}
+	ip := net.ParseIP(result.Server.ServerIP).To4()
+	if ip == nil {
+		c.parseErrors.Add(1)
+		return nil, fmt.Errorf("%w: invalid server_ip %q", errUnexpectedResponse, truncate(result.Server.ServerIP, maxLoggedResponseLength))
+	}
+	return ip, nil
+}
+
+// checkSource warns if ip isn't an address of the configured interface,
+// which hints at asymmetric routing. With strict-source-check, ip is rejected.
+// With require-up-interface-for-source, ip is rejected if its interface is down.
+func (c *HetznerConfigurer) checkSource(ip net.IP) net.IP {
+	if c.RequireUpInterfaceForSource {
+		if iface := c.interfaceOfFunc(ip); iface != nil && iface.Flags&net.FlagUp == 0 {
+			slog.Error("Preferred outbound IP belongs to an interface that is down, refusing to use it", "ip", ip, "interface", iface.Name)
+			return nil
+		}
+	}
+	if interfaceHasIP(&c.Iface, ip) {
+		return ip
+	}
+	if c.StrictSourceCheck {
+		slog.Error("Preferred outbound IP is not an address of the interface, refusing to use it", "ip", ip, "interface", c.Iface.Name)
+		return nil
+	}
+	slog.Warn("Preferred outbound IP is not an address of the interface", "ip", ip, "interface", c.Iface.Name)
+	return ip
+}
+
+func interfaceHasIP(iface *net.Interface, ip net.IP) bool {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// interfaceOf returns the interface ip is an address of, with its current flags
+func interfaceOf(ip net.IP) *net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for i := range ifaces {
+		if interfaceHasIP(&ifaces[i], ip) {
+			return &ifaces[i]
+		}
+	}
+	return nil
+}
+
+func interfaceIPv4(iface *net.Interface) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+// interfaceIPv6 returns the first global unicast IPv6 address of iface.
+func interfaceIPv6(iface *net.Interface) net.IP {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsGlobalUnicast() {
+			return ipnet.IP
+		}
+	}
+	return nil
+}
+
+/**
+ * Routine log lines are only emitted on every LogSampleEvery-th API call,
+ * unless the logged value changed since the last call.
+ * Errors are always logged.
+ */
+func (c *HetznerConfigurer) shouldLog(changed bool) bool {
+	return changed || c.LogSampleEvery <= 1 || c.apiCalls%c.LogSampleEvery == 1
+}
+
+// resolveAPIHost returns the address of the API host to connect to.
+// If resolving fails, the last address that was resolved within
+// hetzner-dns-cache-ttl is used instead, keeping failovers working through
+// brief DNS outages. Without a TTL, nil is returned and the dialer resolves the host itself.
+func (c *HetznerConfigurer) resolveAPIHost(ctx context.Context) net.IP {
+	if c.HetznerDNSCacheTTL <= 0 {
+		return nil
+	}
+	network := "ip4"
+	switch c.HetznerIPVersion {
+	case "auto":
+		network = "ip"
+	case "ipv6":
+		network = "ip6"
+	}
+	addrs, err := net.DefaultResolver.LookupIP(ctx, network, c.apiHost)
+	if err == nil && len(addrs) > 0 {
+		c.cachedAPIAddr = addrs[0]
+		c.cachedAPITime = time.Now()
+	} else if c.cachedAPIAddr != nil && time.Since(c.cachedAPITime) < time.Duration(c.HetznerDNSCacheTTL)*time.Millisecond {
+		slog.Warn("Couldn't resolve the API host, falling back to the cached address", "host", c.apiHost, "err", err, "address", c.cachedAPIAddr)
+	} else {
+		return nil
+	}
+	return c.cachedAPIAddr
+}
+
+// dialAPI connects using the IP version selected by hetzner-ip-version,
+// and to the address returned by resolveAPIHost when connecting to the API host.
+func (c *HetznerConfigurer) dialAPI(ctx context.Context, _, addr string) (net.Conn, error) {
+	network := "tcp4"
+	switch c.HetznerIPVersion {
+	case "auto":
+		network = "tcp"
+	case "ipv6":
+		network = "tcp6"
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == c.apiHost {
+		if ip := c.resolveAPIHost(ctx); ip != nil {
+			addr = net.JoinHostPort(ip.String(), port)
+		}
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
+
+// readCredentialsFile reads the credentials for the API from /etc/hetzner,
+// used unless hetzner-user and hetzner-password (or their files) are set.
+func readCredentialsFile() (string, string, error) {
+	//TODO: make vipconfig.HetznerCredentialsFile dynamically changeable?
+	f, err := os.Open(vipconfig.HetznerCredentialsFile)
+	if err != nil {
+		slog.Error("Can't open password file", "err", err)
+		return "", "", err
 	}
 	defer f.Close()
 
-	/**
-	 * The retrieval of username and password from the file is rather static,
-	 * so the credentials file must conform to the offsets down below perfectly.
-	 */
+	// the file holds the lines user="..." and pass="...", other lines are ignored
 	var user string
 	var password string
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
 		line := scanner.Text()
-		switch line[:4] {
-		case "user":
-			user = line[6 : len(line)-1]
-		case "pass":
-			password = line[6 : len(line)-1]
+		if value, ok := strings.CutPrefix(line, `user="`); ok {
+			user = strings.TrimSuffix(value, `"`)
+		} else if value, ok := strings.CutPrefix(line, `pass="`); ok {
+			password = strings.TrimSuffix(value, `"`)
 		}
 	}
 	if user == "" || password == "" {
-		log.Println("Couldn't retrieve username or password from file", credentialsFile)
-		return "", errors.New("Couldn't retrieve username or password from file")
+		slog.Error("Couldn't retrieve username or password from file", "file", vipconfig.HetznerCredentialsFile)
+		return "", "", errors.New("couldn't retrieve username or password from file")
+	}
+	vipconfig.RegisterSecret(password)
+	return user, password, nil
+}
+
+// readCredential returns the trimmed contents of file if it is set, e.g. a
+// mounted Kubernetes secret, and value otherwise.
+func readCredential(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	if s := strings.TrimSpace(string(b)); s != "" {
+		return s, nil
+	}
+	return "", fmt.Errorf("%s is empty", file)
+}
+
+// loadCredentials reads hetzner-user and hetzner-password at startup, falling
+// back to /etc/hetzner, which is read on every API call, if neither is set.
+func (c *HetznerConfigurer) loadCredentials() error {
+	user, err := readCredential(c.HetznerUser, c.HetznerUserFile)
+	if err != nil {
+		return fmt.Errorf("cannot read hetzner-user-file: %w", err)
+	}
+	password, err := readCredential(c.HetznerPassword, c.HetznerPasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read hetzner-password-file: %w", err)
+	}
+	switch {
+	case user != "" && password != "":
+		vipconfig.RegisterSecret(password)
+		c.user, c.password = user, password
+	case user != "" || password != "":
+		return errors.New("hetzner-user and hetzner-password (or their files) must be set together")
+	default:
+		if _, err := os.Stat(vipconfig.HetznerCredentialsFile); err != nil {
+			return fmt.Errorf("no Hetzner credentials, set hetzner-user and hetzner-password or create %s: %w", vipconfig.HetznerCredentialsFile, err)
+		}
+	}
+	return nil
+}
+
+func (c *HetznerConfigurer) queryFailover(method string) (string, error) {
+	// only describe this call in recordAPIInteraction, even if it fails without a response
+	c.lastHTTPStatus, c.lastRequestID = 0, ""
+	if c.ipNotFound {
+		return "", errIPNotFound
+	}
+	if wait := rateLimitWait(); wait > 0 {
+		return "", fmt.Errorf("hetzner API: %w, not calling it for another %s", errRateLimited, wait.Round(time.Second))
+	}
+	c.apiCalls++
+
+	var err error
+	user, password := c.user, c.password
+	if user == "" {
+		if user, password, err = readCredentialsFile(); err != nil {
+			return "", err
+		}
 	}
 
 	/**
-	 * As Hetzner API only allows IPv4 connections, we rely on curl
-	 * instead of GO's own http package,
-	 * as selecting IPv4 transport there doesn't seem trivial.
-	 *
-	 * If post is set to true, a failover will be triggered.
-	 * If it is set to false, the current state (i.e. route)
-	 * for the failover-ip will be retrieved.
+	 * A POST triggers a failover to this machine, a DELETE removes the route.
+	 * A GET retrieves the current state (i.e. route) for the failover-ip.
+	 * The IP version used for the transport is selected in dialAPI.
 	 */
-	var cmd *exec.Cmd
-	if post {
-		myOwnIP := getOutboundIP()
+	timeout := c.QueryTimeout
+	if method != http.MethodGet {
+		timeout = c.ConfigureTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Millisecond)
+	defer cancel()
+
+	apiURL := c.apiURL + "/failover/" + c.IPConfiguration.VIP.String()
+	var req *http.Request
+	var form string
+	if method == http.MethodPost {
+		myOwnIP := c.outboundIP()
 		if myOwnIP == nil {
-			log.Printf("Error determining this machine's IP address.")
-			return "", errors.New("Error determining this machine's IP address")
+			slog.Error("Error determining this machine's IP address")
+			return "", errors.New("error determining this machine's IP address")
 		}
-		log.Printf("my_own_ip: %s\n", myOwnIP.String())
-
-		cmd = exec.Command("curl",
-			"--ipv4",
-			"-u", user+":"+password,
-			"https://robot-ws.your-server.de/failover/"+c.IPConfiguration.VIP.String(),
-			"-d", "active_server_ip="+myOwnIP.String())
+		if c.shouldLog(!myOwnIP.Equal(c.lastOwnIP)) {
+			slog.Info("Determined this machine's IP", "my_own_ip", myOwnIP)
+		}
+		c.lastOwnIP = myOwnIP
 
-		if c.verbose {
-			log.Printf("%s %s %s '%s' %s %s %s",
-				"curl",
-				"--ipv4",
-				"-u", user+":XXXXXX",
-				"https://robot-ws.your-server.de/failover/"+c.IPConfiguration.VIP.String(),
-				"-d", "active_server_ip="+myOwnIP.String())
+		form = url.Values{"active_server_ip": {myOwnIP.String()}}.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, apiURL, strings.NewReader(form))
+		if err != nil {
+			return "", err
 		}
-	} else {
-		cmd = exec.Command("curl",
-			"--ipv4",
-			"-u", user+":"+password,
-			"https://robot-ws.your-server.de/failover/"+c.IPConfiguration.VIP.String())
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-		if c.verbose {
-			log.Printf("%s %s %s %s %s",
-				"curl",
-				"--ipv4",
-				"-u", user+":XXXXXX",
-				"https://robot-ws.your-server.de/failover/"+c.IPConfiguration.VIP.String())
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, apiURL, nil)
+		if err != nil {
+			return "", err
 		}
 	}
+	req.SetBasicAuth(user, password)
+	c.lastRequestID = c.setRequestHeaders(req)
+	slog.Debug("Hetzner API request", "method", method, "url", apiURL, "user", user, "form", form, "request_id", c.lastRequestID)
+
+	c.apiCallsTotal.Add(1)
+	resp, err := c.client.Do(req)
 
-	out, err := cmd.Output()
+	// the request only fails if the API couldn't be reached at all,
+	// errors reported by the API itself are handled in getActiveIPFromJSON
+	if err != nil {
+		c.apiReachable.Set(0)
+		c.networkErrors.Add(1)
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("hetzner API call timed out after %d ms", timeout)
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+	c.apiReachable.Set(1)
+	c.lastHTTPStatus = resp.StatusCode
+	if resp.StatusCode == http.StatusTooManyRequests {
+		c.apiErrors.Add(1)
+		backoff := defaultRateLimitBackoff
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			backoff = time.Duration(seconds) * time.Second
+		}
+		return "", c.rateLimited(backoff)
+	}
+	if resp.StatusCode >= 500 {
+		c.apiErrors.Add(1)
+		return "", fmt.Errorf("%w: HTTP status %d", errServerError, resp.StatusCode)
+	}
 
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(c.HetznerMaxResponseBytes)+1))
+	if ctx.Err() == context.DeadlineExceeded {
+		c.networkErrors.Add(1)
+		return "", fmt.Errorf("hetzner API call timed out after %d ms", timeout)
+	}
 	if err != nil {
+		c.networkErrors.Add(1)
 		return "", err
 	}
+	if len(out) > c.HetznerMaxResponseBytes {
+		c.parseErrors.Add(1)
+		return "", fmt.Errorf("%w: more than %d bytes", errResponseTooLarge, c.HetznerMaxResponseBytes)
+	}
+
+	return string(out), nil
+}
 
-	retStr := string(out[:])
+// hetznerNumber accepts both JSON numbers and numbers in quoted strings,
+// so minor variations of the API responses don't break parsing.
+type hetznerNumber int64
 
-	return retStr, nil
+func (n *hetznerNumber) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid number %s", errUnexpectedResponse, truncate(string(b), maxLoggedResponseLength))
+	}
+	*n = hetznerNumber(f)
+	return nil
+}
+
+// HetznerFailover is the failover-ip as reported by the last successful API call.
+// ServerIP and ServerNumber name the server the failover-ip belongs to,
+// ActiveServerIP the one it is routed to, which may be empty.
+type HetznerFailover struct {
+	IP             string `json:"ip"`
+	Netmask        string `json:"netmask"`
+	ServerIP       string `json:"server_ip"`
+	ServerNumber   int64  `json:"server_number"`
+	ActiveServerIP string `json:"active_server_ip"`
+}
+
+// hetznerResponse is the answer of the failover endpoint,
+// either failover or error is set.
+type hetznerResponse struct {
+	Error *struct {
+		Status   hetznerNumber `json:"status"`
+		Code     string        `json:"code"`
+		Message  string        `json:"message"`
+		Interval hetznerNumber `json:"interval"`
+	} `json:"error"`
+	Failover *struct {
+		IP           string        `json:"ip"`
+		Netmask      string        `json:"netmask"`
+		ServerIP     string        `json:"server_ip"`
+		ServerNumber hetznerNumber `json:"server_number"`
+		// may be empty (or null) if no server is active
+		ActiveServerIP string `json:"active_server_ip"`
+	} `json:"failover"`
 }
 
 /**
  * This function is used to parse the response which comes from the
- * curlQueryFailover function and in turn from the curl calls to the API.
+ * queryFailover function and in turn from the API.
+ * If no server is active for the failover-ip, nil is returned without an error.
  */
-func (c *HetznerConfigurer) getActiveIPFromJSON(str string) (net.IP, error) {
-	var f map[string]interface{}
+func (c *HetznerConfigurer) getActiveIPFromJSON(str string) (_ net.IP, err error) {
+	defer func() {
+		if errors.Is(err, errUnexpectedResponse) {
+			c.parseErrors.Add(1)
+		}
+	}()
+	var f hetznerResponse
 
-	if c.verbose {
-		log.Printf("JSON response: %s\n", str)
-	}
+	slog.Debug("Hetzner API response", "body", str)
 
-	err := json.Unmarshal([]byte(str), &f)
+	err = json.Unmarshal([]byte(str), &f)
 	if err != nil {
-		log.Println(err)
+		slog.Error("Couldn't parse the Hetzner API response", "err", err)
+		if !errors.Is(err, errUnexpectedResponse) {
+			err = fmt.Errorf("%w: %v", errUnexpectedResponse, err)
+		}
+		return nil, err
+	}
+
+	if f.Error != nil {
+		c.apiErrors.Add(1)
+		if f.Error.Code == "FAILOVER_LOCKED" {
+			slog.Warn("Server locked, cannot failover", "message", f.Error.Message)
+			c.serverLocked.Set(1)
+			return nil, errServerLocked
+		}
+
+		if f.Error.Code == "IP_NOT_FOUND" || f.Error.Code == "NOT_FOUND" {
+			return nil, c.failoverIPNotFound(f.Error.Message)
+		}
+
+		if f.Error.Code == "RATE_LIMIT_EXCEEDED" || f.Error.Code == "RATELIMIT_EXCEEDED" {
+			backoff := defaultRateLimitBackoff
+			if f.Error.Interval > 0 {
+				backoff = time.Duration(f.Error.Interval) * time.Second
+			}
+			return nil, c.rateLimited(backoff)
+		}
+
+		slog.Error("There was an error accessing the Hetzner API!",
+			"status", f.Error.Status,
+			"code", f.Error.Code,
+			"message", f.Error.Message)
+		err := fmt.Errorf("hetzner API returned error response %d %s", f.Error.Status, f.Error.Code)
+		if f.Error.Status >= 400 && f.Error.Status < 500 {
+			// e.g. wrong credentials or invalid input, repeating the call right away won't help
+			err = fmt.Errorf("%w: %v", errPermanent, err)
+		}
 		return nil, err
 	}
 
-	if f["error"] != nil {
-		errormap := f["error"].(map[string]interface{})
+	if f.Failover != nil {
+		failover := f.Failover
+		if err := checkFailoverFields(str); err != nil {
+			return nil, err
+		}
+		c.serverLocked.Set(0)
+		c.failover = &HetznerFailover{
+			IP:             failover.IP,
+			Netmask:        failover.Netmask,
+			ServerIP:       failover.ServerIP,
+			ServerNumber:   int64(failover.ServerNumber),
+			ActiveServerIP: failover.ActiveServerIP,
+		}
+		c.reportedNetmask = parseHetznerNetmask(failover.Netmask, c.VIP)
+
+		if failover.ActiveServerIP == "" {
+			if c.shouldLog(c.lastActiveIP != nil) {
+				slog.Info("No active server for failover-ip", "failover_ip", failover.IP)
+			}
+			c.lastActiveIP = nil
+			return nil, nil
+		}
+
+		activeIP := net.ParseIP(failover.ActiveServerIP)
+		if activeIP == nil {
+			return nil, fmt.Errorf("%w: invalid active_server_ip %q", errUnexpectedResponse, truncate(failover.ActiveServerIP, maxLoggedResponseLength))
+		}
+		if ip4 := activeIP.To4(); ip4 != nil {
+			activeIP = ip4
+		}
+		if c.shouldLog(!sameIP(activeIP, c.lastActiveIP)) {
+			slog.Info("Result of the failover query",
+				"failover_ip", failover.IP,
+				"netmask", failover.Netmask,
+				"server_ip", failover.ServerIP,
+				"server_number", failover.ServerNumber,
+				"active_server_ip", failover.ActiveServerIP,
+			)
+		}
+		c.lastActiveIP = activeIP
+
+		return activeIP, nil
 
-		log.Printf("There was an error accessing the Hetzner API!\n"+
-			" status: %f\n code: %s\n message: %s\n",
-			errormap["status"].(float64),
-			errormap["code"].(string),
-			errormap["message"].(string))
-		return nil, errors.New("Hetzner API returned error response")
 	}
 
-	if f["failover"] != nil {
-		failovermap := f["failover"].(map[string]interface{})
+	return nil, fmt.Errorf("%w: neither \"failover\" nor \"error\" found in %q",
+		errUnexpectedResponse, truncate(str, maxLoggedResponseLength))
+}
+
+// checkFailoverFields makes sure that the failover object of a response has an
+// active_server_ip, as a missing one, e.g. after the API renamed it, would
+// otherwise be taken for a failover-ip that isn't routed anywhere.
+func checkFailoverFields(str string) error {
+	var fields struct {
+		Failover map[string]json.RawMessage `json:"failover"`
+	}
+	if err := json.Unmarshal([]byte(str), &fields); err != nil {
+		return fmt.Errorf("%w: %v", errUnexpectedResponse, err)
+	}
+	if _, ok := fields.Failover["active_server_ip"]; !ok {
+		return fmt.Errorf("%w: active_server_ip is missing in %q", errUnexpectedResponse, truncate(str, maxLoggedResponseLength))
+	}
+	return nil
+}
+
+// parseHetznerNetmask parses the netmask of a failover response, given either
+// as address (e.g. 255.255.255.255) or prefix length. It returns nil if it is invalid.
+func parseHetznerNetmask(s string, vip net.IP) net.IPMask {
+	bits := 128
+	if vip.To4() != nil {
+		bits = 32
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 || n > bits {
+			return nil
+		}
+		return net.CIDRMask(n, bits)
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	mask := net.IPMask(ip.To16())
+	if bits == 32 {
+		if ip.To4() == nil {
+			return nil
+		}
+		mask = net.IPMask(ip.To4())
+	}
+	if ones, maskBits := mask.Size(); ones == 0 && maskBits == 0 {
+		// not a contiguous mask
+		return nil
+	}
+	return mask
+}
 
-		ip := failovermap["ip"].(string)
-		netmask := failovermap["netmask"].(string)
-		serverIP := failovermap["server_ip"].(string)
-		serverNumber := failovermap["server_number"].(float64)
-		activeServerIP := failovermap["active_server_ip"].(string)
+// failoverIPNotFound marks this configurer as permanently failed, as the vip
+// can never be managed, or exits, depending on hetzner-on-ip-not-found.
+func (c *HetznerConfigurer) failoverIPNotFound(message string) error {
+	if c.HetznerOnIPNotFound == "fatal" {
+		slog.Error("CRITICAL: failover-ip doesn't exist on this Hetzner account, check ip and the credentials", "vip", c.VIP, "message", message)
+		os.Exit(1)
+	}
+	slog.Error("CRITICAL: failover-ip doesn't exist on this Hetzner account, check ip and the credentials. "+
+		"Not calling the Hetzner API anymore until vip-manager is restarted", "vip", c.VIP, "message", message)
+	c.ipNotFound = true
+	hetznerIPNotFound.Set(c.VIP.String(), c.Iface.Name, 1)
+	return errIPNotFound
+}
 
-		log.Println("Result of the failover query was: ",
-			"failover-ip=", ip,
-			"netmask=", netmask,
-			"server_ip=", serverIP,
-			"server_number=", serverNumber,
-			"active_server_ip=", activeServerIP,
-		)
+// hetznerRateLimit is shared by all failover IPs managed by this process,
+// as the Robot API limits the calls of the account, not of the failover-ip.
+var hetznerRateLimit struct {
+	sync.Mutex
+	// the API isn't called before this, see rateLimited
+	until time.Time
+}
 
-		return net.ParseIP(activeServerIP), nil
+// rateLimitWait returns how long the API must not be called anymore
+func rateLimitWait() time.Duration {
+	hetznerRateLimit.Lock()
+	defer hetznerRateLimit.Unlock()
+	return time.Until(hetznerRateLimit.until)
+}
 
+// rateLimited makes sure the API isn't called again before backoff passed,
+// for any of the failover IPs.
+func (c *HetznerConfigurer) rateLimited(backoff time.Duration) error {
+	hetznerRateLimit.Lock()
+	if until := time.Now().Add(backoff); until.After(hetznerRateLimit.until) {
+		hetznerRateLimit.until = until
 	}
+	hetznerRateLimit.Unlock()
+	slog.Warn("Hetzner API rate limit exceeded, not calling it for a while", "backoff", backoff)
+	return fmt.Errorf("hetzner API: %w", errRateLimited)
+}
 
-	return nil, errors.New("why did we end up here?")
+// cacheExpired returns whether the last API check is older than hetzner-cache-ttl.
+// A check that seems to be in the future, e.g. because the wall clock was set
+// back, is treated as expired, so the cache can't be stuck.
+func (c *HetznerConfigurer) cacheExpired() bool {
+	age := time.Since(c.lastAPICheck)
+	return age < 0 || age > time.Duration(c.HetznerCacheTTL)*time.Millisecond
 }
 
+// holdState keeps the last known state after an error that doesn't tell anything
+// about the failover-ip, instead of moving the vip back and forth.
+func (c *HetznerConfigurer) holdState(previousState int, err error) bool {
+	c.lastError = err
+	slog.Warn("Keeping the last known state", "err", err, "state", stateString(previousState))
+	c.cachedState = previousState
+	return previousState == configured
+}
+
+// truncate shortens s to at most n bytes, marking it as truncated.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// queryAddress returns whether the failover-ip is routed to this machine.
+// With hetzner-bind-local, it must be bound to the interface as well,
+// otherwise configureAddress is asked to bind it.
 func (c *HetznerConfigurer) queryAddress() bool {
-	if (time.Since(c.lastAPICheck) / time.Hour) > 1 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.publishState()
+
+	routed := c.queryRoute()
+	if routed && c.local != nil && !c.local.queryAddress() {
+		slog.Info("Failover-ip is routed to this machine, but not bound to the interface", "vip", c.VIP, "interface", c.Iface.Name)
+		return false
+	}
+	return routed
+}
+
+// queryRoute returns whether the failover-ip is routed to this machine, asking the API if the cache expired
+func (c *HetznerConfigurer) queryRoute() bool {
+	if backoff := time.Duration(c.HetznerPostConfigureBackoff) * time.Millisecond; time.Since(c.lastFailover) < backoff {
+		/** The API might still return stale data right after a failover,
+		 * so trust the state we just set.
+		 */
+		slog.Info("Failover was issued recently, skipping Hetzner API query", "ago", time.Since(c.lastFailover).Round(time.Millisecond))
+		return c.cachedState == configured
+	}
+
+	if c.cachedState == configured && c.configuredOwnIP != nil {
+		/** The failover-ip is routed to the IP this machine had back then,
+		 * if that changed (e.g. a new DHCP lease), it has to be routed again.
+		 */
+		if ownIP := c.outboundIP(); ownIP != nil && !sameIP(ownIP, c.configuredOwnIP) {
+			slog.Warn("This machine's IP changed, the failover-ip has to be routed to the new IP", "old_ip", c.configuredOwnIP, "new_ip", ownIP)
+			c.configuredOwnIP = nil
+			c.cachedState = released
+			return false
+		}
+	}
+
+	previousState := c.cachedState
+	if c.cacheExpired() {
 		/**We need to recheck the status!
 		 * Don't check too often because of stupid API rate limits
 		 */
-		log.Println("Cached state was too old.")
+		if c.lastAPICheck.Equal(time.Unix(0, 0)) {
+			slog.Info("No cached state yet, querying Hetzner API")
+		} else {
+			slog.Info("Cached state was too old", "previous_state", stateString(previousState),
+				"age", time.Since(c.lastAPICheck).Round(time.Millisecond), "ttl", time.Duration(c.HetznerCacheTTL)*time.Millisecond)
+		}
 		c.cachedState = unknown
 	} else {
 		/** no need to check, we can use "cached" state if set.
@@ -217,22 +1168,45 @@ func (c *HetznerConfigurer) queryAddress() bool {
 		}
 	}
 
-	str, err := c.curlQueryFailover(false)
-	if err != nil {
-		//TODO
-		c.cachedState = unknown
-	} else {
+	// transient failures, i.e. network errors and 5xx responses, are retried,
+	// error responses of the API are definitive
+	var currentFailoverDestinationIP net.IP
+	err := c.retryQuery("Hetzner API query", func() error {
+		str, err := c.queryFailover(http.MethodGet)
+		if err != nil {
+			return err
+		}
 		c.lastAPICheck = time.Now()
+		currentFailoverDestinationIP, err = c.getActiveIPFromJSON(str)
+		return err
+	})
+	c.recordAPIInteraction(false, currentFailoverDestinationIP, err)
+	if errors.Is(err, errRateLimited) || errors.Is(err, errServerError) {
+		return c.holdState(previousState, err)
 	}
-
-	currentFailoverDestinationIP, err := c.getActiveIPFromJSON(str)
 	if err != nil {
-		//TODO
+		slog.Error("Error while querying Hetzner failover-ip!", "err", err)
+		c.lastError = err
 		c.cachedState = unknown
+		return false
 	}
 
-	if currentFailoverDestinationIP.Equal(getOutboundIP()) {
+	//If no server is the current failover destination, we aren't either.
+	var ownIP net.IP
+	if currentFailoverDestinationIP != nil {
+		ownIP = c.outboundIP()
+	}
+	routedHere := sameIP(currentFailoverDestinationIP, ownIP)
+	if !c.startupChecked {
+		c.startupChecked = true
+		routedHere = c.adoptStartupState(currentFailoverDestinationIP, routedHere)
+	} else {
+		c.forceFailover = false
+	}
+
+	if routedHere {
 		//We "are" the current failover destination.
+		c.configuredOwnIP = ownIP
 		c.cachedState = configured
 		return true
 	}
@@ -241,49 +1215,294 @@ func (c *HetznerConfigurer) queryAddress() bool {
 	return false
 }
 
+// adoptStartupState decides how the route of the failover-ip that the first query
+// found is taken over, returning whether it counts as routed to this machine.
+// A route to this machine, e.g. from a previous run or set by hand, is adopted,
+// so a leader doesn't send a redundant failover request, unless
+// hetzner-adopt-on-startup is disabled. Otherwise, a leader sends the request.
+func (c *HetznerConfigurer) adoptStartupState(activeIP net.IP, routedHere bool) bool {
+	switch {
+	case activeIP == nil:
+		slog.Info("Failover-ip isn't routed to any server at startup, it is routed here once this machine is the leader")
+	case !routedHere:
+		slog.Info("Failover-ip is routed to another server at startup, it is routed here once this machine is the leader", "active_ip", activeIP)
+	case c.HetznerAdoptOnStartup:
+		slog.Info("Failover-ip is already routed to this machine at startup, adopting it without a failover request", "ip", activeIP)
+	default:
+		slog.Info("Failover-ip is already routed to this machine at startup, but hetzner-adopt-on-startup is disabled, it is routed here once more if this machine is the leader", "ip", activeIP)
+		c.forceFailover = true
+		return false
+	}
+	return routedHere
+}
+
 func (c *HetznerConfigurer) configureAddress() bool {
-	//log.Printf("Configuring address %s on %s", m.GetCIDR(), m.iface.Name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return c.runAddressConfiguration("set")
+	force := c.forceFailover
+	c.forceFailover = false
+	if c.SkipConfigureWhenActive && !force && c.lastActiveIP != nil && !c.cacheExpired() {
+		/** e.g. leadership came back before another node took over,
+		 * the API still routes the failover-ip to us, no need to ask again.
+		 */
+		if ownIP := c.outboundIP(); sameIP(c.lastActiveIP, ownIP) {
+			slog.Info("Failover-ip is already routed to this machine, skipping the failover request", "ip", ownIP)
+			c.configuredOwnIP = ownIP
+			c.cachedState = configured
+			c.publishState()
+			return c.bindLocal()
+		}
+	}
+
+	return c.runAddressConfiguration("set") && c.bindLocal()
 }
 
 func (c *HetznerConfigurer) deconfigureAddress() bool {
 	//The address doesn't need deconfiguring since Hetzner API
 	// is used to point the VIP address somewhere else.
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.cachedState = released
+	c.publishState()
+	return c.unbindLocal()
+}
+
+// bindLocal adds the failover-ip to the interface with the netmask reported
+// by the API, or netmask if it is unknown, see hetzner-bind-local.
+func (c *HetznerConfigurer) bindLocal() bool {
+	if c.local == nil {
+		return true
+	}
+	if c.reportedNetmask != nil {
+		c.localConfig.Netmask = c.reportedNetmask
+	}
+	if c.local.queryAddress() {
+		return true
+	}
+	if !c.local.configureAddress() {
+		c.lastError = fmt.Errorf("failover-ip is routed here, but couldn't be bound to the interface: %w", c.local.lastFailure())
+		return false
+	}
 	return true
 }
 
-func (c *HetznerConfigurer) runAddressConfiguration(action string) bool {
-	str, err := c.curlQueryFailover(true)
+// unbindLocal removes the failover-ip from the interface, if it was bound by bindLocal
+func (c *HetznerConfigurer) unbindLocal() bool {
+	if c.local == nil || !c.local.queryAddress() {
+		return true
+	}
+	return c.local.deconfigureAddress()
+}
+
+func (c *HetznerConfigurer) lastFailure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastError
+}
+
+// describeAction returns the request that would be sent, see dryRunConfigurer
+func (c *HetznerConfigurer) describeAction(configure bool) string {
+	if !configure {
+		return "nothing, the new leader routes the failover-ip to itself"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return "POST " + c.apiURL + "/failover/" + c.VIP.String() + " active_server_ip=" + c.outboundIP().String()
+}
+
+// preflight queries the failover-ip without changing its route, see Check
+func (c *HetznerConfigurer) preflight() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	str, err := c.queryFailover(http.MethodGet)
 	if err != nil {
-		log.Printf("Error while configuring Hetzner failover-ip! Error message: %s", err)
-		c.cachedState = unknown
-		return false
+		return "", err
 	}
-	currentFailoverDestinationIP, err := c.getActiveIPFromJSON(str)
+	activeIP, err := c.getActiveIPFromJSON(str)
 	if err != nil {
+		return "", err
+	}
+	detail := "failover-ip has no active server"
+	if activeIP != nil {
+		detail = "failover-ip is routed to " + activeIP.String()
+	}
+	if ownIP := c.outboundIP(); ownIP != nil {
+		detail += ", this machine is " + ownIP.String()
+	}
+	if c.local != nil {
+		local, err := c.local.preflight()
+		if err != nil {
+			return "", err
+		}
+		detail += "; " + local
+	}
+	return detail, nil
+}
+
+// verifyRelease asks the API whether the failover-ip is routed to another server,
+// bypassing the cached state. The cached state is left alone, as the caller
+// only wants to know whether the release took effect.
+func (c *HetznerConfigurer) verifyRelease() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	str, err := c.queryFailover(http.MethodGet)
+	if err != nil {
+		return false, err
+	}
+	activeIP, err := c.getActiveIPFromJSON(str)
+	c.recordAPIInteraction(false, activeIP, err)
+	if err != nil {
+		return false, err
+	}
+	return !sameIP(activeIP, c.outboundIP()), nil
+}
+
+// checkSplitBrain asks the API where the failover-ip is routed, bypassing the
+// cached state, and returns the server it is routed to if that isn't this machine.
+func (c *HetznerConfigurer) checkSplitBrain() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	str, err := c.queryFailover(http.MethodGet)
+	if err != nil {
+		return "", err
+	}
+	activeIP, err := c.getActiveIPFromJSON(str)
+	c.recordAPIInteraction(false, activeIP, err)
+	if err != nil {
+		return "", err
+	}
+	if activeIP == nil || sameIP(activeIP, c.outboundIP()) {
+		return "", nil
+	}
+	return activeIP.String(), nil
+}
+
+// reassert routes the failover-ip to this machine again
+func (c *HetznerConfigurer) reassert() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.runAddressConfiguration("set")
+}
+
+func (c *HetznerConfigurer) runAddressConfiguration(action string) bool {
+	defer c.publishState()
+
+	// like in queryRoute, only transient failures are retried
+	var currentFailoverDestinationIP net.IP
+	err := c.retryConfigure("Hetzner failover request", func() error {
+		str, err := c.queryFailover(http.MethodPost)
+		if err != nil {
+			return err
+		}
+		currentFailoverDestinationIP, err = c.getActiveIPFromJSON(str)
+		return err
+	})
+	c.recordAPIInteraction(true, currentFailoverDestinationIP, err)
+	if err != nil {
+		slog.Error("Error while configuring Hetzner failover-ip!", "err", err)
+		c.lastError = err
 		c.cachedState = unknown
 		return false
 	}
 
 	c.lastAPICheck = time.Now()
 
-	if currentFailoverDestinationIP.Equal(getOutboundIP()) {
+	ownIP := c.outboundIP()
+	if !sameIP(currentFailoverDestinationIP, ownIP) {
+		currentFailoverDestinationIP = c.awaitConvergence(currentFailoverDestinationIP, ownIP)
+	}
+	if sameIP(currentFailoverDestinationIP, ownIP) {
 		//We "are" the current failover destination.
-		log.Printf("Failover was successfully executed!")
+		slog.Info("Failover was successfully executed!")
+		c.configuredOwnIP = ownIP
+		c.lastFailover = time.Now()
 		c.cachedState = configured
 		return true
 	}
 
-	log.Printf("The failover command was issued, but the current Failover destination (%s) is different from what it should be (%s).",
-		currentFailoverDestinationIP.String(),
-		getOutboundIP().String())
+	slog.Error("The failover command was issued, but the current failover destination is different from what it should be",
+		"destination", currentFailoverDestinationIP,
+		"expected", ownIP)
 	//Something must have gone wrong while trying to switch IP's...
+	c.convergenceErrors.Add(1)
+	c.lastError = errors.New("failover destination differs after failover")
 	c.cachedState = unknown
 	return false
 }
 
+// awaitConvergence queries the failover-ip until it is routed to ownIP, for at most
+// configure-timeout, as the API may still report the previous destination for a few
+// seconds after a failover. It returns the last destination reported. c.mu must be
+// held; it is released while sleeping, so queryAddress, the status endpoint and
+// the metrics don't wait for the failover to take effect.
+func (c *HetznerConfigurer) awaitConvergence(destination, ownIP net.IP) net.IP {
+	deadline := time.Now().Add(time.Duration(c.ConfigureTimeout) * time.Millisecond)
+	for time.Now().Add(convergeInterval).Before(deadline) {
+		slog.Info("Failover was issued, but the failover-ip isn't routed to this machine yet, checking again",
+			"destination", destination, "expected", ownIP, "in", convergeInterval)
+		c.mu.Unlock()
+		time.Sleep(convergeInterval)
+		c.mu.Lock()
+
+		str, err := c.queryFailover(http.MethodGet)
+		if err == nil {
+			destination, err = c.getActiveIPFromJSON(str)
+		}
+		c.recordAPIInteraction(false, destination, err)
+		if err != nil {
+			slog.Warn("Couldn't check whether the failover took effect", "err", err)
+			return destination
+		}
+		c.lastAPICheck = time.Now()
+		if sameIP(destination, ownIP) {
+			return destination
+		}
+	}
+	return destination
+}
+
+// releaseOnShutdown removes the route of the failover-ip, but only if it
+// is routed to this machine, so a new leader's route is never removed.
+func (c *HetznerConfigurer) releaseOnShutdown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.publishState()
+
+	str, err := c.queryFailover(http.MethodGet)
+	if err != nil {
+		slog.Error("Error while querying Hetzner failover-ip before shutdown", "err", err)
+		return false
+	}
+	activeIP, err := c.getActiveIPFromJSON(str)
+	c.recordAPIInteraction(false, activeIP, err)
+	if err != nil {
+		slog.Error("Error while querying Hetzner failover-ip before shutdown", "err", err)
+		return false
+	}
+	if activeIP == nil || !sameIP(activeIP, c.outboundIP()) {
+		slog.Info("Failover-ip isn't routed to this machine, leaving it alone")
+		c.cachedState = released
+		return c.unbindLocal()
+	}
+
+	slog.Info("Removing the route of failover-ip to this machine", "vip", c.VIP)
+	str, err = c.queryFailover(http.MethodDelete)
+	if err == nil {
+		activeIP, err = c.getActiveIPFromJSON(str)
+	}
+	c.recordAPIInteraction(true, activeIP, err)
+	if err != nil {
+		slog.Error("Error while removing the route of Hetzner failover-ip", "err", err)
+		return false
+	}
+	c.cachedState = released
+	return c.unbindLocal()
+}
+
 func (c *HetznerConfigurer) cleanupArp() {
 	// dummy function as the usage of interfaces requires us to have this function.
 	// It is sufficient for the leader to tell Hetzner to switch the IP, no cleanup needed.
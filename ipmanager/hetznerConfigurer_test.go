@@ -0,0 +1,787 @@
+package ipmanager
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ownIP is the address the test configurers route the failover-ip to
+var ownIP = net.ParseIP("198.51.100.1").To4()
+
+// newTestHetznerConfigurer returns a configurer for 192.0.2.10 with the default
+// settings that calls the API served by handler and takes ownIP as this machine's IP.
+func newTestHetznerConfigurer(t *testing.T, handler http.Handler) *HetznerConfigurer {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	c, err := newHetznerConfigurer(&IPConfiguration{
+		VIP:                     net.ParseIP("192.0.2.10"),
+		Netmask:                 net.CIDRMask(32, 32),
+		Iface:                   net.Interface{Name: "eth0"},
+		HetznerAPIURL:           srv.URL,
+		HetznerUser:             "robot",
+		HetznerPassword:         "secret",
+		QueryTimeout:            1000,
+		ConfigureTimeout:        1000,
+		HetznerMaxResponseBytes: 64 * 1024,
+		SkipConfigureWhenActive: true,
+		HetznerAdoptOnStartup:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.outboundIPFunc = func(string, string) net.IP { return ownIP }
+	t.Cleanup(c.unpublish)
+	return c
+}
+
+func TestGetActiveIPFromJSONActiveServerIP(t *testing.T) {
+	c, err := newHetznerConfigurer(&IPConfiguration{
+		VIP:             net.ParseIP("192.0.2.10"),
+		Netmask:         net.CIDRMask(32, 32),
+		HetznerUser:     "robot",
+		HetznerPassword: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		activeServerIP string
+		want           net.IP
+		// a malformed address must be reported, not taken as released
+		wantErr bool
+	}{
+		{`"198.51.100.1"`, net.IPv4(198, 51, 100, 1), false},
+		{`""`, nil, false},
+		{`null`, nil, false},
+		{`"not-an-ip"`, nil, true},
+		{`"198.51.100.256"`, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := c.getActiveIPFromJSON(`{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":321,"active_server_ip":` + tt.activeServerIP + `}}`)
+		if tt.wantErr {
+			if !errors.Is(err, errUnexpectedResponse) || !strings.Contains(err.Error(), strings.Trim(tt.activeServerIP, `"`)) {
+				t.Errorf("active_server_ip %s: got error %v, want the malformed address reported", tt.activeServerIP, err)
+			}
+			continue
+		}
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("active_server_ip %s: got %v, %v, want %v", tt.activeServerIP, got, err, tt.want)
+		}
+	}
+}
+
+func TestConcurrentQueriesCallAPIOnce(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		// keep the request in flight while the others arrive
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":321,"active_server_ip":null}}`))
+	}))
+	c.HetznerCacheTTL = 60000
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if c.queryAddress() {
+				t.Error("failover-ip reported as routed here")
+			}
+		}()
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("got %d API calls for simultaneous queries, want 1", n)
+	}
+}
+
+func TestSameIP(t *testing.T) {
+	tests := []struct {
+		a, b net.IP
+		want bool
+	}{
+		{net.ParseIP("198.51.100.1"), net.ParseIP("198.51.100.1").To4(), true},
+		{net.ParseIP("::ffff:198.51.100.1"), net.IPv4(198, 51, 100, 1).To4(), true},
+		{net.ParseIP("::ffff:198.51.100.1"), net.ParseIP("198.51.100.1"), true},
+		{net.ParseIP("198.51.100.1").To4(), net.ParseIP("198.51.100.2").To4(), false},
+		{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::1"), true},
+		{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), false},
+		{net.ParseIP("::c633:6401"), net.ParseIP("198.51.100.1"), false},
+		{nil, net.ParseIP("198.51.100.1"), false},
+		{nil, nil, false},
+	}
+	for _, tt := range tests {
+		if got := sameIP(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameIP(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := sameIP(tt.b, tt.a); got != tt.want {
+			t.Errorf("sameIP(%v, %v) = %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestGetActiveIPFromJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     net.IP
+		// checked with errors.Is, nil if no error is expected
+		err          error
+		serverNumber int64
+	}{
+		{
+			name:         "routed",
+			response:     `{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":321,"active_server_ip":"198.51.100.1"}}`,
+			want:         ownIP,
+			serverNumber: 321,
+		},
+		{
+			name:         "server_number as string",
+			response:     `{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":"321","active_server_ip":"198.51.100.1"}}`,
+			want:         ownIP,
+			serverNumber: 321,
+		},
+		{
+			name:         "server_number as float",
+			response:     `{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":321.0,"active_server_ip":"198.51.100.1"}}`,
+			want:         ownIP,
+			serverNumber: 321,
+		},
+		{
+			name:     "server_number missing",
+			response: `{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","active_server_ip":"198.51.100.1"}}`,
+			want:     ownIP,
+		},
+		{
+			name:     "server_number not a number",
+			response: `{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":"abc","active_server_ip":"198.51.100.1"}}`,
+			err:      errUnexpectedResponse,
+		},
+		{
+			name:         "no active server",
+			response:     `{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":321,"active_server_ip":""}}`,
+			serverNumber: 321,
+		},
+		{
+			name:         "active server null",
+			response:     `{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":321,"active_server_ip":null}}`,
+			serverNumber: 321,
+		},
+		{
+			name:     "malformed JSON",
+			response: `{"failover":{"ip":"192.0.2.10",`,
+			err:      errUnexpectedResponse,
+		},
+		{
+			name:     "not JSON",
+			response: `<html>Bad Gateway</html>`,
+			err:      errUnexpectedResponse,
+		},
+		{
+			name:     "active_server_ip missing",
+			response: `{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":321}}`,
+			err:      errUnexpectedResponse,
+		},
+		{
+			name:     "active_server_ip renamed",
+			response: `{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":321,"active_ip":"198.51.100.1"}}`,
+			err:      errUnexpectedResponse,
+		},
+		{
+			name:     "active_server_ip not a string",
+			response: `{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":321,"active_server_ip":3325256705}}`,
+			err:      errUnexpectedResponse,
+		},
+		{
+			name:     "failover not an object",
+			response: `{"failover":["192.0.2.10"]}`,
+			err:      errUnexpectedResponse,
+		},
+		{
+			name:     "error object",
+			response: `{"error":{"status":400,"code":"INVALID_INPUT","message":"invalid input"}}`,
+			err:      errPermanent,
+		},
+		{
+			name:     "unauthorized",
+			response: `{"error":{"status":401,"code":"UNAUTHORIZED","message":"Unauthorized"}}`,
+			err:      errPermanent,
+		},
+		{
+			name:     "locked",
+			response: `{"error":{"status":409,"code":"FAILOVER_LOCKED","message":"failover is locked"}}`,
+			err:      errServerLocked,
+		},
+		{
+			name:     "not found",
+			response: `{"error":{"status":404,"code":"FAILOVER_IP_NOT_FOUND","message":"failover-ip not found"}}`,
+			err:      errPermanent,
+		},
+		{
+			name:     "ip not found",
+			response: `{"error":{"status":404,"code":"IP_NOT_FOUND","message":"IP not found"}}`,
+			err:      errIPNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestHetznerConfigurer(t, http.NotFoundHandler())
+			got, err := c.getActiveIPFromJSON(tt.response)
+			if tt.err == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if tt.err == nil && c.failover.ServerNumber != tt.serverNumber {
+				t.Errorf("got server_number %d, want %d", c.failover.ServerNumber, tt.serverNumber)
+			}
+		})
+	}
+}
+
+func TestQueryAddressMalformedResponse(t *testing.T) {
+	c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"failover":`))
+	}))
+	if c.queryAddress() {
+		t.Error("failover-ip reported as routed here after a malformed response")
+	}
+	if c.cachedState != unknown {
+		t.Errorf("got state %s, want unknown", stateString(c.cachedState))
+	}
+}
+
+func TestQueryAddressNoActiveServer(t *testing.T) {
+	c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":321,"active_server_ip":""}}`))
+	}))
+	if c.queryAddress() {
+		t.Error("failover-ip without active server reported as routed here")
+	}
+	if c.cachedState != released {
+		t.Errorf("got state %s, want released", stateString(c.cachedState))
+	}
+}
+
+func TestQueryFailoverRequest(t *testing.T) {
+	c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "robot" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"status":401,"code":"UNAUTHORIZED","message":"Unauthorized"}}`))
+			return
+		}
+		if r.URL.Path != "/failover/192.0.2.10" {
+			http.NotFound(w, r)
+			return
+		}
+		active := "203.0.113.7"
+		if r.Method == http.MethodPost {
+			r.ParseForm()
+			active = r.PostForm.Get("active_server_ip")
+		}
+		w.Write([]byte(`{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"203.0.113.7","server_number":321,"active_server_ip":"` + active + `"}}`))
+	}))
+
+	for method, want := range map[string]net.IP{
+		http.MethodGet:  net.ParseIP("203.0.113.7"),
+		http.MethodPost: ownIP,
+	} {
+		str, err := c.queryFailover(method)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		got, err := c.getActiveIPFromJSON(str)
+		if err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if !sameIP(got, want) {
+			t.Errorf("%s: got %v, want %v", method, got, want)
+		}
+	}
+}
+
+func TestQueryFailoverUnexpectedResponse(t *testing.T) {
+	for _, body := range []string{"", "{}", `{"failover_ip":{"ip":"192.0.2.10"}}`} {
+		t.Run(body, func(t *testing.T) {
+			c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+			}))
+			parseErrors := c.parseErrors.Value()
+
+			str, err := c.queryFailover(http.MethodGet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.getActiveIPFromJSON(str)
+			if !errors.Is(err, errUnexpectedResponse) {
+				t.Fatalf("got error %v, want %v", err, errUnexpectedResponse)
+			}
+			if body != "" && !strings.Contains(err.Error(), strconv.Quote(body)) {
+				t.Errorf("the response is missing in %q", err)
+			}
+			if retryable(err) {
+				t.Error("unexpected responses must not be retried right away")
+			}
+			if n := c.parseErrors.Value() - parseErrors; n != 1 {
+				t.Errorf("counted %d parse errors, want 1", n)
+			}
+		})
+	}
+}
+
+func TestQueryFailoverOversizedResponse(t *testing.T) {
+	c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"failover":{"ip":"192.0.2.10","netmask":"` + strings.Repeat("x", 1<<20) + `"}}`))
+	}))
+	if _, err := c.queryFailover(http.MethodGet); !errors.Is(err, errResponseTooLarge) {
+		t.Fatalf("got error %v, want %v", err, errResponseTooLarge)
+	}
+	if c.queryAddress() {
+		t.Error("failover-ip reported as routed here after an oversized response")
+	}
+}
+
+func TestQueryFailoverResponseSizeLimit(t *testing.T) {
+	const limit = 1024
+	var size int
+	c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat(" ", size)))
+	}))
+	c.HetznerMaxResponseBytes = limit
+
+	size = limit
+	if _, err := c.queryFailover(http.MethodGet); err != nil {
+		t.Errorf("response of %d bytes: %v", size, err)
+	}
+
+	size = limit + 1
+	parseErrors := c.parseErrors.Value()
+	if _, err := c.queryFailover(http.MethodGet); !errors.Is(err, errResponseTooLarge) {
+		t.Errorf("response of %d bytes: got error %v, want %v", size, err, errResponseTooLarge)
+	}
+	if n := c.parseErrors.Value() - parseErrors; n != 1 {
+		t.Errorf("counted %d parse errors, want 1", n)
+	}
+}
+
+func TestQueryFailoverServerError(t *testing.T) {
+	c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("<html>Service Unavailable</html>"))
+	}))
+	apiErrors := c.apiErrors.Value()
+	if _, err := c.queryFailover(http.MethodGet); !errors.Is(err, errServerError) {
+		t.Fatalf("got error %v, want %v", err, errServerError)
+	}
+	if n := c.apiErrors.Value() - apiErrors; n != 1 {
+		t.Errorf("counted %d API errors, want 1", n)
+	}
+}
+
+func TestQueryAddressHoldsStateOnServerError(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		active string
+		want   int
+	}{
+		{"configured", ownIP.String(), configured},
+		{"released", "203.0.113.7", released},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			status := http.StatusOK
+			c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if status != http.StatusOK {
+					w.WriteHeader(status)
+					w.Write([]byte(`{"error":{"status":` + strconv.Itoa(status) + `,"code":"ERROR","message":"error"}}`))
+					return
+				}
+				w.Write([]byte(`{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"203.0.113.7","server_number":321,"active_server_ip":"` + tt.active + `"}}`))
+			}))
+			c.queryAddress()
+			if c.cachedState != tt.want {
+				t.Fatalf("got state %s, want %s", stateString(c.cachedState), stateString(tt.want))
+			}
+
+			status = http.StatusServiceUnavailable
+			if got := c.queryAddress(); got != (tt.want == configured) {
+				t.Errorf("got routed %v after a server error, want %v", got, tt.want == configured)
+			}
+			if c.cachedState != tt.want {
+				t.Errorf("got state %s after a server error, want %s", stateString(c.cachedState), stateString(tt.want))
+			}
+
+			// an error response of the API is definitive, the state isn't known anymore
+			status = http.StatusForbidden
+			if c.queryAddress() {
+				t.Error("failover-ip reported as routed here after an error response")
+			}
+			if c.cachedState != unknown {
+				t.Errorf("got state %s after an error response, want unknown", stateString(c.cachedState))
+			}
+		})
+	}
+}
+
+func TestAPIHistoryAfterTransportError(t *testing.T) {
+	var calls atomic.Int32
+	c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) > 1 {
+			// drop the connection without a response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.Write([]byte(`{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"198.51.100.1","server_number":321,"active_server_ip":"198.51.100.1"}}`))
+	}))
+	c.HetznerAPIHistorySize = 10
+
+	if !c.reassert() {
+		t.Fatal("first failover failed")
+	}
+	if c.reassert() {
+		t.Fatal("failover without a response succeeded")
+	}
+	history := c.apiHistory()
+	if len(history) != 2 {
+		t.Fatalf("got %d API interactions, want 2", len(history))
+	}
+	if history[0].HTTPStatus != http.StatusOK {
+		t.Errorf("got HTTP status %d for the first call, want %d", history[0].HTTPStatus, http.StatusOK)
+	}
+	if failed := history[1]; failed.HTTPStatus != 0 || failed.RequestID == history[0].RequestID {
+		t.Errorf("failed call recorded with HTTP status %d and request ID %q, want no status and its own ID", failed.HTTPStatus, failed.RequestID)
+	}
+}
+
+func TestQueryAddressAPIUnreachable(t *testing.T) {
+	c := newTestHetznerConfigurer(t, http.NotFoundHandler())
+	// the API goes away while running, e.g. the network is down
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	c.apiURL = srv.URL
+
+	networkErrors := c.networkErrors.Value()
+	if c.queryAddress() {
+		t.Error("failover-ip reported as routed here")
+	}
+	if n := c.networkErrors.Value() - networkErrors; n != 1 {
+		t.Errorf("counted %d network errors, want 1", n)
+	}
+	if c.apiReachable.Value() != 0 {
+		t.Error("API reported as reachable")
+	}
+	// nothing is known about the failover-ip, it mustn't be taken as released
+	if c.cachedState != unknown {
+		t.Errorf("got state %s, want unknown", stateString(c.cachedState))
+	}
+}
+
+// fakeFailoverAPI serves the failover endpoint for 192.0.2.10, routing it to
+// the server a POST asked for, and counts the requests by method.
+type fakeFailoverAPI struct {
+	mu     sync.Mutex
+	active string
+	calls  map[string]int
+}
+
+func (a *fakeFailoverAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.calls == nil {
+		a.calls = map[string]int{}
+	}
+	a.calls[r.Method]++
+	switch r.Method {
+	case http.MethodPost:
+		r.ParseForm()
+		a.active = r.PostForm.Get("active_server_ip")
+	case http.MethodDelete:
+		a.active = ""
+	}
+	w.Write([]byte(`{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"203.0.113.7","server_number":321,"active_server_ip":"` + a.active + `"}}`))
+}
+
+func (a *fakeFailoverAPI) count(method string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.calls[method]
+}
+
+func TestConcurrentQueryAndConfigure(t *testing.T) {
+	api := &fakeFailoverAPI{active: "203.0.113.7"}
+	c := newTestHetznerConfigurer(t, api)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			c.queryAddress()
+		}()
+		go func() {
+			defer wg.Done()
+			c.configureAddress()
+		}()
+		go func() {
+			defer wg.Done()
+			c.status()
+			c.labels()
+			c.failoverDetails()
+		}()
+	}
+	wg.Wait()
+
+	if !c.configureAddress() || !c.queryAddress() {
+		t.Error("failover-ip not routed here after configuring it")
+	}
+}
+
+func TestConfigureAddressSkipsPostWhenActive(t *testing.T) {
+	for _, skip := range []bool{true, false} {
+		t.Run(strconv.FormatBool(skip), func(t *testing.T) {
+			api := &fakeFailoverAPI{active: ownIP.String()}
+			c := newTestHetznerConfigurer(t, api)
+			c.HetznerCacheTTL = 60000
+			c.SkipConfigureWhenActive = skip
+
+			if !c.queryAddress() {
+				t.Fatal("failover-ip not reported as routed here")
+			}
+			if !c.configureAddress() {
+				t.Fatal("configuring failed")
+			}
+			want := 1
+			if skip {
+				want = 0
+			}
+			if n := api.count(http.MethodPost); n != want {
+				t.Errorf("got %d failover requests, want %d", n, want)
+			}
+			if c.cachedState != configured {
+				t.Errorf("got state %s, want configured", stateString(c.cachedState))
+			}
+		})
+	}
+}
+
+func TestQueryAddressLastAPICheckInFuture(t *testing.T) {
+	api := &fakeFailoverAPI{active: "203.0.113.7"}
+	c := newTestHetznerConfigurer(t, api)
+	c.HetznerCacheTTL = 60000
+
+	// restored from before the wall clock was set back
+	c.cachedState = configured
+	c.lastAPICheck = time.Now().Add(time.Hour)
+	if !c.cacheExpired() {
+		t.Error("cache with a check in the future not expired")
+	}
+
+	if c.queryAddress() {
+		t.Error("stale cached state used instead of querying the API")
+	}
+	if n := api.count(http.MethodGet); n != 1 {
+		t.Errorf("got %d queries, want 1", n)
+	}
+	if c.lastAPICheck.After(time.Now()) {
+		t.Errorf("last API check %s still in the future", c.lastAPICheck)
+	}
+}
+
+func TestStartupAdoption(t *testing.T) {
+	tests := []struct {
+		name   string
+		active string
+		adopt  bool
+		leader bool
+		// whether the first query reports the failover-ip as routed here
+		routed bool
+		posts  int
+	}{
+		{"unrouted leader", "", true, true, false, 1},
+		{"unrouted follower", "", true, false, false, 0},
+		{"routed elsewhere leader", "203.0.113.7", true, true, false, 1},
+		{"routed elsewhere follower", "203.0.113.7", true, false, false, 0},
+		{"routed here leader", ownIP.String(), true, true, true, 0},
+		{"routed here follower", ownIP.String(), true, false, true, 0},
+		{"routed here leader without adoption", ownIP.String(), false, true, false, 1},
+		{"routed here follower without adoption", ownIP.String(), false, false, false, 0},
+		{"routed elsewhere leader without adoption", "203.0.113.7", false, true, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeFailoverAPI{active: tt.active}
+			c := newTestHetznerConfigurer(t, api)
+			c.HetznerCacheTTL = 60000
+			c.HetznerAdoptOnStartup = tt.adopt
+
+			// what the first check of IPManager does
+			routed := c.queryAddress()
+			if routed != tt.routed {
+				t.Errorf("got routed %v at startup, want %v", routed, tt.routed)
+			}
+			if tt.leader && !routed && !c.configureAddress() {
+				t.Error("configuring failed")
+			}
+			if n := api.count(http.MethodPost); n != tt.posts {
+				t.Errorf("got %d failover requests, want %d", n, tt.posts)
+			}
+			if tt.leader && !c.queryAddress() {
+				t.Error("failover-ip not routed to the leader")
+			}
+		})
+	}
+}
+
+func TestRunAddressConfigurationAwaitsConvergence(t *testing.T) {
+	tests := []struct {
+		name string
+		// the responses, starting with the one to the failover request, that still report the previous server
+		stale int
+		want  bool
+	}{
+		{"converged after a while", 1, true},
+		{"not converged", 10, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			var mu sync.Mutex
+			stale := 0
+			c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				active := ownIP.String()
+				if r.Method == http.MethodPost {
+					// accepted, but the API reports the previous server for a while
+					stale = tt.stale
+				}
+				if stale > 0 {
+					active = "203.0.113.7"
+					stale--
+				}
+				w.Write([]byte(`{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"203.0.113.7","server_number":321,"active_server_ip":"` + active + `"}}`))
+			}))
+			// time for two checks
+			c.ConfigureTimeout = int((2*convergeInterval + time.Second) / time.Millisecond)
+			convergenceErrors := c.convergenceErrors.Value()
+
+			if got := c.reassert(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			want := unknown
+			if tt.want {
+				want = configured
+			}
+			if c.cachedState != want {
+				t.Errorf("got state %s, want %s", stateString(c.cachedState), stateString(want))
+			}
+			if !tt.want && c.convergenceErrors.Value() == convergenceErrors {
+				t.Error("convergence error not counted")
+			}
+		})
+	}
+}
+
+func TestQueryAddressWhileAwaitingConvergence(t *testing.T) {
+	t.Parallel()
+	posted := make(chan struct{})
+	var once sync.Once
+	c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			once.Do(func() { close(posted) })
+		}
+		// the failover never takes effect
+		w.Write([]byte(`{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"203.0.113.7","server_number":321,"active_server_ip":"203.0.113.7"}}`))
+	}))
+	c.ConfigureTimeout = int((2*convergeInterval + time.Second) / time.Millisecond)
+
+	reasserted := make(chan bool)
+	go func() { reasserted <- c.reassert() }()
+	<-posted
+
+	queried := make(chan bool)
+	go func() { queried <- c.queryAddress() }()
+	select {
+	case <-queried:
+	case <-time.After(convergeInterval):
+		t.Fatal("queryAddress waited for the failover to take effect")
+	}
+	if <-reasserted {
+		t.Error("failover reported as successful")
+	}
+}
+
+func TestIPv4MappedFailoverDestination(t *testing.T) {
+	tests := []struct {
+		name   string
+		active string
+		local  net.IP
+	}{
+		{"mapped destination", "::ffff:198.51.100.1", ownIP},
+		{"mapped outbound IP", "198.51.100.1", net.IPv4(198, 51, 100, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestHetznerConfigurer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"failover":{"ip":"192.0.2.10","netmask":"255.255.255.255","server_ip":"203.0.113.7","server_number":321,"active_server_ip":"` + tt.active + `"}}`))
+			}))
+			c.outboundIPFunc = func(string, string) net.IP { return tt.local }
+
+			if !c.queryAddress() {
+				t.Error("query: failover-ip not reported as routed here")
+			}
+			if !c.runAddressConfiguration("set") {
+				t.Error("failover: failover-ip not reported as routed here")
+			}
+		})
+	}
+}
+
+func TestFailoverToAddressOfDownInterface(t *testing.T) {
+	tests := []struct {
+		name    string
+		require bool
+		flags   net.Flags
+		posts   int
+	}{
+		{"interface up", true, net.FlagUp, 1},
+		{"interface down", true, 0, 0},
+		{"interface down, not required", false, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeFailoverAPI{active: "203.0.113.7"}
+			c := newTestHetznerConfigurer(t, api)
+			c.RequireUpInterfaceForSource = tt.require
+			c.interfaceOfFunc = func(net.IP) *net.Interface {
+				return &net.Interface{Name: "eth1", Flags: tt.flags}
+			}
+
+			if got := c.configureAddress(); got != (tt.posts > 0) {
+				t.Errorf("got %v, want %v", got, tt.posts > 0)
+			}
+			if n := api.count(http.MethodPost); n != tt.posts {
+				t.Errorf("got %d failover requests, want %d", n, tt.posts)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package ipmanager
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Histogram counts observations in fixed buckets, like a Prometheus histogram.
+// It is published through expvar and rendered on /metrics by the main package.
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// Observe adds a value to the buckets it falls into
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// Snapshot returns the upper bounds of the buckets, their cumulative counts,
+// and the sum and count of all observations
+func (h *Histogram) Snapshot() (bounds []float64, counts []uint64, sum float64, count uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]float64(nil), h.bounds...), append([]uint64(nil), h.counts...), h.sum, h.count
+}
+
+// String implements expvar.Var
+func (h *Histogram) String() string {
+	bounds, counts, sum, count := h.Snapshot()
+	buckets := make(map[string]uint64, len(bounds))
+	for i, bound := range bounds {
+		b, _ := json.Marshal(bound)
+		buckets[string(b)] = counts[i]
+	}
+	out, _ := json.Marshal(struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Sum     float64           `json:"sum"`
+		Count   uint64            `json:"count"`
+	}{buckets, sum, count})
+	return string(out)
+}
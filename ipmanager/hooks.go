@@ -0,0 +1,56 @@
+package ipmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// runHook executes a user-supplied command and waits for it to finish.
+// The command is split on whitespace, no shell is involved.
+// The VIP and interface are passed to the command as environment variables,
+// along with env. If the command doesn't exit within timeout (in milliseconds), it is killed.
+func runHook(name string, command string, timeout int, config *IPConfiguration, env ...string) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+		defer cancel()
+	}
+
+	if config.DryRun {
+		slog.Info("Dry run: not running hook", "hook", name, "command", command)
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"VIP_IP="+config.VIP.String(),
+		"VIP_CIDR="+config.getCIDR(),
+		"VIP_INTERFACE="+config.Iface.Name,
+	)
+	cmd.Env = append(cmd.Env, env...)
+
+	slog.Info("Running hook", "hook", name, "command", command)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		slog.Info("Hook output", "hook", name, "output", string(output))
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out after %d ms", name, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s failed: %w", name, err)
+	}
+	return nil
+}
@@ -1,17 +1,291 @@
 package ipmanager
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"time"
 )
 
 // IPConfiguration holds the configuration for VIP manager
 type IPConfiguration struct {
-	VIP        net.IP
-	Netmask    net.IPMask
-	Iface      net.Interface
+	VIP     net.IP
+	Netmask net.IPMask
+	Iface   net.Interface
+	// further virtual IPs managed together with VIP, see multiConfigurer
+	AdditionalVIPs []net.IPNet
+	// the DCS key holding further VIPs, see IPManager.WatchVIPList
+	VIPListKey string
+
+	VIPName       string
+	AliasTemplate string
+	SkipDAD       bool
+	NoPrefixRoute bool
+	RoutingTable  int
+	RouteMetric   int
+
+	HostAddressCheck string
+	OnInterfaceGone  string
+
 	RetryNum   int
 	RetryAfter int
+
+	QueryRetries          int
+	QueryRetryAfter       int
+	ConfigureRetries      int
+	ConfigureRetryAfter   int
+	DeconfigureRetries    int
+	DeconfigureRetryAfter int
+
+	OutboundIPRetries           int
+	StrictSourceCheck           bool
+	RequireUpInterfaceForSource bool
+	PreferInterfaceAddress      bool
+	HetznerOutboundProbe        string
+	HetznerActiveServerIP       net.IP
+	HetznerServerNumber         int
+
+	QueryTimeout     int
+	ConfigureTimeout int
+	// milliseconds between checks while the leader doesn't change
+	RecheckInterval int
+	// the operations on the VIPs per check, see multiConfigurer.startTick
+	MaxOpsPerTick int
+
+	ArpTargets      []net.IP
+	ArpAnnounceFrom string
+	// the interface the gratuitous ARP messages are sent on, if not Iface
+	ArpInterface string
+	// the sender hardware address of ARP announcements, nil for the one of Iface
+	ArpSourceMAC net.HardwareAddr
+	// milliseconds, 0 disables repeated announcements
+	ArpRefreshInterval int
+	ArpRepeatCount     int
+	ArpRepeatInterval  int
+	// milliseconds, 0 disables the limit
+	MinArpBurstInterval int
+
+	// false leaves announcing the VIP to the kernel, see gratuitous-arp
+	GratuitousArp       bool
+	VerifyArpCapability bool
+	VerifyArpSent       bool
+
+	ReleaseGraceWindow       int
+	VerifyReleaseAfter       int
+	FailFastOnConfigureError bool
+	NoReleaseOnShutdown      bool
+	DryRun                   bool
+	DriftCorrectionBackoff   int
+	// milliseconds, 0 disables the check
+	SplitBrainCheckInterval int
+	// milliseconds, 0 disables the alert
+	MaxUnconfiguredLeaderTime int
+
+	LogSampleEvery int
+	OTLPEndpoint   string
+	DeadLetterFile string
+	StateFile      string
+
+	// one of the tls.VersionTLS* constants
+	TLSMinVersion uint16
+
+	Region string
+	// cap of concurrent requests to the metadata service, shared by all configurers
+	MetadataConcurrency int
+
+	HetznerIPVersion            string
+	HetznerPostConfigureBackoff int
+	HetznerCacheTTL             int
+	SkipConfigureWhenActive     bool
+	HetznerAdoptOnStartup       bool
+	HetznerBindLocal            bool
+	HetznerOnIPNotFound         string
+
+	HetznerUser         string
+	HetznerPassword     string
+	HetznerUserFile     string
+	HetznerPasswordFile string
+
+	HetznerCloudToken        string
+	HetznerCloudFloatingIPID int64
+
+	GCPNetworkInterface string
+
+	CloudflareAPIToken   string
+	CloudflareZoneID     string
+	CloudflareRecordName string
+	CloudflareRecordTTL  int
+
+	EquinixAPIToken  string
+	EquinixProjectID string
+
+	AzureIPConfigurationName string
+	AzureClientID            string
+
+	OpenStackAuthURL                     string
+	OpenStackApplicationCredentialID     string
+	OpenStackApplicationCredentialSecret string
+	OpenStackInterface                   string
+
+	HetznerDNSCacheTTL      int
+	HetznerAPIHistorySize   int
+	HetznerMaxResponseBytes int
+	// empty for the default endpoint of Region
+	HetznerAPIURL string
+
+	PreConfigureHook string
+	OnGainHook       string
+	OnLossHook       string
+	HookTimeout      int
+
+	FenceCommand string
+	FenceTimeout int
+
+	// StartCommand and StopCommand manage a service that only runs on the machine holding the VIP
+	StartCommand string
+	StopCommand  string
+
+	NotifyURL string
+	// identifies this machine in notifications, the trigger-value
+	Nodename string
+	// sent with the calls to the Hetzner API, e.g. "vip-manager/1.0.1 (node1)"
+	UserAgent string
+
+	ConnectivityCanary        string
+	ConnectivityCanaryMethod  string
+	ConnectivityCanaryTimeout int
+
+	HealthCheckCommand    string
+	HealthCheckURL        string
+	HealthCheckMinHealthy int
+}
+
+// defaultTimeout is used for manager types without a default of their own
+const defaultTimeout = 10000
+
+// backendTimeouts are the default query and configure timeouts in milliseconds
+// per manager type. Local commands are expected to finish quickly,
+// while remote APIs may take a while.
+var backendTimeouts = map[string]int{
+	"basic":          2000,
+	"arp_only":       2000,
+	"hetzner":        10000,
+	"hetzner_cloud":  10000,
+	"dns_cloudflare": 10000,
+	// floating IP associations are synchronous
+	"openstack": 10000,
+	// waits for the asynchronous operations to finish
+	"gcp": 60000,
+	// waits for the assignment to show up
+	"equinix": 60000,
+	"azure":   60000,
+}
+
+// resolveTimeouts fills in the timeouts that weren't configured,
+// using the default of the manager type or the global default.
+func (c *IPConfiguration) resolveTimeouts(hostingType string) {
+	timeout, ok := backendTimeouts[hostingType]
+	if !ok {
+		timeout = defaultTimeout
+	}
+	if c.QueryTimeout <= 0 {
+		c.QueryTimeout = timeout
+	}
+	if c.ConfigureTimeout <= 0 {
+		c.ConfigureTimeout = timeout
+	}
+}
+
+// reload copies the settings that can be changed while running from update,
+// see IPManager.Reload. All others keep their values.
+func (c *IPConfiguration) reload(update *IPConfiguration) {
+	c.RetryNum = update.RetryNum
+	c.RetryAfter = update.RetryAfter
+	c.QueryRetries = update.QueryRetries
+	c.QueryRetryAfter = update.QueryRetryAfter
+	c.ConfigureRetries = update.ConfigureRetries
+	c.ConfigureRetryAfter = update.ConfigureRetryAfter
+	c.DeconfigureRetries = update.DeconfigureRetries
+	c.DeconfigureRetryAfter = update.DeconfigureRetryAfter
+
+	c.VerifyReleaseAfter = update.VerifyReleaseAfter
+	c.DriftCorrectionBackoff = update.DriftCorrectionBackoff
+	c.MaxUnconfiguredLeaderTime = update.MaxUnconfiguredLeaderTime
+
+	c.HetznerCacheTTL = update.HetznerCacheTTL
+	c.HetznerPostConfigureBackoff = update.HetznerPostConfigureBackoff
+
+	c.PreConfigureHook = update.PreConfigureHook
+	c.OnGainHook = update.OnGainHook
+	c.OnLossHook = update.OnLossHook
+	c.HookTimeout = update.HookTimeout
+	c.FenceCommand = update.FenceCommand
+	c.FenceTimeout = update.FenceTimeout
+	c.StartCommand = update.StartCommand
+	c.StopCommand = update.StopCommand
+	c.NotifyURL = update.NotifyURL
+}
+
+// retryQuery calls query until it succeeds or was retried query-retries times,
+// doubling the delay after every attempt. Queries don't change anything, so they can be retried freely.
+func (c *IPConfiguration) retryQuery(what string, query func() error) error {
+	return retry(what, c.QueryRetries, c.QueryRetryAfter, query)
+}
+
+// retryConfigure calls configure until it succeeds or was retried configure-retries times,
+// doubling the delay after every attempt. Configuring must be idempotent, and the delay should respect API rate limits.
+func (c *IPConfiguration) retryConfigure(what string, configure func() error) error {
+	return retry(what, c.ConfigureRetries, c.ConfigureRetryAfter, configure)
+}
+
+// maxRetryAfter caps the doubling delay between retries
+const maxRetryAfter = 30 * time.Second
+
+// retryDeconfigure calls deconfigure until it succeeds or was retried deconfigure-retries times,
+// doubling the delay after every attempt. Failing to release the VIP risks a split-brain,
+// so every attempt and the outcome are logged.
+func (c *IPConfiguration) retryDeconfigure(what string, deconfigure func() error) error {
+	attempts := 0
+	err := retry(what, c.DeconfigureRetries, c.DeconfigureRetryAfter, func() error {
+		attempts++
+		return deconfigure()
+	})
+	if err == nil && attempts > 1 {
+		slog.Info(what+" succeeded after retrying", "retries", attempts-1)
+	}
+	return err
+}
+
+// errRateLimited is returned (wrapped) by operations that must not be repeated
+// before a backoff passed. Such errors are never retried right away.
+var errRateLimited = errors.New("rate limit exceeded")
+
+// errPermanent is returned (wrapped) by operations that can never succeed
+// with the current configuration, so retrying them is pointless.
+var errPermanent = errors.New("permanent failure")
+
+// retryable returns whether err is a failure that may be retried right away.
+// An unexpected response from the Hetzner API would most likely be the same
+// again, it is only retried on the next check.
+func retryable(err error) bool {
+	return err != nil && !errors.Is(err, errRateLimited) && !errors.Is(err, errPermanent) && !errors.Is(err, errUnexpectedResponse)
+}
+
+// retry calls f until it succeeds, fails with an error that isn't retryable,
+// or was retried retries times. Only transient failures are retried.
+func retry(what string, retries int, retryAfter int, f func() error) error {
+	delay := time.Duration(retryAfter) * time.Millisecond
+	err := f()
+	for i := 0; i < retries && retryable(err); i++ {
+		slog.Warn(what+" failed, retrying", "delay", delay, "retry", i+1, "retries", retries, "err", err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryAfter {
+			delay = maxRetryAfter
+		}
+		err = f()
+	}
+	return err
 }
 
 // getCIDR returns the CIDR composed from the given address and mask
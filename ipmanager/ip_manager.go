@@ -2,84 +2,374 @@ package ipmanager
 
 import (
 	"context"
-	"log"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net"
+	"os"
 	"sync"
 	"time"
+
+	"github.com/cybertec-postgresql/vip-manager/vipconfig"
+)
+
+var (
+	// isLeader is 1 while this machine is the leader according to the DCS
+	isLeader = expvar.NewInt("vipmanager_is_leader")
+	// configureErrors counts the failed attempts to configure the virtual IP
+	configureErrors = expvar.NewInt("vipmanager_configure_errors_total")
+	// deconfigureErrors counts how often releasing the virtual IP failed
+	deconfigureErrors = expvar.NewInt("vipmanager_deconfigure_errors_total")
+	// fenceErrors counts how often fence-command failed
+	fenceErrors = expvar.NewInt("vipmanager_fence_errors_total")
+	// vipConfigured is 1 while a virtual IP is registered to this machine, by VIP
+	vipConfigured = newVIPGauge()
+	// driftCorrections counts how often the virtual IP had to be re-configured
+	// after it went away while this machine was still the leader
+	driftCorrections = expvar.NewInt("vipmanager_drift_corrections_total")
+	// releaseConfirmed is 1 if the last release was confirmed, 0 if it wasn't,
+	// and -1 if it couldn't be determined or wasn't checked yet
+	releaseConfirmed = expvar.NewInt("vipmanager_release_confirmed")
+	// splitBrainDetected counts how often split-brain-check-interval found
+	// another machine holding the virtual IP
+	splitBrainDetected = expvar.NewInt("vipmanager_split_brain_detected_total")
+	// failoverDuration measures the time from becoming the leader
+	// until the virtual IP was configured, in seconds
+	failoverDuration = newHistogram(0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120)
+	// healthCheckPassing is 1 while health-check-command or health-check-url passes,
+	// 0 while it fails and -1 if there is none
+	healthCheckPassing = expvar.NewInt("vipmanager_health_check_passing")
+	// arpSent counts the gratuitous ARP announcements sent by arp-refresh-interval
+	arpSent = expvar.NewInt("vipmanager_arp_sent_total")
+	// leaderUnconfigured is 1 while this machine has been the leader for longer
+	// than max-unconfigured-leader-time without being able to configure the virtual IP
+	leaderUnconfigured = expvar.NewInt("vipmanager_leader_unconfigured")
+	// backendLabels holds the backend specific identifiers returned by ipConfigurer.labels
+	backendLabels = expvar.NewMap("vipmanager_labels")
 )
 
+func init() {
+	releaseConfirmed.Set(-1)
+	healthCheckPassing.Set(-1)
+	expvar.Publish("vipmanager_failover_duration_seconds", failoverDuration)
+	expvar.Publish("vipmanager_vip_configured", vipConfigured)
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 type ipConfigurer interface {
 	queryAddress() bool
 	configureAddress() bool
 	deconfigureAddress() bool
 	getCIDR() string
 	cleanupArp()
+	// labels returns backend specific identifiers to tell instances apart in
+	// metrics and traces. Keys are fixed per backend and values change rarely,
+	// if at all, to keep the cardinality bounded.
+	labels() map[string]string
+}
+
+// releaseVerifier is implemented by configurers whose queryAddress may answer
+// from a cache, and that need to ask the provider to confirm a release.
+type releaseVerifier interface {
+	verifyRelease() (bool, error)
+}
+
+// statusReporter is implemented by configurers that track the state of the VIP
+// themselves, e.g. because they cache the answers of an API.
+type statusReporter interface {
+	status() (state string, lastAPICheck time.Time)
+}
+
+// Status is a snapshot of the state that drives the manager loop
+type Status struct {
+	Leader       bool       `json:"leader"`
+	VIP          string     `json:"vip"`
+	Backend      string     `json:"backend"`
+	State        string     `json:"state"`
+	LastCheck    time.Time  `json:"last_check"`
+	LastAPICheck *time.Time `json:"last_api_check,omitempty"`
+	// the last answer of the Hetzner API, see failoverReporter
+	Failover *HetznerFailover `json:"failover,omitempty"`
+}
+
+// failoverReporter is implemented by configurers that know the details
+// of the failover-ip from the last API call, without calling it again.
+type failoverReporter interface {
+	failoverDetails() *HetznerFailover
+}
+
+// shutdownReleaser is implemented by configurers whose deconfigureAddress
+// leaves the VIP registered, but that can release it when vip-manager stops.
+type shutdownReleaser interface {
+	releaseOnShutdown() bool
+}
+
+// arpRefresher is implemented by configurers that can repeat
+// their gratuitous ARP announcement while holding the VIP.
+type arpRefresher interface {
+	refreshArp() error
+}
+
+// splitBrainChecker is implemented by configurers that can tell whether another
+// machine holds the VIP as well, while this one is the leader and holds it.
+type splitBrainChecker interface {
+	// checkSplitBrain returns the other machine, or an empty string if there is none
+	checkSplitBrain() (string, error)
+	// reassert claims the VIP for this machine again
+	reassert() bool
+}
+
+// configReloader is implemented by configurers that keep
+// copies of the configuration, which IPManager.Reload has to update.
+type configReloader interface {
+	reloadConfig(update *IPConfiguration)
+}
+
+// vipStateReporter is implemented by configurers managing several VIPs,
+// to tell which of them were registered to this machine as of the last query.
+type vipStateReporter interface {
+	vipStates() map[string]bool
+}
+
+// unpublisher is implemented by configurers that publish variables of their VIP,
+// to remove them once the VIP is no longer managed, see vip-list-key.
+type unpublisher interface {
+	unpublish()
+}
+
+// partialConfigurer is implemented by configurers managing several VIPs,
+// where queryAddress only returns true if all of them are registered.
+type partialConfigurer interface {
+	anyConfigured() bool
 }
 
 // IPManager implements the main functionality of the VIP manager
 type IPManager struct {
-	configurer ipConfigurer
+	configurer  ipConfigurer
+	config      *IPConfiguration
+	hostingType string
+	tracer      *otlpExporter
+	notifier    *notifier
 
 	states       <-chan bool
 	currentState bool
 	stateLock    sync.Mutex
 	recheck      *sync.Cond
+	// set by SyncStates every arp-refresh-interval
+	arpRefreshDue bool
+	// set by SyncStates every split-brain-check-interval
+	splitBrainCheckDue bool
+	// set by SyncStates once the leader checker reported the first state
+	stateKnown bool
+	// set by SyncStates when this machine became the leader, see observeFailover
+	leaderSince time.Time
+	// set by Reload, applied by applyLoop
+	pendingReload *IPConfiguration
+
+	statusLock sync.Mutex
+	status     Status
+
+	// only used by applyLoop
+	ready               bool
+	interfaceGone       bool
+	configured          bool
+	fenced              bool
+	configureFailures   int
+	unconfiguredSince   time.Time
+	releaseSince        time.Time
+	lastDriftCorrection time.Time
+	// whether start-command succeeded, so stop-command is due when the VIP is released
+	serviceStarted bool
+	// set when an existing VIP was kept at startup, see startService
+	startPending bool
+	// see updateHealth
+	healthySince  time.Time
+	healthChecked bool
+	// last content written to state-file, see writeStateFile
+	stateFileContent string
+
+	// set if several VIPs are managed, see updateVIPList
+	multi       *multiConfigurer
+	readVIPList func(ctx context.Context) (string, error)
+	// set while max-ops-per-tick defers configuring some of the VIPs
+	deferredConfigure bool
+	// the lists last logged, in a dry run or as invalid
+	dryRunVIPList  string
+	invalidVIPList string
 }
 
 // NewIPManager returns a new instance of IPManager
-func NewIPManager(hostingType string, config *IPConfiguration, states <-chan bool, verbose bool) (m *IPManager, err error) {
+func NewIPManager(hostingType string, config *IPConfiguration, states <-chan bool) (m *IPManager, err error) {
 	m = &IPManager{
+		config:       config,
+		hostingType:  hostingType,
+		tracer:       newOTLPExporter(config.OTLPEndpoint, config.TLSMinVersion),
 		states:       states,
 		currentState: false,
 	}
 	m.recheck = sync.NewCond(&m.stateLock)
+	config.resolveTimeouts(hostingType)
+	if config.MetadataConcurrency > 0 {
+		metadataConcurrency = config.MetadataConcurrency
+	}
+	if len(config.AdditionalVIPs) > 0 || config.VIPListKey != "" {
+		m.multi, err = newMultiConfigurer(hostingType, config)
+		m.configurer = m.multi
+	} else {
+		m.configurer, err = newConfigurer(hostingType, config)
+	}
+	if err != nil {
+		m = nil
+		return
+	}
+	if config.DryRun {
+		m.configurer = newDryRunConfigurer(m.configurer, hostingType)
+	}
+	m.status = Status{VIP: m.configurer.getCIDR(), Backend: hostingType, State: "unknown"}
+	m.notifier = newNotifier(config)
+	return
+}
+
+// newConfigurer returns the ipConfigurer for hostingType, managing config.VIP
+func newConfigurer(hostingType string, config *IPConfiguration) (ipConfigurer, error) {
 	switch hostingType {
 	case "hetzner":
-		m.configurer, err = newHetznerConfigurer(config, verbose)
-		if err != nil {
-			return nil, err
-		}
+		return newHetznerConfigurer(config)
+	case "hetzner_cloud":
+		return newHetznerCloudConfigurer(config)
+	case "gcp":
+		return newGCPConfigurer(config)
+	case "dns_cloudflare":
+		return newCloudflareConfigurer(config)
+	case "equinix":
+		return newEquinixConfigurer(config)
+	case "azure":
+		return newAzureConfigurer(config)
+	case "openstack":
+		return newOpenStackConfigurer(config)
+	case "arp_only":
+		return newArpOnlyConfigurer(config)
 	case "basic":
 		fallthrough
 	default:
-		m.configurer, err = newBasicConfigurer(config)
-	}
-	if err != nil {
-		m = nil
+		if err := checkHostAddress(config); err != nil {
+			return nil, err
+		}
+		c, err := newBasicConfigurer(config)
+		if err != nil {
+			return nil, err
+		}
+		// a dry run doesn't change the interface
+		if !config.DryRun {
+			if err := c.checkCapabilities(); err != nil {
+				return nil, err
+			}
+		}
+		return c, nil
 	}
-	return
 }
 
 func (m *IPManager) applyLoop(ctx context.Context) {
-	timeout := 0
+	timeout := time.Duration(0)
 	for {
 		// Check if we should exit
 		select {
 		case <-ctx.Done():
-			m.configurer.deconfigureAddress()
+			sdNotify("STOPPING=1")
+			m.releaseOnShutdown()
+			m.removeStateFile()
 			return
-		case <-time.After(time.Duration(timeout) * time.Second):
+		case <-time.After(timeout):
+			// the loop runs at least every recheck-interval, see SyncStates
+			sdNotify("WATCHDOG=1")
+			m.applyReload()
+			if !m.checkInterface() {
+				timeout = time.Second
+				continue
+			}
+			m.updateHealth()
+			if m.multi != nil {
+				m.stateLock.Lock()
+				desired := m.currentState
+				m.stateLock.Unlock()
+				m.multi.startTick(desired)
+			}
+			m.updateVIPList(ctx)
 			actualState := m.configurer.queryAddress()
+			m.publishVIPConfigured(actualState)
+			m.publishLabels()
 			m.stateLock.Lock()
 			desiredState := m.currentState
-			log.Printf("IP address %s state is %t, desired %t", m.configurer.getCIDR(), actualState, desiredState)
+			if !desiredState && !actualState {
+				// some of several VIPs may still be registered, if releasing the others failed
+				if p, ok := m.configurer.(partialConfigurer); ok && p.anyConfigured() {
+					actualState = true
+				}
+			}
+			slog.Info("IP address state", "vip", m.configurer.getCIDR(), "state", actualState, "desired", desiredState)
+			m.logDecision(actualState, desiredState)
+			m.updateStatus(actualState, desiredState)
+			if m.stateKnown && !m.ready {
+				// the leader checker reached the DCS and the initial role is known
+				m.ready = true
+				sdNotify("READY=1")
+				if actualState && desiredState {
+					slog.Info("The virtual ip is already configured on this machine and it is the leader, keeping it", "vip", m.configurer.getCIDR())
+					m.startPending = true
+				}
+			}
+			if !m.stateKnown {
+				// don't touch the address before the role of this machine is known,
+				// so a virtual ip left in place by the last run survives a restart of the leader
+				m.waitRecheck(ctx)
+				m.stateLock.Unlock()
+				continue
+			}
 			if actualState != desiredState {
 				m.stateLock.Unlock()
-				var configureState bool
-				if desiredState {
-					configureState = m.configurer.configureAddress()
-				} else {
-					configureState = m.configurer.deconfigureAddress()
+				timeout = m.changeState(desiredState)
+			} else {
+				m.releaseSince = time.Time{}
+				// nothing to converge, e.g. the virtual ip was still configured
+				m.leaderSince = time.Time{}
+				m.configured = actualState
+				m.trackUnconfigured(false)
+				if m.arpRefreshDue {
+					m.arpRefreshDue = false
+					if actualState {
+						m.stateLock.Unlock()
+						m.refreshArp()
+						// the leader may have changed in the meantime
+						timeout = 0
+						continue
+					}
 				}
-				if !configureState {
-					log.Printf("Error while acquiring virtual ip for this machine")
-					//Sleep a little bit to avoid busy waiting due to the for loop.
-					timeout = 10
-				} else {
-					timeout = 0
+				if m.startPending {
+					m.startPending = false
+					if actualState {
+						m.stateLock.Unlock()
+						m.startService()
+						timeout = 0
+						continue
+					}
+				}
+				if m.splitBrainCheckDue {
+					m.splitBrainCheckDue = false
+					if actualState {
+						m.stateLock.Unlock()
+						m.checkSplitBrain()
+						timeout = 0
+						continue
+					}
 				}
-			} else {
 				// Wait for notification
-				m.recheck.Wait()
+				m.waitRecheck(ctx)
 				// Want to query actual state anyway, so unlock
 				m.stateLock.Unlock()
 			}
@@ -87,9 +377,536 @@ func (m *IPManager) applyLoop(ctx context.Context) {
 	}
 }
 
+// WatchVIPList makes the manager read the further VIPs of vip-list-key with read
+// on every check while this machine is the leader. It must be called before SyncStates.
+func (m *IPManager) WatchVIPList(read func(ctx context.Context) (string, error)) {
+	m.readVIPList = read
+}
+
+// updateVIPList reads vip-list-key and updates the VIPs managed besides ip,
+// see multiConfigurer.setListedVIPs. This is only done while this machine is the
+// leader, a follower releases all of them anyway. If the key can't be read or
+// doesn't hold a valid list, the VIPs managed so far are kept.
+func (m *IPManager) updateVIPList(ctx context.Context) {
+	if m.readVIPList == nil || m.multi == nil {
+		return
+	}
+	m.stateLock.Lock()
+	leader := m.currentState
+	m.stateLock.Unlock()
+	if !leader {
+		return
+	}
+
+	list, err := m.readVIPList(ctx)
+	if ctx.Err() != nil {
+		// shutting down, releaseOnShutdown takes care of the VIPs
+		return
+	}
+	if err != nil {
+		slog.Warn("Couldn't read vip-list-key, keeping the virtual ips managed so far", "key", m.config.VIPListKey, "err", err)
+		return
+	}
+	ones, _ := m.config.Netmask.Size()
+	vips, err := vipconfig.ParseVIPs(list, ones)
+	if err != nil {
+		// logged once per value, it won't change without someone fixing it
+		if list != m.invalidVIPList {
+			slog.Warn("vip-list-key doesn't hold a valid list, keeping the virtual ips managed so far", "key", m.config.VIPListKey, "err", err)
+			m.invalidVIPList = list
+		}
+		return
+	}
+	m.invalidVIPList = ""
+	if m.config.DryRun {
+		if list != m.dryRunVIPList {
+			slog.Warn("Dry run: the virtual ips listed in vip-list-key are never configured or released", "key", m.config.VIPListKey, "vips", list)
+			m.dryRunVIPList = list
+		}
+		return
+	}
+	if err = m.multi.setListedVIPs(vips); err != nil {
+		slog.Error("Couldn't update the virtual ips listed in vip-list-key", "key", m.config.VIPListKey, "err", err)
+	}
+}
+
+// waitRecheck waits for SyncStates to ask for another check, unless vip-manager
+// is shutting down. SyncStates broadcasts under stateLock once ctx is done, so
+// checking ctx under the lock doesn't miss that wakeup. stateLock must be held.
+func (m *IPManager) waitRecheck(ctx context.Context) {
+	if ctx.Err() == nil {
+		m.recheck.Wait()
+	}
+}
+
+// Reload changes the settings that can be changed while running, see
+// IPConfiguration.reload, keeping the state of the VIP. The settings are applied
+// by the manager loop before its next check, so they never change during an operation.
+func (m *IPManager) Reload(update *IPConfiguration) {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	m.pendingReload = update
+	m.recheck.Broadcast()
+}
+
+func (m *IPManager) applyReload() {
+	m.stateLock.Lock()
+	update := m.pendingReload
+	m.pendingReload = nil
+	m.stateLock.Unlock()
+	if update == nil {
+		return
+	}
+
+	notifyURL := m.config.NotifyURL
+	m.config.reload(update)
+	if r, ok := m.configurer.(configReloader); ok {
+		r.reloadConfig(update)
+	}
+	if m.config.NotifyURL != notifyURL {
+		m.notifier.close()
+		m.notifier = newNotifier(m.config)
+	}
+	slog.Info("Reloaded configuration", "vip", m.configurer.getCIDR())
+}
+
+// checkInterface returns whether the interface still exists, so the VIP can be managed.
+// If it was removed, e.g. because a VLAN was torn down, vip-manager either waits
+// for it to come back or exits, depending on on-interface-gone.
+func (m *IPManager) checkInterface() bool {
+	if m.hostingType == "hetzner" || m.hostingType == "hetzner_cloud" || m.hostingType == "gcp" || m.hostingType == "dns_cloudflare" || m.hostingType == "equinix" || m.hostingType == "azure" || m.hostingType == "openstack" {
+		// the failover-ip isn't bound to the interface
+		return true
+	}
+	iface, err := net.InterfaceByName(m.config.Iface.Name)
+	if err == nil {
+		if m.interfaceGone {
+			slog.Info("Interface is back, managing the virtual ip again", "interface", iface.Name, "vip", m.configurer.getCIDR())
+			m.interfaceGone = false
+			// the interface may have been re-created with a new index
+			m.config.Iface = *iface
+			m.configurer.cleanupArp()
+		}
+		return true
+	}
+	if !m.interfaceGone {
+		if m.config.OnInterfaceGone == "fatal" {
+			slog.Error("Interface is gone", "interface", m.config.Iface.Name, "err", err)
+			os.Exit(1)
+		}
+		slog.Warn("Interface is gone, waiting for it to come back", "interface", m.config.Iface.Name, "err", err)
+		m.interfaceGone = true
+	}
+	return false
+}
+
+// changeState configures or deconfigures the virtual IP,
+// returning how long to wait before checking the state again.
+func (m *IPManager) changeState(desiredState bool) time.Duration {
+	if !desiredState && m.config.ReleaseGraceWindow > 0 {
+		// Keep the address for a while, so that the new leader can take over
+		// before we drop it. Both nodes may hold the address during this window.
+		if m.releaseSince.IsZero() {
+			m.releaseSince = time.Now()
+			slog.Info("Keeping the virtual ip before releasing it", "vip", m.configurer.getCIDR(), "grace_window_ms", m.config.ReleaseGraceWindow)
+		}
+		remaining := time.Duration(m.config.ReleaseGraceWindow)*time.Millisecond - time.Since(m.releaseSince)
+		if remaining > 0 {
+			return remaining
+		}
+	}
+	m.releaseSince = time.Time{}
+
+	if desiredState {
+		if wait := m.unhealthyFor(); wait > 0 {
+			if m.healthySince.IsZero() {
+				slog.Warn("Not configuring the virtual ip, the health check fails", "vip", m.configurer.getCIDR())
+			} else {
+				slog.Info("Not configuring the virtual ip until the health check passed for health-check-min-healthy", "vip", m.configurer.getCIDR(), "remaining", wait.Round(time.Millisecond))
+			}
+			m.trackUnconfigured(true)
+			return wait
+		}
+	}
+
+	if desiredState && m.configured {
+		// We configured the address before, but it went away, e.g. because
+		// someone changed the failover destination in the Hetzner console.
+		remaining := time.Duration(m.config.DriftCorrectionBackoff)*time.Millisecond - time.Since(m.lastDriftCorrection)
+		if remaining > 0 {
+			return remaining
+		}
+		slog.Warn("IP address is no longer registered to this machine although it should be, re-configuring it", "vip", m.configurer.getCIDR())
+		driftCorrections.Add(1)
+		m.lastDriftCorrection = time.Now()
+		m.configured = false
+	}
+
+	var configureState bool
+	start := time.Now()
+	if desiredState {
+		// the canary and hook already ran when the first VIPs were configured
+		configureState = (m.deferredConfigure || m.preConfigure()) && m.configurer.configureAddress()
+		m.tracer.exportSpan("configure", start, configureState, m.spanAttributes())
+	} else {
+		if m.configured && !m.fenced {
+			m.fence()
+			m.fenced = true
+		}
+		m.stopService()
+		configureState = m.configurer.deconfigureAddress()
+		m.tracer.exportSpan("deconfigure", start, configureState, m.spanAttributes())
+		if configureState && m.config.VerifyReleaseAfter > 0 {
+			time.AfterFunc(time.Duration(m.config.VerifyReleaseAfter)*time.Millisecond, m.verifyRelease)
+		}
+	}
+	if configureState {
+		m.publishVIPConfigured(desiredState)
+		m.configured = desiredState
+		m.fenced = false
+		if desiredState {
+			m.startService()
+		}
+		m.runStateHook(desiredState)
+		m.notifier.notify(desiredState, m.configurer.getCIDR())
+		if desiredState {
+			m.observeFailover()
+		}
+	}
+	if !configureState && m.multi != nil && m.multi.deferredWork() {
+		// not a failure, max-ops-per-tick left some VIPs for the next check
+		m.deferredConfigure = desiredState
+		return time.Duration(m.config.RetryAfter) * time.Millisecond
+	}
+	m.deferredConfigure = false
+	m.trackUnconfigured(!configureState && desiredState)
+	if !configureState && desiredState {
+		configureErrors.Add(1)
+		m.configureFailures++
+		if m.config.FailFastOnConfigureError && m.configureFailures >= m.config.RetryNum {
+			slog.Error("Failed to configure virtual ip too often in a row, exiting as fail-fast-on-configure-error is set", "vip", m.configurer.getCIDR(), "failures", m.configureFailures)
+			os.Exit(1)
+		}
+	} else {
+		m.configureFailures = 0
+	}
+	if !configureState && !desiredState {
+		deconfigureErrors.Add(1)
+		slog.Error("CRITICAL: failed to release virtual ip, this machine might keep it while another one becomes the leader", "vip", m.configurer.getCIDR())
+	}
+	if !configureState {
+		slog.Error("Error while acquiring virtual ip for this machine", "vip", m.configurer.getCIDR())
+		operation := "deconfigure"
+		if desiredState {
+			operation = "configure"
+		}
+		m.recordDeadLetter(operation, desiredState)
+		//Sleep a little bit to avoid busy waiting due to the for loop.
+		return 10 * time.Second
+	}
+	return 0
+}
+
+// refreshArp repeats the gratuitous ARP announcement of the VIP.
+func (m *IPManager) refreshArp() {
+	r, ok := m.configurer.(arpRefresher)
+	if !ok {
+		return
+	}
+	err := r.refreshArp()
+	if errors.Is(err, errArpBurstSuppressed) {
+		return
+	}
+	if err != nil {
+		slog.Warn("Couldn't refresh the ARP announcement", "vip", m.configurer.getCIDR(), "err", err)
+		return
+	}
+	arpSent.Add(1)
+}
+
+// observeFailover logs and records in failoverDuration how long it took from
+// becoming the leader until the virtual IP was configured. For manager types
+// like hetzner, configureAddress only succeeds once the provider confirmed it.
+func (m *IPManager) observeFailover() {
+	m.stateLock.Lock()
+	since := m.leaderSince
+	m.leaderSince = time.Time{}
+	m.stateLock.Unlock()
+	if since.IsZero() {
+		return
+	}
+	d := time.Since(since)
+	failoverDuration.Observe(d.Seconds())
+	slog.Info("Virtual ip was configured after becoming the leader", "vip", m.configurer.getCIDR(), "backend", m.hostingType, "duration", d.Round(time.Millisecond))
+}
+
+// checkSplitBrain looks for another machine holding the VIP, while this one is
+// the leader and holds it as well, and claims the VIP again if there is one.
+func (m *IPManager) checkSplitBrain() {
+	c, ok := m.configurer.(splitBrainChecker)
+	if !ok {
+		return
+	}
+	other, err := c.checkSplitBrain()
+	if err != nil {
+		slog.Warn("Couldn't check whether another machine holds the virtual ip", "vip", m.configurer.getCIDR(), "err", err)
+		return
+	}
+	if other == "" {
+		return
+	}
+	splitBrainDetected.Add(1)
+	slog.Error("SPLIT-BRAIN: this machine is the leader and holds the virtual ip, but another machine holds it as well, claiming it again",
+		"vip", m.configurer.getCIDR(), "other", other)
+	if !c.reassert() {
+		slog.Error("Couldn't claim the virtual ip again", "vip", m.configurer.getCIDR())
+	}
+}
+
+// trackUnconfigured raises a critical alert once this machine has been the leader
+// for longer than max-unconfigured-leader-time without configuring the virtual IP.
+func (m *IPManager) trackUnconfigured(failed bool) {
+	if !failed {
+		if !m.unconfiguredSince.IsZero() && leaderUnconfigured.Value() == 1 {
+			slog.Info("Virtual ip was configured or leadership was lost, clearing the critical alert", "vip", m.configurer.getCIDR())
+		}
+		m.unconfiguredSince = time.Time{}
+		leaderUnconfigured.Set(0)
+		return
+	}
+	if m.unconfiguredSince.IsZero() {
+		m.unconfiguredSince = time.Now()
+	}
+	if m.config.MaxUnconfiguredLeaderTime <= 0 || leaderUnconfigured.Value() == 1 {
+		return
+	}
+	if since := time.Since(m.unconfiguredSince); since >= time.Duration(m.config.MaxUnconfiguredLeaderTime)*time.Millisecond {
+		slog.Error("CRITICAL: this machine is the leader, but failed to configure the virtual ip. Another node can't take over unless leadership moves",
+			"vip", m.configurer.getCIDR(), "since", since.Round(time.Second))
+		leaderUnconfigured.Set(1)
+	}
+}
+
+// releaseOnShutdown releases the VIP before vip-manager exits, so it isn't
+// left on a node that no longer takes part, unless no-release-on-shutdown is set.
+func (m *IPManager) releaseOnShutdown() {
+	if m.config.NoReleaseOnShutdown {
+		slog.Info("Leaving the virtual ip as it is, as no-release-on-shutdown is set", "vip", m.configurer.getCIDR())
+		return
+	}
+	m.stopService()
+	var released bool
+	if r, ok := m.configurer.(shutdownReleaser); ok {
+		released = r.releaseOnShutdown()
+	} else {
+		released = m.configurer.deconfigureAddress()
+	}
+	if !released {
+		m.recordDeadLetter("release on shutdown", false)
+	}
+}
+
+// runStateHook runs on-gain-hook or on-loss-hook after the VIP was configured
+// or released. Failures are only logged, the VIP has already moved.
+func (m *IPManager) runStateHook(gained bool) {
+	name, command := "on-loss hook", m.config.OnLossHook
+	if gained {
+		name, command = "on-gain hook", m.config.OnGainHook
+	}
+	if err := runHook(name, command, m.config.HookTimeout, m.config); err != nil {
+		slog.Warn("Hook failed", "hook", name, "err", err)
+	}
+}
+
+// fence runs fence-command when leadership was lost while this machine held the VIP,
+// before it is released. The VIP is released even if the command fails, as keeping it
+// can only make a split-brain worse.
+func (m *IPManager) fence() {
+	if m.config.FenceCommand == "" {
+		return
+	}
+	slog.Warn("Leadership was lost while holding the virtual ip, running fence command", "vip", m.configurer.getCIDR())
+	err := runHook("fence command", m.config.FenceCommand, m.config.FenceTimeout, m.config, "VIP_NODE="+m.config.Nodename)
+	if err != nil {
+		fenceErrors.Add(1)
+		slog.Error("CRITICAL: fence command failed, releasing the virtual ip anyway", "vip", m.configurer.getCIDR(), "err", err)
+	}
+}
+
+// startService runs start-command once the VIP is configured on this machine.
+// The command should be idempotent, e.g. systemctl start, as it is also run when
+// vip-manager restarts on the leader and keeps the VIP, which may find the service running.
+func (m *IPManager) startService() {
+	if m.config.StartCommand == "" || m.serviceStarted {
+		return
+	}
+	err := runHook("start command", m.config.StartCommand, m.config.HookTimeout, m.config, "VIP_NODE="+m.config.Nodename)
+	if err != nil {
+		slog.Error("Start command failed, stop command won't be run when the virtual ip is released", "vip", m.configurer.getCIDR(), "err", err)
+		return
+	}
+	m.serviceStarted = true
+}
+
+// stopService runs stop-command before the VIP is released, if start-command
+// succeeded. The VIP is released even if the command fails.
+func (m *IPManager) stopService() {
+	if !m.serviceStarted {
+		return
+	}
+	m.serviceStarted = false
+	if m.config.StopCommand == "" {
+		return
+	}
+	err := runHook("stop command", m.config.StopCommand, m.config.HookTimeout, m.config, "VIP_NODE="+m.config.Nodename)
+	if err != nil {
+		slog.Error("Stop command failed, releasing the virtual ip anyway", "vip", m.configurer.getCIDR(), "err", err)
+	}
+}
+
+// verifyRelease checks that the VIP is no longer registered to this machine
+// some time after it was released, e.g. that the provider routes it elsewhere.
+func (m *IPManager) verifyRelease() {
+	var released bool
+	var err error
+	if v, ok := m.configurer.(releaseVerifier); ok {
+		released, err = v.verifyRelease()
+	} else {
+		released = !m.configurer.queryAddress()
+	}
+	switch {
+	case err != nil:
+		slog.Warn("Couldn't verify that the virtual ip was released", "vip", m.configurer.getCIDR(), "err", err)
+		releaseConfirmed.Set(-1)
+	case released:
+		slog.Info("Release confirmed", "vip", m.configurer.getCIDR())
+		releaseConfirmed.Set(1)
+	default:
+		slog.Warn("Virtual ip was released, but is still registered to this machine", "vip", m.configurer.getCIDR())
+		releaseConfirmed.Set(0)
+	}
+}
+
+// updateStatus records the result of the last check, see Status
+func (m *IPManager) updateStatus(actualState, desiredState bool) {
+	s := Status{
+		Leader:    desiredState,
+		VIP:       m.configurer.getCIDR(),
+		Backend:   m.hostingType,
+		State:     "released",
+		LastCheck: time.Now(),
+	}
+	if actualState {
+		s.State = "configured"
+	}
+	if r, ok := m.configurer.(statusReporter); ok {
+		var lastAPICheck time.Time
+		s.State, lastAPICheck = r.status()
+		if !lastAPICheck.IsZero() && lastAPICheck.Unix() != 0 {
+			s.LastAPICheck = &lastAPICheck
+		}
+	}
+	if r, ok := m.configurer.(failoverReporter); ok {
+		s.Failover = r.failoverDetails()
+	}
+	m.statusLock.Lock()
+	m.status = s
+	m.statusLock.Unlock()
+	m.writeStateFile(s)
+}
+
+// Status returns the result of the last check of the virtual IP
+func (m *IPManager) Status() Status {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	return m.status
+}
+
+// logDecision logs everything the decision of this check is based on in a single line.
+func (m *IPManager) logDecision(actualState, desiredState bool) {
+	action := "none"
+	switch {
+	case !m.stateKnown:
+		action = "wait"
+	case actualState == desiredState:
+	case desiredState:
+		action = "configure"
+	default:
+		action = "deconfigure"
+	}
+	slog.Debug("decision", "vip", m.configurer.getCIDR(), "backend", m.hostingType,
+		"leader", desiredState, "registered", actualState, "configured", m.configured, "action", action)
+}
+
+func (m *IPManager) spanAttributes() map[string]string {
+	attrs := map[string]string{
+		"vip":       m.configurer.getCIDR(),
+		"interface": m.config.Iface.Name,
+		"backend":   m.hostingType,
+	}
+	for k, v := range m.configurer.labels() {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// publishLabels exports the backend specific labels, they may only be
+// known after the first query, e.g. the Hetzner server number.
+func (m *IPManager) publishLabels() {
+	for k, v := range m.configurer.labels() {
+		s := new(expvar.String)
+		s.Set(v)
+		backendLabels.Set(k, s)
+	}
+}
+
+// publishVIPConfigured sets vipmanager_vip_configured of each VIP, to configured
+// unless the configurer tells the state of each VIP, see vipStateReporter.
+func (m *IPManager) publishVIPConfigured(configured bool) {
+	if r, ok := m.configurer.(vipStateReporter); ok {
+		for vip, state := range r.vipStates() {
+			vipConfigured.Set(vip, m.config.Iface.Name, boolToInt(state))
+		}
+		return
+	}
+	vipConfigured.Set(m.config.VIP.String(), m.config.Iface.Name, boolToInt(configured))
+	for _, vip := range m.config.AdditionalVIPs {
+		vipConfigured.Set(vip.IP.String(), m.config.Iface.Name, boolToInt(configured))
+	}
+}
+
+// preConfigure checks the connectivity canary and runs the pre-configure hook,
+// if they are set. The VIP must only be configured if both succeeded.
+func (m *IPManager) preConfigure() bool {
+	if err := checkCanary(m.config); err != nil {
+		slog.Warn("Not configuring the virtual ip, this machine might be partitioned", "vip", m.configurer.getCIDR(), "err", err)
+		return false
+	}
+	err := runHook("pre-configure hook", m.config.PreConfigureHook, m.config.HookTimeout, m.config)
+	if err != nil {
+		slog.Warn("Not configuring the virtual ip", "vip", m.configurer.getCIDR(), "err", err)
+		return false
+	}
+	return true
+}
+
 // SyncStates implements states synchronization
 func (m *IPManager) SyncStates(ctx context.Context, states <-chan bool) {
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(time.Duration(m.config.RecheckInterval) * time.Millisecond)
+
+	var arpRefresh <-chan time.Time
+	if _, ok := m.configurer.(arpRefresher); ok && m.config.ArpRefreshInterval > 0 {
+		arpTicker := time.NewTicker(time.Duration(m.config.ArpRefreshInterval) * time.Millisecond)
+		defer arpTicker.Stop()
+		arpRefresh = arpTicker.C
+	}
+
+	var splitBrainCheck <-chan time.Time
+	if _, ok := m.configurer.(splitBrainChecker); ok && m.config.SplitBrainCheckInterval > 0 {
+		splitBrainTicker := time.NewTicker(time.Duration(m.config.SplitBrainCheckInterval) * time.Millisecond)
+		defer splitBrainTicker.Stop()
+		splitBrainCheck = splitBrainTicker.C
+	}
 
 	var wg sync.WaitGroup
 	wg.Add(1)
@@ -102,15 +919,33 @@ func (m *IPManager) SyncStates(ctx context.Context, states <-chan bool) {
 		select {
 		case newState := <-states:
 			m.stateLock.Lock()
-			if m.currentState != newState {
+			if m.currentState != newState || !m.stateKnown {
 				m.currentState = newState
+				m.stateKnown = true
+				m.leaderSince = time.Time{}
+				if newState {
+					m.leaderSince = time.Now()
+				}
+				isLeader.Set(boolToInt(newState))
 				m.recheck.Broadcast()
 			}
 			m.stateLock.Unlock()
 		case <-ticker.C:
 			m.recheck.Broadcast()
+		case <-arpRefresh:
+			m.stateLock.Lock()
+			m.arpRefreshDue = true
+			m.recheck.Broadcast()
+			m.stateLock.Unlock()
+		case <-splitBrainCheck:
+			m.stateLock.Lock()
+			m.splitBrainCheckDue = true
+			m.recheck.Broadcast()
+			m.stateLock.Unlock()
 		case <-ctx.Done():
+			m.stateLock.Lock()
 			m.recheck.Broadcast()
+			m.stateLock.Unlock()
 			wg.Wait()
 			m.configurer.cleanupArp()
 			return
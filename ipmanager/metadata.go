@@ -0,0 +1,37 @@
+package ipmanager
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// metadataConcurrency caps the concurrent requests of all configurers to the
+// metadata services, e.g. of GCP and Hetzner Cloud, see metadata-concurrency.
+// It is set by NewIPManager before any request is made.
+var metadataConcurrency = 1
+
+var (
+	metadataSlotsOnce sync.Once
+	metadataSlots     chan struct{}
+)
+
+// acquireMetadataSlot waits until a request to the metadata service may be made,
+// returning the function that frees the slot again. Waiting is logged, as it
+// means that several configurers query the metadata service at the same time.
+func acquireMetadataSlot(ctx context.Context, key string) (func(), error) {
+	metadataSlotsOnce.Do(func() {
+		metadataSlots = make(chan struct{}, metadataConcurrency)
+	})
+	select {
+	case metadataSlots <- struct{}{}:
+	default:
+		slog.Info("Waiting for a free slot to query the metadata service", "key", key, "limit", cap(metadataSlots))
+		select {
+		case metadataSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return func() { <-metadataSlots }, nil
+}
@@ -0,0 +1,541 @@
+package ipmanager
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// multiConfigurer manages several virtual IPs together, one configurer per VIP.
+// All of them are configured and released together, but each on its own,
+// so failing to move one VIP doesn't keep the others from moving.
+type multiConfigurer struct {
+	hostingType string
+	config      *IPConfiguration
+	configs     []*IPConfiguration
+	members     []ipConfigurer
+	// the first members are the VIPs of ip, the others come from vip-list-key
+	static int
+
+	// states of the members as of the last query, verifyRelease runs in the background
+	mu     sync.Mutex
+	states []bool
+
+	// the work of the current check, see startTick
+	desired  bool
+	budget   int
+	queried  []bool
+	deferred int
+	// the member whose routine query is due next
+	next int
+
+	// newConfigurer and promoteSecondaries unless replaced, see initMembers and keepSharedSubnet
+	newConfigurer      func(hostingType string, config *IPConfiguration) (ipConfigurer, error)
+	promoteSecondaries func(iface string) error
+	// set once promote_secondaries was enabled on the interface
+	promoted bool
+}
+
+// maxConcurrentInits bounds the number of configurers created at once, see initMembers
+const maxConcurrentInits = 8
+
+func newMultiConfigurer(hostingType string, config *IPConfiguration) (*multiConfigurer, error) {
+	vips := append([]net.IPNet{{IP: config.VIP, Mask: config.Netmask}}, config.AdditionalVIPs...)
+	c := &multiConfigurer{hostingType: hostingType, config: config, static: len(vips),
+		newConfigurer: newConfigurer, promoteSecondaries: promoteSecondaries}
+	if err := c.initMembers(vips); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// initMembers creates the configurers of vips, as released. Creating one may take
+// a while, e.g. to look up the instance or check credentials, so up to
+// maxConcurrentInits are created at once. All of them are created even if some
+// fail, and the errors are returned per VIP.
+func (c *multiConfigurer) initMembers(vips []net.IPNet) error {
+	for _, vip := range vips {
+		c.keepSharedSubnet(vip)
+		c.configs = append(c.configs, c.memberConfig(vip))
+	}
+	c.members = make([]ipConfigurer, len(vips))
+	c.states = make([]bool, len(vips))
+
+	errs := make([]error, len(vips))
+	slots := make(chan struct{}, maxConcurrentInits)
+	var wg sync.WaitGroup
+	for i, config := range c.configs {
+		wg.Add(1)
+		go func(i int, config *IPConfiguration) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			start := time.Now()
+			member, err := c.newConfigurer(c.hostingType, config)
+			if err != nil {
+				slog.Error("Couldn't set up the virtual ip", "vip", config.VIP, "err", err)
+				errs[i] = fmt.Errorf("%s: %w", config.VIP, err)
+				return
+			}
+			slog.Debug("Set up the virtual ip", "vip", config.VIP, "took", time.Since(start).Round(time.Millisecond))
+			c.members[i] = member
+		}(i, config)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// memberConfig returns the configuration of the member managing vip
+func (c *multiConfigurer) memberConfig(vip net.IPNet) *IPConfiguration {
+	memberConfig := *c.config
+	memberConfig.VIP = vip.IP
+	memberConfig.Netmask = vip.Mask
+	memberConfig.AdditionalVIPs = nil
+	return &memberConfig
+}
+
+// addMember creates the configurer of vip, as released
+func (c *multiConfigurer) addMember(vip net.IPNet) error {
+	memberConfig := c.memberConfig(vip)
+	c.keepSharedSubnet(vip)
+	member, err := c.newConfigurer(c.hostingType, memberConfig)
+	if err != nil {
+		return fmt.Errorf("%s: %w", vip.IP, err)
+	}
+	c.configs = append(c.configs, memberConfig)
+	c.members = append(c.members, member)
+	c.states = append(c.states, false)
+	return nil
+}
+
+// setListedVIPs makes vips the VIPs managed besides the ones of ip, see vip-list-key.
+// It is only called while this machine is the leader, so new VIPs are configured
+// right away, as far as max-ops-per-tick allows; otherwise, or if that fails,
+// the next checks configure them like after a drift.
+// VIPs that are no longer listed are released and removed; if releasing one
+// fails, it is kept and released again on the next update.
+func (c *multiConfigurer) setListedVIPs(vips []net.IPNet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	listed := map[string]bool{}
+	var errs []error
+	for _, vip := range vips {
+		listed[vip.IP.String()] = true
+		if c.indexOf(vip.IP) >= 0 {
+			continue
+		}
+		if err := c.addMember(vip); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		i := len(c.members) - 1
+		slog.Info("Managing the virtual ip listed in vip-list-key", "vip", c.members[i].getCIDR())
+		if !c.spend() {
+			// configured by one of the next checks
+			continue
+		}
+		c.states[i] = c.members[i].configureAddress()
+		if !c.states[i] {
+			errs = append(errs, fmt.Errorf("%s: couldn't configure the virtual ip listed in vip-list-key", vip.IP))
+		}
+	}
+
+	for i := len(c.members) - 1; i >= c.static; i-- {
+		vip := c.configs[i].VIP
+		if listed[vip.String()] {
+			continue
+		}
+		if c.states[i] && !c.spend() {
+			// released by one of the next updates
+			continue
+		}
+		if c.states[i] && !c.members[i].deconfigureAddress() {
+			errs = append(errs, fmt.Errorf("%s: couldn't release the virtual ip, which is no longer listed in vip-list-key", vip))
+			continue
+		}
+		slog.Info("No longer managing the virtual ip, it isn't listed in vip-list-key anymore", "vip", c.members[i].getCIDR())
+		vipConfigured.Delete(vip.String(), c.config.Iface.Name)
+		if u, ok := c.members[i].(unpublisher); ok {
+			u.unpublish()
+		}
+		c.configs = append(c.configs[:i], c.configs[i+1:]...)
+		c.members = append(c.members[:i], c.members[i+1:]...)
+		c.states = append(c.states[:i], c.states[i+1:]...)
+	}
+	return errors.Join(errs...)
+}
+
+// keepSharedSubnet makes sure that releasing one of several VIPs in the same IPv4
+// subnet doesn't remove the others as well. The kernel adds all but the first
+// address of a subnet as secondary addresses and deletes them along with the first
+// one, unless promote_secondaries is enabled on the interface. The prefix route
+// then moves to the promoted address, so the subnet keeps exactly one route.
+func (c *multiConfigurer) keepSharedSubnet(vip net.IPNet) {
+	if c.hostingType != "basic" || c.promoted || vip.IP.To4() == nil {
+		return
+	}
+	shared := false
+	for _, config := range c.configs {
+		other := net.IPNet{IP: config.VIP, Mask: config.Netmask}
+		if other.IP.To4() != nil && (other.Contains(vip.IP) || vip.Contains(other.IP)) {
+			shared = true
+			break
+		}
+	}
+	if !shared {
+		return
+	}
+	if err := c.promoteSecondaries(c.config.Iface.Name); err != nil {
+		slog.Warn("Couldn't enable promote_secondaries, releasing one of the virtual ips in the same subnet removes the others as well",
+			"vip", vip.String(), "interface", c.config.Iface.Name, "err", err)
+		return
+	}
+	slog.Info("Enabled promote_secondaries, as several virtual ips share a subnet", "vip", vip.String(), "interface", c.config.Iface.Name)
+	c.promoted = true
+}
+
+// indexOf returns the index of the member managing vip, or -1
+func (c *multiConfigurer) indexOf(vip net.IP) int {
+	for i, config := range c.configs {
+		if config.VIP.Equal(vip) {
+			return i
+		}
+	}
+	return -1
+}
+
+// startTick starts a check, in which the VIPs should be configured if desired, or
+// released otherwise, resetting the budget of max-ops-per-tick for its operations.
+func (c *multiConfigurer) startTick(desired bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.desired = desired
+	c.budget = c.config.MaxOpsPerTick
+	c.queried = make([]bool, len(c.members))
+	c.deferred = 0
+}
+
+// spend takes an operation from the budget of the check,
+// returning false if it is used up. mu must be held.
+func (c *multiConfigurer) spend() bool {
+	if c.config.MaxOpsPerTick <= 0 {
+		return true
+	}
+	if c.budget <= 0 {
+		return false
+	}
+	c.budget--
+	return true
+}
+
+// deferredWork returns whether the last configure or release left VIPs for
+// the next check, as they didn't fit into max-ops-per-tick
+func (c *multiConfigurer) deferredWork() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deferred > 0
+}
+
+// queryAddress queries every VIP and returns whether all of them are registered to this machine.
+// With max-ops-per-tick, the VIPs that need to be changed are queried first, keeping
+// an operation of the budget for each that still needs it. The others take turns with
+// what is left, and keep their last state until it is their turn.
+func (c *multiConfigurer) queryAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.queried) != len(c.members) {
+		// vip-list-key changed the members
+		c.queried = make([]bool, len(c.members))
+	}
+	order := make([]int, 0, len(c.members))
+	for i := range c.members {
+		if c.states[i] != c.desired {
+			order = append(order, i)
+		}
+	}
+	for k := range c.members {
+		if i := (c.next + k) % len(c.members); c.states[i] == c.desired {
+			order = append(order, i)
+		}
+	}
+
+	reserved, skipped := 0, 0
+	for _, i := range order {
+		routine := c.states[i] == c.desired
+		if c.config.MaxOpsPerTick > 0 && c.budget-reserved <= 0 || !c.spend() {
+			skipped++
+			continue
+		}
+		c.states[i] = c.members[i].queryAddress()
+		c.queried[i] = true
+		if c.states[i] != c.desired {
+			reserved++
+		}
+		if routine {
+			c.next = (i + 1) % len(c.members)
+		}
+	}
+	if skipped > 0 {
+		slog.Debug("Deferring queries to the next checks, as max-ops-per-tick is used up", "deferred", skipped, "max_ops_per_tick", c.config.MaxOpsPerTick)
+	}
+
+	all := true
+	for _, state := range c.states {
+		all = all && state
+	}
+	return all
+}
+
+// anyConfigured returns whether any VIP was registered to this machine as of the last query
+func (c *multiConfigurer) anyConfigured() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, state := range c.states {
+		if state {
+			return true
+		}
+	}
+	return false
+}
+
+// vipStates returns which VIPs were registered to this machine as of the last query, see vipStateReporter
+func (c *multiConfigurer) vipStates() map[string]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	states := make(map[string]bool, len(c.configs))
+	for i, config := range c.configs {
+		states[config.VIP.String()] = c.states[i]
+	}
+	return states
+}
+
+// configureAddress configures the VIPs that aren't registered yet,
+// returning whether all of them are registered now.
+func (c *multiConfigurer) configureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	all := true
+	c.deferred = 0
+	for i, member := range c.members {
+		if c.states[i] {
+			continue
+		}
+		if !c.mayChange(i) {
+			all = false
+			c.deferred++
+			continue
+		}
+		c.states[i] = member.configureAddress()
+		all = all && c.states[i]
+	}
+	if c.deferred > 0 {
+		slog.Info("Deferring configuring virtual ips to the next check, as max-ops-per-tick is used up", "deferred", c.deferred, "max_ops_per_tick", c.config.MaxOpsPerTick)
+	}
+	return all
+}
+
+// deconfigureAddress releases the VIPs that are registered,
+// returning whether all of them were released.
+func (c *multiConfigurer) deconfigureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	all := true
+	c.deferred = 0
+	for i, member := range c.members {
+		if !c.states[i] {
+			continue
+		}
+		if !c.mayChange(i) {
+			all = false
+			c.deferred++
+			continue
+		}
+		c.states[i] = !member.deconfigureAddress()
+		all = all && !c.states[i]
+	}
+	if c.deferred > 0 {
+		slog.Info("Deferring releasing virtual ips to the next check, as max-ops-per-tick is used up", "deferred", c.deferred, "max_ops_per_tick", c.config.MaxOpsPerTick)
+	}
+	return all
+}
+
+// mayChange returns whether member i may be configured or released in this
+// check: it must have been queried in it and the budget must allow it. mu must be held.
+func (c *multiConfigurer) mayChange(i int) bool {
+	if c.config.MaxOpsPerTick <= 0 {
+		return true
+	}
+	return i < len(c.queried) && c.queried[i] && c.spend()
+}
+
+// snapshot returns the members and their configurations, for the methods that
+// don't hold mu while calling the members, as vip-list-key may change them meanwhile
+func (c *multiConfigurer) snapshot() ([]ipConfigurer, []*IPConfiguration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]ipConfigurer(nil), c.members...), append([]*IPConfiguration(nil), c.configs...)
+}
+
+func (c *multiConfigurer) getCIDR() string {
+	members, _ := c.snapshot()
+	cidrs := make([]string, len(members))
+	for i, member := range members {
+		cidrs[i] = member.getCIDR()
+	}
+	return strings.Join(cidrs, ",")
+}
+
+// cleanupArp passes on the interface, which may have been re-created, to the members
+func (c *multiConfigurer) cleanupArp() {
+	members, configs := c.snapshot()
+	for i, member := range members {
+		configs[i].Iface = c.config.Iface
+		member.cleanupArp()
+	}
+}
+
+// labels merges the labels of the members, the first VIP wins on conflicts
+func (c *multiConfigurer) labels() map[string]string {
+	var labels map[string]string
+	members, _ := c.snapshot()
+	for _, member := range members {
+		for k, v := range member.labels() {
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			if _, ok := labels[k]; !ok {
+				labels[k] = v
+			}
+		}
+	}
+	return labels
+}
+
+// reloadConfig passes on the reloaded settings to the members, see configReloader
+func (c *multiConfigurer) reloadConfig(update *IPConfiguration) {
+	_, configs := c.snapshot()
+	for _, config := range configs {
+		config.reload(update)
+	}
+}
+
+// describeAction joins what would be done for each VIP, see dryRunConfigurer
+func (c *multiConfigurer) describeAction(configure bool) string {
+	members, _ := c.snapshot()
+	actions := make([]string, len(members))
+	for i, member := range members {
+		actions[i] = member.getCIDR() + ": " + describeAction(member, configure)
+	}
+	return strings.Join(actions, "; ")
+}
+
+// lastFailure joins the last failures of the VIPs, see failureReporter
+func (c *multiConfigurer) lastFailure() error {
+	var errs []error
+	members, _ := c.snapshot()
+	for _, member := range members {
+		if f, ok := member.(failureReporter); ok {
+			if err := f.lastFailure(); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", member.getCIDR(), err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// verifyRelease returns whether all VIPs were released, see releaseVerifier
+func (c *multiConfigurer) verifyRelease() (bool, error) {
+	all := true
+	var errs []error
+	members, _ := c.snapshot()
+	for _, member := range members {
+		var released bool
+		var err error
+		if v, ok := member.(releaseVerifier); ok {
+			released, err = v.verifyRelease()
+		} else {
+			released = !member.queryAddress()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", member.getCIDR(), err))
+		}
+		all = all && released
+	}
+	return all, errors.Join(errs...)
+}
+
+// status reports the common state of the VIPs, or partial if they differ.
+// The last API check is the oldest one of the members.
+func (c *multiConfigurer) status() (string, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var state string
+	var lastAPICheck time.Time
+	for i, member := range c.members {
+		s := "released"
+		if c.states[i] {
+			s = "configured"
+		}
+		if r, ok := member.(statusReporter); ok {
+			var checked time.Time
+			s, checked = r.status()
+			if lastAPICheck.IsZero() || checked.Before(lastAPICheck) {
+				lastAPICheck = checked
+			}
+		}
+		if state == "" {
+			state = s
+		} else if state != s {
+			state = "partial"
+		}
+	}
+	return state, lastAPICheck
+}
+
+// releaseOnShutdown releases every VIP, see shutdownReleaser
+func (c *multiConfigurer) releaseOnShutdown() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	all := true
+	for i, member := range c.members {
+		if r, ok := member.(shutdownReleaser); ok {
+			all = r.releaseOnShutdown() && all
+		} else if c.states[i] {
+			c.states[i] = !member.deconfigureAddress()
+			all = all && !c.states[i]
+		}
+	}
+	return all
+}
+
+// refreshArp repeats the announcements of the registered VIPs, see arpRefresher
+func (c *multiConfigurer) refreshArp() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for i, member := range c.members {
+		r, ok := member.(arpRefresher)
+		if !ok || !c.states[i] {
+			continue
+		}
+		if err := r.refreshArp(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", member.getCIDR(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,136 @@
+package ipmanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeepSharedSubnet(t *testing.T) {
+	cidr := func(s string) net.IPNet {
+		ip, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return net.IPNet{IP: ip, Mask: ipnet.Mask}
+	}
+	tests := []struct {
+		name        string
+		hostingType string
+		vips        []string
+		promoted    bool
+	}{
+		{"same /24", "basic", []string{"192.0.2.10/24", "192.0.2.11/24"}, true},
+		{"host address in a larger subnet", "basic", []string{"192.0.2.10/32", "192.0.2.11/24"}, true},
+		{"different subnets", "basic", []string{"192.0.2.10/24", "198.51.100.10/24"}, false},
+		{"host addresses", "basic", []string{"192.0.2.10/32", "192.0.2.11/32"}, false},
+		{"single VIP", "basic", []string{"192.0.2.10/24"}, false},
+		{"IPv6", "basic", []string{"2001:db8::10/64", "2001:db8::11/64"}, false},
+		{"not bound to the interface", "hetzner", []string{"192.0.2.10/24", "192.0.2.11/24"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			c := &multiConfigurer{
+				hostingType: tt.hostingType,
+				config:      &IPConfiguration{Iface: net.Interface{Name: "eth0"}},
+				promoteSecondaries: func(iface string) error {
+					calls = append(calls, iface)
+					return nil
+				},
+			}
+			for _, s := range tt.vips {
+				vip := cidr(s)
+				c.keepSharedSubnet(vip)
+				c.configs = append(c.configs, &IPConfiguration{VIP: vip.IP, Netmask: vip.Mask})
+			}
+			if c.promoted != tt.promoted {
+				t.Errorf("got promoted %v, want %v", c.promoted, tt.promoted)
+			}
+			want := 0
+			if tt.promoted {
+				want = 1
+			}
+			if len(calls) != want || (want == 1 && calls[0] != "eth0") {
+				t.Errorf("got promote_secondaries enabled on %v, want it %d times on eth0", calls, want)
+			}
+		})
+	}
+}
+
+func TestKeepSharedSubnetOnce(t *testing.T) {
+	calls := 0
+	c := &multiConfigurer{
+		hostingType: "basic",
+		config:      &IPConfiguration{Iface: net.Interface{Name: "eth0"}},
+		promoteSecondaries: func(string) error {
+			if calls++; calls == 1 {
+				return errors.New("read-only file system")
+			}
+			return nil
+		},
+	}
+	for _, ip := range []string{"192.0.2.10", "192.0.2.11", "192.0.2.12", "192.0.2.13"} {
+		vip := net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)}
+		c.keepSharedSubnet(vip)
+		c.configs = append(c.configs, &IPConfiguration{VIP: vip.IP, Netmask: vip.Mask})
+	}
+	// tried again with the next VIP after the first attempt failed, and not anymore once it succeeded
+	if !c.promoted || calls != 2 {
+		t.Errorf("got promoted %v after %d attempts, want true after 2", c.promoted, calls)
+	}
+}
+
+func TestInitMembersReportsEachFailure(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	c := &multiConfigurer{
+		hostingType: "basic",
+		config:      &IPConfiguration{Iface: net.Interface{Name: "eth0"}},
+		newConfigurer: func(_ string, config *IPConfiguration) (ipConfigurer, error) {
+			mu.Lock()
+			if running++; running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+
+			if last := config.VIP.To4()[3]; last%5 == 0 {
+				return nil, fmt.Errorf("no such address %d", last)
+			}
+			return &BasicConfigurer{IPConfiguration: config}, nil
+		},
+		promoteSecondaries: func(string) error { return nil },
+	}
+	var vips []net.IPNet
+	for i := 1; i <= 3*maxConcurrentInits; i++ {
+		vips = append(vips, net.IPNet{IP: net.IPv4(192, 0, 2, byte(i)), Mask: net.CIDRMask(32, 32)})
+	}
+
+	err := c.initMembers(vips)
+	if err == nil {
+		t.Fatal("no error reported")
+	}
+	for i, vip := range vips {
+		failed := (i+1)%5 == 0
+		if reported := strings.Contains(err.Error(), vip.IP.String()+": no such address"); reported != failed {
+			t.Errorf("%s: got failure reported %v, want %v", vip.IP, reported, failed)
+		}
+		if built := c.members[i] != nil; built == failed {
+			t.Errorf("%s: got configurer built %v, want %v", vip.IP, built, !failed)
+		}
+		if !c.configs[i].VIP.Equal(vip.IP) {
+			t.Errorf("member %d manages %s, want %s", i, c.configs[i].VIP, vip.IP)
+		}
+	}
+	if maxRunning > maxConcurrentInits || maxRunning < 2 {
+		t.Errorf("got %d configurers created at once, want 2 to %d", maxRunning, maxConcurrentInits)
+	}
+}
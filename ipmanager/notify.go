@@ -0,0 +1,99 @@
+package ipmanager
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// notification is POSTed to notify-url whenever this machine gains or loses the VIP
+type notification struct {
+	Node      string    `json:"node"`
+	VIP       string    `json:"vip"`
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// notifier delivers notifications in the background, in the order of the events.
+// Delivery is retried retry-num times, but never blocks the manager loop:
+// if notifications pile up, e.g. because the webhook hangs, new ones are dropped.
+type notifier struct {
+	url    string
+	client *http.Client
+	config *IPConfiguration
+	queue  chan notification
+}
+
+func newNotifier(config *IPConfiguration) *notifier {
+	if config.NotifyURL == "" {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: config.TLSMinVersion}
+	n := &notifier{
+		url:    config.NotifyURL,
+		client: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		config: config,
+		queue:  make(chan notification, 16),
+	}
+	go n.deliver()
+	return n
+}
+
+// notify queues a notification, a nil notifier does nothing.
+func (n *notifier) notify(gained bool, vip string) {
+	if n == nil {
+		return
+	}
+	event := "lost"
+	if gained {
+		event = "gained"
+	}
+	if n.config.DryRun {
+		slog.Info("Dry run: not sending notification", "event", event, "vip", vip)
+		return
+	}
+	select {
+	case n.queue <- notification{Node: n.config.Nodename, VIP: vip, Event: event, Timestamp: time.Now()}:
+	default:
+		slog.Warn("Dropping notification, as earlier ones are still being delivered", "event", event, "vip", vip)
+	}
+}
+
+// close stops the notifier once the queued notifications were delivered
+func (n *notifier) close() {
+	if n != nil {
+		close(n.queue)
+	}
+}
+
+func (n *notifier) deliver() {
+	for msg := range n.queue {
+		err := retry("Sending notification", n.config.RetryNum, n.config.RetryAfter, func() error {
+			return n.post(msg)
+		})
+		if err != nil {
+			slog.Warn("Couldn't send notification", "event", msg.Event, "vip", msg.VIP, "err", err)
+		}
+	}
+}
+
+func (n *notifier) post(msg notification) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
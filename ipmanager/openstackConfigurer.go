@@ -0,0 +1,532 @@
+package ipmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openStackMetadataURL returns the metadata of the instance it is called from
+const openStackMetadataURL = "http://169.254.169.254/openstack/latest/meta_data.json"
+
+// openStackMaxResponseBytes limits the responses read from the metadata service and the APIs
+const openStackMaxResponseBytes = 1 << 20
+
+// The OpenStackConfigurer can be used to enable vip-management on instances
+// in an OpenStack cloud, where the vip is a floating IP that is associated
+// with the port of an instance through the Neutron API, whenever hosting type
+// `openstack` is set. The router translates the floating IP to the fixed IP
+// of the port, so unlike with Hetzner, it isn't configured in the instance.
+type OpenStackConfigurer struct {
+	*IPConfiguration
+	authURL string
+	client  *http.Client
+
+	// serializes all operations, verifyRelease runs in the background
+	mu sync.Mutex
+
+	// token of the application credential, and the Neutron endpoint from its catalog
+	token       string
+	tokenExpiry time.Time
+	networkURL  string
+
+	instanceID   string // this instance, resolved through the metadata service
+	portID       string // the port of this instance on the interface
+	fixedIP      string // the IPv4 address of the port the floating IP is translated to
+	floatingIPID string // resolved from the vip
+
+	// set after losing leadership, until the new leader took over
+	released bool
+	// why the last association failed, see failureReporter
+	failure error
+}
+
+func newOpenStackConfigurer(config *IPConfiguration) (*OpenStackConfigurer, error) {
+	if config.OpenStackAuthURL == "" || config.OpenStackApplicationCredentialID == "" || config.OpenStackApplicationCredentialSecret == "" {
+		return nil, errors.New("manager-type openstack requires openstack-auth-url and an application credential")
+	}
+	if config.VIP.To4() == nil {
+		return nil, errors.New("manager-type openstack only supports IPv4 floating IPs")
+	}
+	authURL := strings.TrimSuffix(config.OpenStackAuthURL, "/")
+	if !strings.HasSuffix(authURL, "/v3") {
+		authURL += "/v3"
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: config.TLSMinVersion}
+
+	return &OpenStackConfigurer{
+		IPConfiguration: config,
+		authURL:         authURL,
+		client:          &http.Client{Transport: transport},
+	}, nil
+}
+
+// readResponse reads the body of resp, which must be successful.
+// Errors reported by Neutron or Keystone are returned with their message,
+// client errors are permanent, except for an expired token.
+func (c *OpenStackConfigurer) readResponse(resp *http.Response, api string) ([]byte, error) {
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, openStackMaxResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > openStackMaxResponseBytes {
+		return nil, fmt.Errorf("%s response is too large: more than %d bytes", api, openStackMaxResponseBytes)
+	}
+	if resp.StatusCode/100 == 2 {
+		return out, nil
+	}
+
+	message := truncate(string(out), maxLoggedResponseLength)
+	var apiError struct {
+		NeutronError *struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"NeutronError"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(out, &apiError) == nil {
+		if apiError.NeutronError != nil {
+			message = apiError.NeutronError.Type + ": " + apiError.NeutronError.Message
+		} else if apiError.Error != nil {
+			message = apiError.Error.Message
+		}
+	}
+	err = fmt.Errorf("%s returned %s: %s", api, resp.Status, message)
+	if resp.StatusCode == http.StatusUnauthorized {
+		// the token was revoked or expired early, authenticate again
+		c.token = ""
+	} else if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		err = fmt.Errorf("%w: %v", errPermanent, err)
+	}
+	return nil, err
+}
+
+// authenticate returns a token of the application credential, which is renewed
+// shortly before it expires, and looks up the Neutron endpoint in its catalog.
+func (c *OpenStackConfigurer) authenticate(ctx context.Context) (string, error) {
+	if c.token != "" && time.Until(c.tokenExpiry) > time.Minute {
+		return c.token, nil
+	}
+	body := map[string]interface{}{
+		"auth": map[string]interface{}{
+			"identity": map[string]interface{}{
+				"methods": []string{"application_credential"},
+				"application_credential": map[string]string{
+					"id":     c.OpenStackApplicationCredentialID,
+					"secret": c.OpenStackApplicationCredentialSecret,
+				},
+			},
+		},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.authURL+"/auth/tokens", bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	out, err := c.readResponse(resp, "Keystone API")
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		Token struct {
+			ExpiresAt time.Time `json:"expires_at"`
+			Catalog   []struct {
+				Type      string `json:"type"`
+				Endpoints []struct {
+					Interface string `json:"interface"`
+					RegionID  string `json:"region_id"`
+					URL       string `json:"url"`
+				} `json:"endpoints"`
+			} `json:"catalog"`
+		} `json:"token"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return "", fmt.Errorf("unexpected response from the Keystone API: %w", err)
+	}
+	token := resp.Header.Get("X-Subject-Token")
+	if token == "" {
+		return "", errors.New("the Keystone API returned no token")
+	}
+
+	networkURL := ""
+	for _, service := range result.Token.Catalog {
+		if service.Type != "network" {
+			continue
+		}
+		for _, e := range service.Endpoints {
+			if e.Interface == c.OpenStackInterface && (c.Region == "" || e.RegionID == c.Region) {
+				networkURL = strings.TrimSuffix(e.URL, "/")
+				break
+			}
+		}
+	}
+	if networkURL == "" {
+		return "", fmt.Errorf("no %s network endpoint in region %q in the service catalog", c.OpenStackInterface, c.Region)
+	}
+	if !strings.HasSuffix(networkURL, "/v2.0") {
+		networkURL += "/v2.0"
+	}
+	if networkURL != c.networkURL {
+		slog.Info("Using Neutron endpoint", "url", networkURL)
+	}
+	c.networkURL = networkURL
+	c.token = token
+	c.tokenExpiry = result.Token.ExpiresAt
+	return c.token, nil
+}
+
+// request calls the Neutron API and decodes the JSON response into result, if any.
+func (c *OpenStackConfigurer) request(ctx context.Context, method, path string, body interface{}, result interface{}) error {
+	token, err := c.authenticate(ctx)
+	if err != nil {
+		return err
+	}
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.networkURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Auth-Token", token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	out, err := c.readResponse(resp, "Neutron API")
+	if err != nil {
+		return err
+	}
+	if result == nil || len(out) == 0 {
+		return nil
+	}
+	return json.Unmarshal(out, result)
+}
+
+// resolveInstance looks up the ID of this instance, once.
+func (c *OpenStackConfigurer) resolveInstance(ctx context.Context) error {
+	if c.instanceID != "" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, openStackMetadataURL, nil)
+	if err != nil {
+		return err
+	}
+	release, err := acquireMetadataSlot(ctx, "meta_data.json")
+	if err != nil {
+		return err
+	}
+	defer release()
+	// the metadata service must never be reached through a proxy
+	resp, err := (&http.Client{Transport: &http.Transport{}}).Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach the metadata service: %w", err)
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(resp.Body, openStackMaxResponseBytes))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("metadata service returned %s", resp.Status)
+	}
+	var metadata struct {
+		UUID string `json:"uuid"`
+	}
+	if err := json.Unmarshal(out, &metadata); err != nil {
+		return fmt.Errorf("unexpected response from the metadata service: %w", err)
+	}
+	if metadata.UUID == "" {
+		return errors.New("the metadata service returned no instance uuid")
+	}
+	c.instanceID = metadata.UUID
+	slog.Info("This is an OpenStack instance", "instance_id", c.instanceID)
+	return nil
+}
+
+// resolvePort looks up the port of this instance that belongs to the interface,
+// or its only port, once.
+func (c *OpenStackConfigurer) resolvePort(ctx context.Context) error {
+	if c.portID != "" {
+		return nil
+	}
+	if err := c.resolveInstance(ctx); err != nil {
+		return err
+	}
+	var result struct {
+		Ports []struct {
+			ID       string `json:"id"`
+			FixedIPs []struct {
+				IPAddress string `json:"ip_address"`
+			} `json:"fixed_ips"`
+		} `json:"ports"`
+	}
+	if err := c.request(ctx, http.MethodGet, "/ports?device_id="+url.QueryEscape(c.instanceID), nil, &result); err != nil {
+		return err
+	}
+
+	// the addresses of the interface tell the ports apart
+	local := []net.IP{}
+	if addrs, err := c.Iface.Addrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				local = append(local, ipNet.IP)
+			}
+		}
+	}
+	for _, port := range result.Ports {
+		fixedIP := ""
+		onInterface := false
+		for _, f := range port.FixedIPs {
+			ip := net.ParseIP(f.IPAddress)
+			if ip == nil || ip.To4() == nil {
+				continue
+			}
+			if fixedIP == "" {
+				fixedIP = f.IPAddress
+			}
+			for _, l := range local {
+				if sameIP(ip, l) {
+					fixedIP = f.IPAddress
+					onInterface = true
+				}
+			}
+		}
+		if fixedIP != "" && (onInterface || len(result.Ports) == 1) {
+			c.portID = port.ID
+			c.fixedIP = fixedIP
+			slog.Info("Resolved port of this instance", "port_id", c.portID, "fixed_ip", c.fixedIP, "interface", c.Iface.Name)
+			return nil
+		}
+	}
+	return fmt.Errorf("no port of instance %s has an IPv4 address of interface %s", c.instanceID, c.Iface.Name)
+}
+
+// resolveFloatingIP looks up the ID of the floating IP, once.
+func (c *OpenStackConfigurer) resolveFloatingIP(ctx context.Context) error {
+	if c.floatingIPID != "" {
+		return nil
+	}
+	var result struct {
+		FloatingIPs []struct {
+			ID string `json:"id"`
+		} `json:"floatingips"`
+	}
+	if err := c.request(ctx, http.MethodGet, "/floatingips?floating_ip_address="+url.QueryEscape(c.VIP.String()), nil, &result); err != nil {
+		return err
+	}
+	if len(result.FloatingIPs) == 0 {
+		return fmt.Errorf("%w: no floating IP %s in this OpenStack project", errPermanent, c.VIP)
+	}
+	c.floatingIPID = result.FloatingIPs[0].ID
+	slog.Info("Resolved floating IP", "vip", c.VIP, "floating_ip_id", c.floatingIPID)
+	return nil
+}
+
+// resolve looks up everything needed to query or associate the floating IP
+func (c *OpenStackConfigurer) resolve(ctx context.Context) error {
+	if err := c.resolvePort(ctx); err != nil {
+		return err
+	}
+	return c.resolveFloatingIP(ctx)
+}
+
+// associatedPort returns the port the floating IP is associated with, empty if none
+func (c *OpenStackConfigurer) associatedPort(ctx context.Context) (string, error) {
+	var result struct {
+		FloatingIP struct {
+			PortID *string `json:"port_id"`
+		} `json:"floatingip"`
+	}
+	if err := c.request(ctx, http.MethodGet, "/floatingips/"+url.PathEscape(c.floatingIPID), nil, &result); err != nil {
+		return "", err
+	}
+	if result.FloatingIP.PortID == nil {
+		return "", nil
+	}
+	return *result.FloatingIP.PortID, nil
+}
+
+func (c *OpenStackConfigurer) assigned() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.QueryTimeout)*time.Millisecond)
+	defer cancel()
+
+	var port string
+	err := c.retryQuery("Neutron API query", func() error {
+		if err := c.resolve(ctx); err != nil {
+			return err
+		}
+		var err error
+		port, err = c.associatedPort(ctx)
+		return err
+	})
+	return err == nil && port == c.portID, err
+}
+
+// queryAddress returns whether the floating IP is associated with this instance.
+// After deconfigureAddress, it is considered released even while
+// it is still associated with this instance, until another instance took over.
+func (c *OpenStackConfigurer) queryAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assigned, err := c.assigned()
+	if err != nil {
+		slog.Error("Error while querying OpenStack floating IP", "err", err)
+		return false
+	}
+	if !assigned {
+		c.released = false
+	}
+	return assigned && !c.released
+}
+
+// verifyRelease checks whether the floating IP was associated with another instance.
+func (c *OpenStackConfigurer) verifyRelease() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assigned, err := c.assigned()
+	return !assigned, err
+}
+
+// preflight looks up the floating IP without associating it, see Check
+func (c *OpenStackConfigurer) preflight() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.QueryTimeout)*time.Millisecond)
+	defer cancel()
+
+	if err := c.resolve(ctx); err != nil {
+		return "", err
+	}
+	port, err := c.associatedPort(ctx)
+	if err != nil {
+		return "", err
+	}
+	if port == "" {
+		port = "no port"
+	}
+	return fmt.Sprintf("floating IP %s is associated with %s, this instance's port is %s", c.floatingIPID, port, c.portID), nil
+}
+
+// configureAddress associates the floating IP with the port of this instance.
+// Neutron moves it from the previous port right away, so no polling is needed.
+func (c *OpenStackConfigurer) configureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.ConfigureTimeout)*time.Millisecond)
+	defer cancel()
+
+	err := c.retryConfigure("OpenStack floating IP association", func() error {
+		if err := c.resolve(ctx); err != nil {
+			return err
+		}
+		slog.Info("Associating floating IP", "vip", c.VIP, "port_id", c.portID, "fixed_ip", c.fixedIP)
+		var result struct {
+			FloatingIP struct {
+				PortID *string `json:"port_id"`
+			} `json:"floatingip"`
+		}
+		err := c.request(ctx, http.MethodPut, "/floatingips/"+url.PathEscape(c.floatingIPID),
+			map[string]interface{}{"floatingip": map[string]string{"port_id": c.portID, "fixed_ip_address": c.fixedIP}}, &result)
+		if err != nil {
+			return err
+		}
+		if result.FloatingIP.PortID == nil || *result.FloatingIP.PortID != c.portID {
+			return fmt.Errorf("floating IP %s wasn't associated with port %s", c.VIP, c.portID)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Error while associating OpenStack floating IP", "err", err)
+		c.failure = err
+		// resolved again on the next attempt, e.g. after the port was recreated
+		c.portID, c.fixedIP = "", ""
+		return false
+	}
+	c.failure = nil
+	c.released = false
+	return true
+}
+
+// deconfigureAddress does nothing, the floating IP is associated
+// with another instance by the new leader.
+func (c *OpenStackConfigurer) deconfigureAddress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.released = true
+	return true
+}
+
+// describeAction returns the request that would be sent, see dryRunConfigurer
+func (c *OpenStackConfigurer) describeAction(configure bool) string {
+	if !configure {
+		return "nothing, the new leader associates the floating IP with its port"
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return fmt.Sprintf("PUT /floatingips/%s port_id=%s fixed_ip_address=%s", c.floatingIPID, c.portID, c.fixedIP)
+}
+
+func (c *OpenStackConfigurer) lastFailure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failure
+}
+
+func (c *OpenStackConfigurer) cleanupArp() {
+	// Neutron routes the floating IP, no ARP involved.
+}
+
+// labels identifies this instance and the floating IP, once they are resolved
+func (c *OpenStackConfigurer) labels() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l := make(map[string]string)
+	if c.instanceID != "" {
+		l["instance_id"] = c.instanceID
+	}
+	if c.floatingIPID != "" {
+		l["floating_ip_id"] = c.floatingIPID
+	}
+	return l
+}
@@ -0,0 +1,116 @@
+package ipmanager
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// otlpExporter sends a trace span for every configure and deconfigure
+// operation to an OpenTelemetry collector, using OTLP/HTTP with JSON encoding.
+// Exporting happens in the background and never blocks the manager loop.
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func newOTLPExporter(endpoint string, tlsMinVersion uint16) *otlpExporter {
+	if endpoint == "" {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tlsMinVersion}
+	return &otlpExporter{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]string) []otlpAttribute {
+	a := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		attr := otlpAttribute{Key: k}
+		attr.Value.StringValue = v
+		a = append(a, attr)
+	}
+	return a
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// exportSpan sends a single span, a nil exporter does nothing.
+func (e *otlpExporter) exportSpan(name string, start time.Time, success bool, attrs map[string]string) {
+	if e == nil {
+		return
+	}
+	end := time.Now()
+
+	// status codes as defined by OTLP: 1 = ok, 2 = error
+	statusCode := 2
+	if success {
+		statusCode = 1
+	}
+	attrs["result"] = strconv.FormatBool(success)
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{"service.name": "vip-manager"}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "vip-manager"},
+				"spans": []interface{}{map[string]interface{}{
+					"traceId":           randomHex(16),
+					"spanId":            randomHex(8),
+					"name":              name,
+					"kind":              1, // internal
+					"startTimeUnixNano": strconv.FormatInt(start.UnixNano(), 10),
+					"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+					"attributes":        otlpAttributes(attrs),
+					"status":            map[string]int{"code": statusCode},
+				}},
+			}},
+		}},
+	}
+
+	go func() {
+		if err := e.post(payload); err != nil {
+			slog.Warn("Couldn't export span to OpenTelemetry collector", "span", name, "err", err)
+		}
+	}()
+}
+
+func (e *otlpExporter) post(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
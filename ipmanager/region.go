@@ -0,0 +1,44 @@
+package ipmanager
+
+import (
+	"fmt"
+	"sort"
+)
+
+// regionalEndpoints maps each manager type that talks to a provider API
+// to the API host of every region it supports.
+// The empty region selects the default endpoint.
+var regionalEndpoints = map[string]map[string]string{
+	// the robot API has a single, global endpoint
+	"hetzner": {"": "robot-ws.your-server.de"},
+	// so does the cloud API, locations are selected per resource
+	"hetzner_cloud": {"": "api.hetzner.cloud"},
+	// the compute API selects the zone per request
+	"gcp": {"": "compute.googleapis.com"},
+	// records are selected by zone
+	"dns_cloudflare": {"": "api.cloudflare.com"},
+	// elastic IPs are selected by project
+	"equinix": {"": "api.equinix.com"},
+	// resources are selected by subscription and resource group
+	"azure": {"": "management.azure.com"},
+}
+
+// apiEndpoint returns the API host to use for the given manager type and region.
+func apiEndpoint(hostingType string, region string) (string, error) {
+	regions, ok := regionalEndpoints[hostingType]
+	if !ok {
+		return "", fmt.Errorf("manager-type %s does not use a provider API", hostingType)
+	}
+	if endpoint, ok := regions[region]; ok {
+		return endpoint, nil
+	}
+
+	known := []string{}
+	for r := range regions {
+		if r != "" {
+			known = append(known, r)
+		}
+	}
+	sort.Strings(known)
+	return "", fmt.Errorf("unknown region %q for manager-type %s, known regions: %v", region, hostingType, known)
+}
@@ -0,0 +1,29 @@
+package ipmanager
+
+import (
+	"log/slog"
+	"net"
+	"os"
+)
+
+// sdNotify sends state, e.g. READY=1, to systemd when running as a service
+// with Type=notify. It does nothing if NOTIFY_SOCKET isn't set.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// abstract sockets are passed with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Couldn't notify systemd", "state", state, "err", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("Couldn't notify systemd", "state", state, "err", err)
+	}
+}
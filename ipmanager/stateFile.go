@@ -0,0 +1,61 @@
+package ipmanager
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// writeStateFile replaces state-file with the role of this machine and the state
+// of the VIP, if they changed since the last check. The file is written next to
+// state-file and renamed, so readers never see a partial file.
+func (m *IPManager) writeStateFile(s Status) {
+	if m.config.StateFile == "" {
+		return
+	}
+	role := "follower"
+	switch {
+	case !m.stateKnown:
+		role = "unknown"
+	case s.Leader:
+		role = "leader"
+	}
+	content := fmt.Sprintf("role=%s\nvip=%s\nstate=%s\n", role, s.VIP, s.State)
+	if content == m.stateFileContent {
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.config.StateFile), "."+filepath.Base(m.config.StateFile)+".*")
+	if err != nil {
+		slog.Error("Couldn't write the state file", "file", m.config.StateFile, "err", err)
+		return
+	}
+	_, err = tmp.WriteString(content)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), m.config.StateFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		slog.Error("Couldn't write the state file", "file", m.config.StateFile, "err", err)
+		return
+	}
+	m.stateFileContent = content
+}
+
+// removeStateFile removes state-file when vip-manager stops, as it no longer
+// tracks the VIP, even if it was left in place by no-release-on-shutdown.
+func (m *IPManager) removeStateFile() {
+	if m.config.StateFile == "" {
+		return
+	}
+	if err := os.Remove(m.config.StateFile); err != nil && !os.IsNotExist(err) {
+		slog.Error("Couldn't remove the state file", "file", m.config.StateFile, "err", err)
+	}
+}
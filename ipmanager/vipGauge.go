@@ -0,0 +1,85 @@
+package ipmanager
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// VIPGauge is a gauge with a value per virtual IP, labelled with the VIP and
+// its interface on /metrics. Only managed VIPs are set, which bounds the number
+// of series. It is published through expvar and rendered by the main package.
+type VIPGauge struct {
+	mu     sync.Mutex
+	values map[VIPLabels]int64
+}
+
+// VIPLabels identifies the series of a VIPGauge
+type VIPLabels struct {
+	VIP       string
+	Interface string
+}
+
+func newVIPGauge() *VIPGauge {
+	return &VIPGauge{values: map[VIPLabels]int64{}}
+}
+
+// Set sets the value of vip on iface
+func (g *VIPGauge) Set(vip, iface string, v int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[VIPLabels{VIP: vip, Interface: iface}] = v
+}
+
+// Delete removes the series of vip on iface, e.g. once the VIP is no longer managed
+func (g *VIPGauge) Delete(vip, iface string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.values, VIPLabels{VIP: vip, Interface: iface})
+}
+
+// Value returns the value of vip on iface, 0 if it wasn't set
+func (g *VIPGauge) Value(vip, iface string) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[VIPLabels{VIP: vip, Interface: iface}]
+}
+
+// Do calls f for each series, ordered by VIP and interface
+func (g *VIPGauge) Do(f func(VIPLabels, int64)) {
+	g.mu.Lock()
+	labels := make([]VIPLabels, 0, len(g.values))
+	for l := range g.values {
+		labels = append(labels, l)
+	}
+	values := make([]int64, len(labels))
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].VIP != labels[j].VIP {
+			return labels[i].VIP < labels[j].VIP
+		}
+		return labels[i].Interface < labels[j].Interface
+	})
+	for i, l := range labels {
+		values[i] = g.values[l]
+	}
+	g.mu.Unlock()
+
+	for i, l := range labels {
+		f(l, values[i])
+	}
+}
+
+// String implements expvar.Var, as a list of the series
+func (g *VIPGauge) String() string {
+	type series struct {
+		VIP       string `json:"vip"`
+		Interface string `json:"interface,omitempty"`
+		Value     int64  `json:"value"`
+	}
+	out := []series{}
+	g.Do(func(l VIPLabels, v int64) {
+		out = append(out, series{l.VIP, l.Interface, v})
+	})
+	b, _ := json.Marshal(out)
+	return string(b)
+}
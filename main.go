@@ -3,14 +3,20 @@ package main
 import (
 	"context"
 	"fmt"
+	"hash/fnv"
 
 	// "flag"
 
+	"io"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/cybertec-postgresql/vip-manager/checker"
 	"github.com/cybertec-postgresql/vip-manager/ipmanager"
@@ -18,80 +24,419 @@ import (
 )
 
 var (
-	// vip-manager version definition
-	version string = "1.0.1"
+	// vip-manager version definition, set by the Makefile with -ldflags -X
+	version   string = "1.0.1"
+	commit    string = "unknown"
+	buildDate string = "unknown"
 )
 
-func getMask(vip net.IP, mask int) net.IPMask {
-	if mask > 0 || mask < 33 {
-		return net.CIDRMask(mask, 32)
+// versionString identifies the build, for --version and the log
+func versionString() string {
+	return fmt.Sprintf("vip-manager %s (commit %s, built %s)", version, commit, buildDate)
+}
+
+// versionRequested checks the arguments for --version before the configuration
+// is read, so that it works without a valid configuration
+func versionRequested(args []string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--version" || arg == "--version=true" {
+			return true
+		}
+	}
+	return false
+}
+
+// startupStagger returns how long this node delays its first checks, derived from
+// its position in expected-peers. A node that isn't listed is placed by a hash of its name,
+// so the offset is still the same on every start.
+func startupStagger(nodename string, peers []string, step int) time.Duration {
+	if len(peers) == 0 {
+		return 0
+	}
+	position := -1
+	for i, p := range peers {
+		if strings.TrimSpace(p) == nodename {
+			position = i
+			break
+		}
+	}
+	if position < 0 {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(nodename))
+		position = int(h.Sum32() % uint32(len(peers)))
+		slog.Info("Not in expected-peers, using a position derived from the name", "trigger_value", nodename, "position", position)
+	}
+	return time.Duration(position*step) * time.Millisecond
+}
+
+func getNetIface(iface string, waitTimeout int) *net.Interface {
+	deadline := time.Now().Add(time.Duration(waitTimeout) * time.Millisecond)
+	for {
+		netIface, err := net.InterfaceByName(iface)
+		if err == nil && netIface.Flags&net.FlagUp != 0 {
+			return netIface
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				fatal("Obtaining the interface raised an error", "interface", iface, "err", err)
+			}
+			if waitTimeout > 0 {
+				fatal("Interface is not up after waiting", "interface", iface, "wait_ms", waitTimeout)
+			}
+			// without waiting, keep the previous behavior and use the interface anyway
+			return netIface
+		}
+		slog.Info("Waiting for interface to come up", "interface", iface)
+		time.Sleep(time.Second)
 	}
-	return vip.DefaultMask()
 }
 
-func getNetIface(iface string) *net.Interface {
-	netIface, err := net.InterfaceByName(iface)
+// reloadableSettings can be changed on SIGHUP, see ipmanager.IPManager.Reload.
+// interval isn't one of them: the leader checkers are set up with it at startup,
+// e.g. as the timeout of the patroni client and the retry period of the kubernetes lease.
+var reloadableSettings = map[string]bool{
+	"verbose":                        true,
+	"log-level":                      true,
+	"log-format":                     true,
+	"retry-num":                      true,
+	"retry-after":                    true,
+	"query-retries":                  true,
+	"query-retry-after":              true,
+	"configure-retries":              true,
+	"configure-retry-after":          true,
+	"deconfigure-retries":            true,
+	"deconfigure-retry-after":        true,
+	"verify-release-after":           true,
+	"drift-correction-backoff":       true,
+	"max-unconfigured-leader-time":   true,
+	"hetzner-cache-ttl":              true,
+	"hetzner-post-configure-backoff": true,
+	"pre-configure-hook":             true,
+	"on-gain-hook":                   true,
+	"on-loss-hook":                   true,
+	"hook-timeout":                   true,
+	"fence-command":                  true,
+	"fence-timeout":                  true,
+	"start-command":                  true,
+	"stop-command":                   true,
+	"notify-url":                     true,
+}
+
+// reloadConfig reads the config file again and applies the reloadableSettings,
+// keeping the state of the virtual IP. Changes to other settings are only logged.
+// conf is the configuration loaded last and is replaced by the new one, so it
+// must not be the one the leader checker reads.
+func reloadConfig(conf *vipconfig.Config, manager *ipmanager.IPManager, logOutput io.Writer) {
+	newConf, err := vipconfig.ReloadConfig()
+	if err == nil {
+		err = newConf.Validate()
+	}
 	if err != nil {
-		log.Fatalf("Obtaining the interface raised an error: %s", err)
+		slog.Error("Couldn't reload the configuration, keeping the current one", "err", err)
+		return
+	}
+	// an interface that wasn't set was detected at startup
+	if newConf.Iface == "" {
+		newConf.Iface = conf.Iface
+	}
+	for _, name := range conf.Changed(newConf) {
+		if !reloadableSettings[name] {
+			slog.Warn("Setting was changed, but only takes effect after a restart", "setting", name)
+		}
+	}
+
+	slog.SetDefault(newConf.NewLogger(logOutput))
+	manager.Reload(&ipmanager.IPConfiguration{
+		RetryNum:   newConf.RetryNum,
+		RetryAfter: newConf.RetryAfter,
+
+		QueryRetries:          newConf.QueryRetries,
+		QueryRetryAfter:       newConf.QueryRetryAfter,
+		ConfigureRetries:      newConf.ConfigureRetries,
+		ConfigureRetryAfter:   newConf.ConfigureRetryAfter,
+		DeconfigureRetries:    newConf.DeconfigureRetries,
+		DeconfigureRetryAfter: newConf.DeconfigureRetryAfter,
+
+		VerifyReleaseAfter:        newConf.VerifyReleaseAfter,
+		DriftCorrectionBackoff:    newConf.DriftCorrectionBackoff,
+		MaxUnconfiguredLeaderTime: newConf.MaxUnconfiguredLeaderTime,
+
+		HetznerCacheTTL:             newConf.HetznerCacheTTL,
+		HetznerPostConfigureBackoff: newConf.HetznerPostConfigureBackoff,
+
+		PreConfigureHook: newConf.PreConfigureHook,
+		OnGainHook:       newConf.OnGainHook,
+		OnLossHook:       newConf.OnLossHook,
+		HookTimeout:      newConf.HookTimeout,
+		FenceCommand:     newConf.FenceCommand,
+		FenceTimeout:     newConf.FenceTimeout,
+		StartCommand:     newConf.StartCommand,
+		StopCommand:      newConf.StopCommand,
+		NotifyURL:        newConf.NotifyURL,
+	})
+	*conf = *newConf
+}
+
+// newIPConfiguration returns the configuration of the ipmanager for the vips on iface
+func newIPConfiguration(conf *vipconfig.Config, vips []net.IPNet, iface net.Interface) *ipmanager.IPConfiguration {
+	// validated by NewConfig
+	tlsMinVersion, _ := vipconfig.ParseTLSVersion(conf.TLSMinVersion)
+
+	// validated by Config.Validate
+	arpSourceMAC, _ := net.ParseMAC(conf.ArpSourceMAC)
+	var arpTargets []net.IP
+	for _, t := range conf.ArpTargets {
+		arpTargets = append(arpTargets, net.ParseIP(t))
+	}
+
+	return &ipmanager.IPConfiguration{
+		VIP:            vips[0].IP,
+		Netmask:        vips[0].Mask,
+		Iface:          iface,
+		AdditionalVIPs: vips[1:],
+		VIPListKey:     conf.VIPListKey,
+
+		VIPName:       conf.VIPName,
+		AliasTemplate: conf.AliasTemplate,
+		SkipDAD:       conf.SkipDAD,
+		NoPrefixRoute: conf.NoPrefixRoute,
+		RoutingTable:  conf.RoutingTable,
+		RouteMetric:   conf.RouteMetric,
+
+		HostAddressCheck: conf.HostAddressCheck,
+		OnInterfaceGone:  conf.OnInterfaceGone,
+
+		RetryNum:   conf.RetryNum,
+		RetryAfter: conf.RetryAfter,
+
+		QueryRetries:          conf.QueryRetries,
+		QueryRetryAfter:       conf.QueryRetryAfter,
+		ConfigureRetries:      conf.ConfigureRetries,
+		ConfigureRetryAfter:   conf.ConfigureRetryAfter,
+		DeconfigureRetries:    conf.DeconfigureRetries,
+		DeconfigureRetryAfter: conf.DeconfigureRetryAfter,
+
+		OutboundIPRetries:           conf.OutboundIPRetries,
+		StrictSourceCheck:           conf.StrictSourceCheck,
+		RequireUpInterfaceForSource: conf.RequireUpInterfaceForSource,
+		PreferInterfaceAddress:      conf.PreferInterfaceAddress,
+		HetznerOutboundProbe:        conf.HetznerOutboundProbe,
+		HetznerActiveServerIP:       net.ParseIP(conf.HetznerActiveServerIP),
+		HetznerServerNumber:         conf.HetznerServerNumber,
+
+		QueryTimeout:     conf.QueryTimeout,
+		ConfigureTimeout: conf.ConfigureTimeout,
+		RecheckInterval:  conf.RecheckInterval,
+		MaxOpsPerTick:    conf.MaxOpsPerTick,
+
+		ArpTargets:          arpTargets,
+		ArpAnnounceFrom:     conf.ArpAnnounceFrom,
+		ArpInterface:        conf.ArpInterface,
+		ArpSourceMAC:        arpSourceMAC,
+		ArpRefreshInterval:  conf.ArpRefreshInterval,
+		ArpRepeatCount:      conf.ArpRepeatCount,
+		ArpRepeatInterval:   conf.ArpRepeatInterval,
+		MinArpBurstInterval: conf.MinArpBurstInterval,
+
+		GratuitousArp:       conf.GratuitousArp,
+		VerifyArpCapability: conf.VerifyArpCapability,
+		VerifyArpSent:       conf.VerifyArpSent,
+
+		ReleaseGraceWindow:        conf.ReleaseGraceWindow,
+		VerifyReleaseAfter:        conf.VerifyReleaseAfter,
+		FailFastOnConfigureError:  conf.FailFastOnConfigureError,
+		NoReleaseOnShutdown:       conf.NoReleaseOnShutdown,
+		DryRun:                    conf.DryRun,
+		DriftCorrectionBackoff:    conf.DriftCorrectionBackoff,
+		SplitBrainCheckInterval:   conf.SplitBrainCheckInterval,
+		MaxUnconfiguredLeaderTime: conf.MaxUnconfiguredLeaderTime,
+
+		LogSampleEvery: conf.LogSampleEvery,
+		OTLPEndpoint:   conf.OTLPEndpoint,
+		DeadLetterFile: conf.DeadLetterFile,
+		StateFile:      conf.StateFile,
+
+		TLSMinVersion: tlsMinVersion,
+
+		Region:              conf.Region,
+		MetadataConcurrency: conf.MetadataConcurrency,
+
+		HetznerIPVersion:            conf.HetznerIPVersion,
+		HetznerPostConfigureBackoff: conf.HetznerPostConfigureBackoff,
+		HetznerCacheTTL:             conf.HetznerCacheTTL,
+		SkipConfigureWhenActive:     conf.SkipConfigureWhenActive,
+		HetznerAdoptOnStartup:       conf.HetznerAdoptOnStartup,
+		HetznerBindLocal:            conf.HetznerBindLocal,
+		HetznerOnIPNotFound:         conf.HetznerOnIPNotFound,
+
+		HetznerUser:         conf.HetznerUser,
+		HetznerPassword:     conf.HetznerPassword,
+		HetznerUserFile:     conf.HetznerUserFile,
+		HetznerPasswordFile: conf.HetznerPasswordFile,
+
+		HetznerCloudToken:        conf.HetznerCloudToken,
+		HetznerCloudFloatingIPID: conf.HetznerCloudFloatingIPID,
+
+		CloudflareAPIToken:   conf.CloudflareAPIToken,
+		CloudflareZoneID:     conf.CloudflareZoneID,
+		CloudflareRecordName: conf.CloudflareRecordName,
+		CloudflareRecordTTL:  conf.CloudflareRecordTTL,
+
+		EquinixAPIToken:  conf.EquinixAPIToken,
+		EquinixProjectID: conf.EquinixProjectID,
+
+		AzureIPConfigurationName: conf.AzureIPConfigurationName,
+		AzureClientID:            conf.AzureClientID,
+
+		OpenStackAuthURL:                     conf.OpenStackAuthURL,
+		OpenStackApplicationCredentialID:     conf.OpenStackApplicationCredentialID,
+		OpenStackApplicationCredentialSecret: conf.OpenStackApplicationCredentialSecret,
+		OpenStackInterface:                   conf.OpenStackInterface,
+
+		GCPNetworkInterface: conf.GCPNetworkInterface,
+
+		HetznerDNSCacheTTL:      conf.HetznerDNSCacheTTL,
+		HetznerAPIHistorySize:   conf.HetznerAPIHistorySize,
+		HetznerMaxResponseBytes: conf.HetznerMaxResponseBytes,
+		HetznerAPIURL:           conf.HetznerAPIURL,
+
+		PreConfigureHook: conf.PreConfigureHook,
+		OnGainHook:       conf.OnGainHook,
+		OnLossHook:       conf.OnLossHook,
+		HookTimeout:      conf.HookTimeout,
+		FenceCommand:     conf.FenceCommand,
+		FenceTimeout:     conf.FenceTimeout,
+		StartCommand:     conf.StartCommand,
+		StopCommand:      conf.StopCommand,
+
+		NotifyURL: conf.NotifyURL,
+		Nodename:  conf.Nodename,
+		UserAgent: fmt.Sprintf("vip-manager/%s (%s)", version, conf.Nodename),
+
+		ConnectivityCanary:        conf.ConnectivityCanary,
+		ConnectivityCanaryMethod:  conf.ConnectivityCanaryMethod,
+		ConnectivityCanaryTimeout: conf.ConnectivityCanaryTimeout,
+
+		HealthCheckCommand:    conf.HealthCheckCommand,
+		HealthCheckURL:        conf.HealthCheckURL,
+		HealthCheckMinHealthy: conf.HealthCheckMinHealthy,
 	}
-	return netIface
+}
+
+// fatal logs msg at error level and exits
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
 func main() {
-	if (len(os.Args) > 1) && (os.Args[1] == "--version") {
-		//			log.Print("version " + version)
-		//			return nil, nil
-		//		}
-		fmt.Printf("version: %s\n", version)
+	// scrub passwords and tokens from everything that is logged
+	logOutput := vipconfig.NewSanitizingWriter(os.Stderr)
+	log.SetOutput(logOutput)
+
+	if versionRequested(os.Args[1:]) {
+		fmt.Println(versionString())
 		return
 	}
 
+	// `vip-manager check --config=...` only verifies the configuration, see runCheck
+	checkOnly := len(os.Args) > 1 && os.Args[1] == "check"
+	if checkOnly {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	conf, err := vipconfig.NewConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
+	// from here on, everything is logged through slog, including the output of the log package
+	slog.SetDefault(conf.NewLogger(logOutput))
+	if err = conf.Validate(); err != nil {
+		fatal(err.Error())
+	}
+
+	if checkOnly {
+		os.Exit(runCheck(conf))
+	}
+
+	slog.Info("Starting "+versionString(), "version", version, "commit", commit, "build_date", buildDate)
+	slog.Info("Using TLS for HTTPS connections", "min_version", conf.TLSMinVersion)
 
 	lc, err := checker.NewLeaderChecker(conf)
 	if err != nil {
-		log.Fatalf("Failed to initialize leader checker: %s", err)
+		fatal("Failed to initialize leader checker", "err", err)
 	}
 
-	vip := net.ParseIP(conf.IP)
-	vipMask := getMask(vip, conf.Mask)
-	netIface := getNetIface(conf.Iface)
+	// checked by Config.Validate
+	vips, _ := conf.VIPs()
+	if conf.Iface == "" {
+		iface, err := ipmanager.DetectInterface(vips[0].IP, conf.InterfaceTieBreak, conf.InterfaceNamePattern)
+		if err != nil {
+			fatal("No interface is set and it can't be detected, set interface", "err", err)
+		}
+		slog.Info("No interface is set, using the interface of the route to the virtual ip", "interface", iface, "vip", vips[0].IP)
+		conf.Iface = iface
+	}
+	netIface := getNetIface(conf.Iface, conf.InterfaceWaitTimeout)
 	states := make(chan bool)
-	manager, err := ipmanager.NewIPManager(
-		conf.HostingType,
-		&ipmanager.IPConfiguration{
-			VIP:        vip,
-			Netmask:    vipMask,
-			Iface:      *netIface,
-			RetryNum:   conf.RetryNum,
-			RetryAfter: conf.RetryAfter,
-		},
-		states,
-		conf.Verbose,
-	)
+	manager, err := ipmanager.NewIPManager(conf.HostingType, newIPConfiguration(conf, vips, *netIface), states)
 	if err != nil {
-		log.Fatalf("Problems with generating the virtual ip manager: %s", err)
+		fatal("Problems with generating the virtual ip manager", "err", err)
+	}
+
+	if conf.VIPListKey != "" {
+		// checked by Config.Validate, etcd and consul can read any key
+		reader := lc.(checker.KeyReader)
+		manager.WatchVIPList(func(ctx context.Context) (string, error) {
+			return reader.ReadKey(ctx, conf.VIPListKey)
+		})
+	}
+
+	if conf.HTTPListenAddress != "" {
+		serveHTTP(conf.HTTPListenAddress, conf.HTTPAuthToken, manager)
+	}
+	if conf.PrometheusEndpoint != "" {
+		servePrometheus(conf.PrometheusEndpoint, conf.HTTPAuthToken)
 	}
 
 	mainCtx, cancel := context.WithCancel(context.Background())
 
 	go func() {
 		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 		<-c
-		log.Print("Received exit signal")
+		slog.Info("Received exit signal")
 		cancel()
 	}()
 
+	// the leader checker keeps reading conf, so the reloads are compared to a copy
+	loaded := *conf
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			slog.Info("Received SIGHUP, reloading the configuration")
+			reloadConfig(&loaded, manager, logOutput)
+		}
+	}()
+
+	if stagger := startupStagger(conf.Nodename, conf.ExpectedPeers, conf.StartupStaggerStep); stagger > 0 {
+		slog.Info("Delaying the first checks as startup stagger", "stagger", stagger)
+		select {
+		case <-time.After(stagger):
+		case <-mainCtx.Done():
+		}
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		err := lc.GetChangeNotificationStream(mainCtx, states)
 		if err != nil && err != context.Canceled {
-			log.Fatalf("Leader checker returned the following error: %s", err)
+			fatal("Leader checker returned an error", "err", err)
 		}
 		wg.Done()
 	}()
@@ -102,5 +447,31 @@ func main() {
 		wg.Done()
 	}()
 
+	if conf.PrimaryCheckDSN != "" {
+		pc := checker.NewPrimaryChecker(conf)
+		wg.Add(1)
+		go func() {
+			pc.Run(mainCtx)
+			wg.Done()
+		}()
+	}
+
 	wg.Wait()
+
+	if conf.WriteDepartureMarker {
+		if dm, ok := lc.(checker.DepartureMarker); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := dm.WriteDepartureMarker(ctx); err != nil {
+				slog.Warn("Couldn't write departure marker", "err", err)
+			} else {
+				slog.Info("Wrote departure marker", "key", conf.DepartureMarkerPrefix+conf.Nodename)
+			}
+			cancel()
+		}
+	}
+
+	if conf.ShutdownDrainDelay > 0 && !conf.NoReleaseOnShutdown {
+		slog.Info("Waiting for connections to drain before exiting", "delay_ms", conf.ShutdownDrainDelay)
+		time.Sleep(time.Duration(conf.ShutdownDrainDelay) * time.Millisecond)
+	}
 }
@@ -3,8 +3,12 @@ package vipconfig
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 
@@ -14,17 +18,46 @@ import (
 
 // Config represents the configuration of the VIP manager
 type Config struct {
-	IP    string `mapstructure:"ip"`
-	Mask  int    `mapstructure:"netmask"`
-	Iface string `mapstructure:"interface"`
+	IP                   string `mapstructure:"ip"`
+	Mask                 int    `mapstructure:"netmask"`
+	Iface                string `mapstructure:"interface"`
+	InterfaceTieBreak    string `mapstructure:"interface-tie-break"`
+	InterfaceNamePattern string `mapstructure:"interface-name-pattern"`
+	InterfaceWaitTimeout int    `mapstructure:"interface-wait-timeout"` //milliseconds
+	HostAddressCheck     string `mapstructure:"host-address-check"`
+	OnInterfaceGone      string `mapstructure:"on-interface-gone"`
+
+	VIPName       string `mapstructure:"vip-name"`
+	AliasTemplate string `mapstructure:"alias-template"`
+	SkipDAD       bool   `mapstructure:"skip-dad"`
+	NoPrefixRoute bool   `mapstructure:"no-prefix-route"`
+	RoutingTable  int    `mapstructure:"routing-table"`
+	RouteMetric   int    `mapstructure:"route-metric"`
 
 	HostingType string `mapstructure:"manager-type"`
 
+	ArpTargets          []string `mapstructure:"arp-targets"`
+	ArpAnnounceFrom     string   `mapstructure:"arp-announce-from"`
+	ArpInterface        string   `mapstructure:"arp-interface"`
+	ArpSourceMAC        string   `mapstructure:"arp-source-mac"`
+	ArpRefreshInterval  int      `mapstructure:"arp-refresh-interval"` //milliseconds
+	ArpRepeatCount      int      `mapstructure:"arp-repeat-count"`
+	ArpRepeatInterval   int      `mapstructure:"arp-repeat-interval"`    //milliseconds
+	MinArpBurstInterval int      `mapstructure:"min-arp-burst-interval"` //milliseconds
+
+	GratuitousArp       bool `mapstructure:"gratuitous-arp"`
+	VerifyArpCapability bool `mapstructure:"verify-arp-capability"`
+	VerifyArpSent       bool `mapstructure:"verify-arp-sent"`
+
 	Key      string `mapstructure:"trigger-key"`
 	Nodename string `mapstructure:"trigger-value"` //hostname to trigger on. usually the name of the host where this vip-manager runs.
+	// further VIPs, read from the DCS while this machine is the leader
+	VIPListKey string `mapstructure:"vip-list-key"`
 
 	EndpointType string   `mapstructure:"dcs-type"`
 	Endpoints    []string `mapstructure:"dcs-endpoints"`
+	// only used if none of the dcs-endpoints can be reached
+	FallbackEndpoints []string `mapstructure:"dcs-fallback-endpoints"`
 
 	EtcdUser     string `mapstructure:"etcd-user"`
 	EtcdPassword string `mapstructure:"etcd-password"`
@@ -32,32 +65,184 @@ type Config struct {
 	EtcdCertFile string `mapstructure:"etcd-cert-file"`
 	EtcdKeyFile  string `mapstructure:"etcd-key-file"`
 
-	ConsulToken string `mapstructure:"consul-token"`
+	ConsulToken    string `mapstructure:"consul-token"`
+	ConsulCAFile   string `mapstructure:"consul-ca-file"`
+	ConsulCertFile string `mapstructure:"consul-cert-file"`
+	ConsulKeyFile  string `mapstructure:"consul-key-file"`
+
+	KubernetesNamespace     string `mapstructure:"kubernetes-namespace"`
+	KubernetesLeaseDuration int    `mapstructure:"kubernetes-lease-duration"` //milliseconds
+
+	TLSMinVersion           string `mapstructure:"tls-min-version"`
+	TLSAllowInsecureVersion bool   `mapstructure:"tls-allow-insecure-version"`
+
+	WriteDepartureMarker  bool   `mapstructure:"write-departure-marker"`
+	DepartureMarkerPrefix string `mapstructure:"departure-marker-prefix"`
+	DepartureMarkerTTL    int    `mapstructure:"departure-marker-ttl"` //seconds
+
+	ConsensusReadConsistency string `mapstructure:"dcs-read-consistency"`
+	OnKeyDelete              string `mapstructure:"on-key-delete"`
+	OnInvalidLeaderValue     string `mapstructure:"on-invalid-leader-value"`
+	MinLeaseTTL              int    `mapstructure:"min-lease-ttl"` //seconds
+	InitialReadRetries       int    `mapstructure:"initial-read-retries"`
+	InitialReadRetryAfter    int    `mapstructure:"initial-read-retry-after"` //milliseconds
+
+	ExpectedPeers      []string `mapstructure:"expected-peers"`
+	StartupStaggerStep int      `mapstructure:"startup-stagger-step"` //milliseconds
 
-	Interval int `mapstructure:"interval"` //milliseconds
+	Interval        int `mapstructure:"interval"`         //milliseconds
+	DCSMaxBackoff   int `mapstructure:"dcs-max-backoff"`  //milliseconds
+	RecheckInterval int `mapstructure:"recheck-interval"` //milliseconds
+	// bounds the operations on the VIPs per check, 0 is unlimited
+	MaxOpsPerTick int `mapstructure:"max-ops-per-tick"`
+
+	DCSDialTimeout    int `mapstructure:"dcs-dial-timeout"`    //milliseconds
+	DCSRequestTimeout int `mapstructure:"dcs-request-timeout"` //milliseconds
 
 	RetryAfter int `mapstructure:"retry-after"` //milliseconds
 	RetryNum   int `mapstructure:"retry-num"`
 
-	Verbose bool `mapstructure:"verbose"`
+	QueryRetries          int `mapstructure:"query-retries"`
+	QueryRetryAfter       int `mapstructure:"query-retry-after"` //milliseconds
+	ConfigureRetries      int `mapstructure:"configure-retries"`
+	ConfigureRetryAfter   int `mapstructure:"configure-retry-after"` //milliseconds
+	DeconfigureRetries    int `mapstructure:"deconfigure-retries"`
+	DeconfigureRetryAfter int `mapstructure:"deconfigure-retry-after"` //milliseconds
+
+	ReleaseGraceWindow int `mapstructure:"release-grace-window"` //milliseconds
+	VerifyReleaseAfter int `mapstructure:"verify-release-after"` //milliseconds
+
+	FailFastOnConfigureError  bool `mapstructure:"fail-fast-on-configure-error"`
+	NoReleaseOnShutdown       bool `mapstructure:"no-release-on-shutdown"`
+	DryRun                    bool `mapstructure:"dry-run"`
+	ShutdownDrainDelay        int  `mapstructure:"shutdown-drain-delay"`         //milliseconds
+	DriftCorrectionBackoff    int  `mapstructure:"drift-correction-backoff"`     //milliseconds
+	SplitBrainCheckInterval   int  `mapstructure:"split-brain-check-interval"`   //milliseconds
+	MaxUnconfiguredLeaderTime int  `mapstructure:"max-unconfigured-leader-time"` //milliseconds
+
+	QueryTimeout     int `mapstructure:"query-timeout"`     //milliseconds
+	ConfigureTimeout int `mapstructure:"configure-timeout"` //milliseconds
+
+	Verbose   bool   `mapstructure:"verbose"`
+	LogLevel  string `mapstructure:"log-level"`
+	LogFormat string `mapstructure:"log-format"`
+
+	HTTPListenAddress  string `mapstructure:"http-listen-address"`
+	HTTPAuthToken      string `mapstructure:"http-auth-token"`
+	PrometheusEndpoint string `mapstructure:"prometheus-endpoint"`
+
+	PrimaryCheckDSN      string `mapstructure:"primary-check-dsn"`
+	PrimaryCheckInterval int    `mapstructure:"primary-check-interval"` //milliseconds
+	OTLPEndpoint         string `mapstructure:"otlp-endpoint"`
+	DeadLetterFile       string `mapstructure:"dead-letter-file"`
+	StateFile            string `mapstructure:"state-file"`
+
+	LogSampleEvery int `mapstructure:"log-sample-every"`
+
+	Region              string `mapstructure:"region"`
+	MetadataConcurrency int    `mapstructure:"metadata-concurrency"`
+
+	HetznerIPVersion            string `mapstructure:"hetzner-ip-version"`
+	OutboundIPRetries           int    `mapstructure:"outbound-ip-retries"`
+	StrictSourceCheck           bool   `mapstructure:"strict-source-check"`
+	RequireUpInterfaceForSource bool   `mapstructure:"require-up-interface-for-source"`
+	PreferInterfaceAddress      bool   `mapstructure:"prefer-interface-address"`
+	HetznerOutboundProbe        string `mapstructure:"hetzner-outbound-probe"`
+	HetznerActiveServerIP       string `mapstructure:"hetzner-active-server-ip"`
+	HetznerServerNumber         int    `mapstructure:"hetzner-server-number"`
+	HetznerPostConfigureBackoff int    `mapstructure:"hetzner-post-configure-backoff"` //milliseconds
+	HetznerCacheTTL             int    `mapstructure:"hetzner-cache-ttl"`              //milliseconds
+	SkipConfigureWhenActive     bool   `mapstructure:"skip-configure-when-active"`
+	HetznerAdoptOnStartup       bool   `mapstructure:"hetzner-adopt-on-startup"`
+	HetznerBindLocal            bool   `mapstructure:"hetzner-bind-local"`
+	HetznerOnIPNotFound         string `mapstructure:"hetzner-on-ip-not-found"`
+
+	HetznerUser         string `mapstructure:"hetzner-user"`
+	HetznerPassword     string `mapstructure:"hetzner-password"`
+	HetznerUserFile     string `mapstructure:"hetzner-user-file"`
+	HetznerPasswordFile string `mapstructure:"hetzner-password-file"`
+
+	HetznerCloudToken        string `mapstructure:"hetzner-cloud-token"`
+	HetznerCloudFloatingIPID int64  `mapstructure:"hetzner-cloud-floating-ip-id"`
+
+	GCPNetworkInterface string `mapstructure:"gcp-network-interface"`
+
+	CloudflareAPIToken   string `mapstructure:"cloudflare-api-token"`
+	CloudflareZoneID     string `mapstructure:"cloudflare-zone-id"`
+	CloudflareRecordName string `mapstructure:"cloudflare-record-name"`
+	CloudflareRecordTTL  int    `mapstructure:"cloudflare-record-ttl"` //seconds
+
+	EquinixAPIToken  string `mapstructure:"equinix-api-token"`
+	EquinixProjectID string `mapstructure:"equinix-project-id"`
+
+	AzureIPConfigurationName string `mapstructure:"azure-ip-configuration-name"`
+	AzureClientID            string `mapstructure:"azure-client-id"`
+
+	OpenStackCloud                       string `mapstructure:"openstack-cloud"`
+	OpenStackAuthURL                     string `mapstructure:"openstack-auth-url"`
+	OpenStackApplicationCredentialID     string `mapstructure:"openstack-application-credential-id"`
+	OpenStackApplicationCredentialSecret string `mapstructure:"openstack-application-credential-secret"`
+	OpenStackInterface                   string `mapstructure:"openstack-interface"`
+
+	HetznerDNSCacheTTL      int `mapstructure:"hetzner-dns-cache-ttl"` //milliseconds
+	HetznerAPIHistorySize   int `mapstructure:"hetzner-api-history-size"`
+	HetznerMaxResponseBytes int `mapstructure:"hetzner-max-response-bytes"`
+	// empty for the default endpoint of region
+	HetznerAPIURL string `mapstructure:"hetzner-api-url"`
+
+	PreConfigureHook string `mapstructure:"pre-configure-hook"`
+	OnGainHook       string `mapstructure:"on-gain-hook"`
+	OnLossHook       string `mapstructure:"on-loss-hook"`
+	HookTimeout      int    `mapstructure:"hook-timeout"` //milliseconds
+	FenceCommand     string `mapstructure:"fence-command"`
+	FenceTimeout     int    `mapstructure:"fence-timeout"` //milliseconds
+	StartCommand     string `mapstructure:"start-command"`
+	StopCommand      string `mapstructure:"stop-command"`
+	NotifyURL        string `mapstructure:"notify-url"`
+
+	ConnectivityCanary        string `mapstructure:"connectivity-canary"`
+	ConnectivityCanaryMethod  string `mapstructure:"connectivity-canary-method"`
+	ConnectivityCanaryTimeout int    `mapstructure:"connectivity-canary-timeout"` //milliseconds
+
+	HealthCheckCommand    string `mapstructure:"health-check-command"`
+	HealthCheckURL        string `mapstructure:"health-check-url"`
+	HealthCheckMinHealthy int    `mapstructure:"health-check-min-healthy"` //milliseconds
 }
 
 func defineFlags() {
 	// When adding new flags here, consider adding them to the Config struct above
 	// and then make sure to insert them into the conf instance in NewConfig down below.
 	pflag.String("config", "", "Location of the configuration file.")
-	pflag.Bool("version", false, "Show the version number.")
+	pflag.Bool("version", false, "Show the version number, git commit and build date, and exit.")
 
-	pflag.String("ip", "", "Virtual IP address to configure.")
+	pflag.String("ip", "", "Virtual IP address to configure. Several can be separated by commas, each with an optional /prefix that overrides netmask.")
 	pflag.String("netmask", "", "The netmask used for the IP address. Defaults to -1 which assigns ipv4 default mask.")
-	pflag.String("interface", "", "Network interface to configure on .")
+	pflag.String("interface", "", "Network interface to configure on. Detected from the route to the virtual IP if empty.")
+	pflag.String("interface-tie-break", "error", "What to do if no interface is set and several have an equally specific route to the virtual IP. Supported values: error, address (prefer the one with an address in the subnet), name (prefer the one matching interface-name-pattern).")
+	pflag.String("interface-name-pattern", "", "Shell pattern for the interface preferred with interface-tie-break=name, e.g. 'eth*'.")
+	pflag.String("on-interface-gone", "wait", "What to do when the interface disappears while running. Supported values: wait, fatal. Not used for manager-type=hetzner and hetzner_cloud.")
+	pflag.String("host-address-check", "error", "What to do when the virtual IP seems to be the host's own address on the interface. Supported values: error, warn. Only used for manager-type=basic.")
+	pflag.String("arp-refresh-interval", "0", "Time in milliseconds between repeated gratuitous ARP messages while this machine holds the virtual IP, 0 disables it.")
+	pflag.Bool("gratuitous-arp", true, "Announce the virtual IP through gratuitous ARP (unsolicited neighbor advertisements for IPv6) after configuring it. Only used for manager-type=basic.")
+	pflag.String("arp-repeat-count", "1", "Number of gratuitous ARP announcements sent after configuring the virtual IP.")
+	pflag.String("arp-repeat-interval", "1000", "Time in milliseconds between the gratuitous ARP announcements sent after configuring the virtual IP.")
+	pflag.String("min-arp-burst-interval", "0", "Minimum time in milliseconds between two rounds of gratuitous ARP announcements, later ones are suppressed. Disabled if 0.")
+	pflag.String("interface-wait-timeout", "0", "Time in milliseconds to wait at startup for the interface to exist and be up. Don't wait if 0.")
+	pflag.String("vip-name", "", "Short name of the virtual IP, available as {{.VIPName}} in alias-template.")
+	pflag.Bool("no-prefix-route", false, "Add the virtual IP without a route for its subnet, leaving routing to the interface's own addresses. Only used for manager-type=basic.")
+	pflag.String("routing-table", "0", "Routing table (by number) that the route for the subnet of the virtual IP is added to. 0 uses the main table. Only used for manager-type=basic.")
+	pflag.String("route-metric", "0", "Metric of the route for the subnet of the virtual IP. 0 uses the kernel's default. Only used for manager-type=basic.")
+	pflag.Bool("skip-dad", false, "Skip IPv6 duplicate address detection when adding the virtual IP. Only used for manager-type=basic.")
+	pflag.String("alias-template", "", "Template for the address label, e.g. \"{{.Iface}}:{{.VIPName}}\". Only used for manager-type=basic.")
 
 	pflag.String("trigger-key", "", "Key in the DCS to monitor, e.g. \"/service/batman/leader\".")
 	pflag.String("trigger-value", "", "Value to monitor for.")
+	pflag.String("vip-list-key", "", "Key in the DCS holding further virtual IPs, separated by commas, that are managed together with ip while this machine is the leader. Only used for dcs-type=etcd and consul.")
 
-	pflag.String("dcs-type", "etcd", "Type of endpoint used for key storage. Supported values: etcd, consul.")
+	pflag.String("dcs-type", "etcd", "Type of endpoint used for key storage. Supported values: etcd, consul, kubernetes, patroni.")
 	// note: can't put a default value into dcs-endpoints as that would mess with applying default localhost when using consul
-	pflag.String("dcs-endpoints", "", "DCS endpoint(s), separate multiple endpoints using commas. (default \"http://127.0.0.1:2379\" or \"http://127.0.0.1:8500\" depending on dcs-type.)")
+	pflag.String("dcs-endpoints", "", "DCS endpoint(s), separate multiple endpoints using commas. (default \"http://127.0.0.1:2379\", \"http://127.0.0.1:8500\" or \"http://127.0.0.1:8008\" depending on dcs-type.)")
+	pflag.String("dcs-fallback-endpoints", "", "DCS endpoint(s) of the same cluster, separated by commas, that are only used while none of the dcs-endpoints can be reached. Only used for dcs-type etcd and consul.")
 	pflag.String("etcd-user", "", "Username for etcd DCS endpoints.")
 	pflag.String("etcd-password", "", "Password for etcd DCS endpoints.")
 	pflag.String("etcd-ca-file", "", "Trusted CA certificate for the etcd server.")
@@ -65,11 +250,126 @@ func defineFlags() {
 	pflag.String("etcd-key-file", "", "Private key matching etcd-cert-file to decrypt messages sent from etcd.")
 
 	pflag.String("consul-token", "", "Token for consul DCS endpoints.")
+	pflag.String("consul-ca-file", "", "Trusted CA certificate for the consul server.")
+	pflag.String("consul-cert-file", "", "Client certificate used for authentication with consul.")
+	pflag.String("consul-key-file", "", "Private key matching consul-cert-file.")
+
+	pflag.String("tls-min-version", "1.2", "Minimum TLS version of all HTTPS connections. Supported values: 1.0, 1.1, 1.2, 1.3.")
+	pflag.Bool("tls-allow-insecure-version", false, "Allow setting tls-min-version below 1.2.")
+	pflag.Bool("write-departure-marker", false, "Write a short-lived key to the DCS on clean shutdown, announcing that this node leaves gracefully.")
+	pflag.String("departure-marker-prefix", "/vip-manager/departed/", "Prefix of the departure marker key, the trigger-value is appended.")
+	pflag.String("departure-marker-ttl", "60", "Time in seconds after which the departure marker expires.")
+	pflag.String("on-key-delete", "release", "What to do when the trigger-key does not exist in the DCS. Supported values: release, hold.")
+	pflag.String("on-invalid-leader-value", "release", "What to do when the trigger-key holds a value that can't be a node name. Supported values: release, hold.")
+	pflag.String("kubernetes-namespace", "", "Namespace of the Lease used for leader election, defaults to the namespace of the pod. Only used for dcs-type=kubernetes.")
+	pflag.String("kubernetes-lease-duration", "15000", "Time in milliseconds after which other nodes may take over the Lease if the leader doesn't renew it. Only used for dcs-type=kubernetes.")
+	pflag.String("min-lease-ttl", "0", "Minimum remaining TTL in seconds the trigger-key must have before it is trusted. Only used for dcs-type=etcd.")
+	pflag.String("initial-read-retries", "0", "Number of times the first read of the trigger-key at startup is retried before a failure releases the virtual IP.")
+	pflag.String("initial-read-retry-after", "1000", "Time in milliseconds to wait before the first retry of the initial read, doubled on every further retry.")
+	pflag.String("expected-peers", "", "The trigger-values of all nodes running vip-manager, separate multiple values using commas. Each node delays its first checks by its position in this list times startup-stagger-step.")
+	pflag.String("startup-stagger-step", "1000", "Time in milliseconds between the startups of consecutive nodes in expected-peers.")
+	pflag.String("dcs-read-consistency", "linearizable", "Consistency of DCS reads. Supported values: linearizable, serializable (faster, but may return stale values).")
 
 	pflag.String("interval", "1000", "DCS scan interval in milliseconds.")
-	pflag.String("manager-type", "basic", "Type of VIP-management to be used. Supported values: basic, hetzner.")
-
-	pflag.Bool("verbose", false, "Be verbose. Currently only implemented for manager-type=hetzner .")
+	pflag.String("recheck-interval", "10000", "Time in milliseconds after which the virtual IP is checked again, even if the leader didn't change.")
+	pflag.String("max-ops-per-tick", "0", "Maximum number of queries, configures and releases of the virtual IPs in one check, the rest is deferred to the next checks. Unlimited if 0.")
+	pflag.String("dcs-max-backoff", "30000", "Maximum time in milliseconds between attempts to reach an unreachable DCS. The wait starts at interval and doubles on every failure.")
+	pflag.String("dcs-dial-timeout", "5000", "Time in milliseconds after which connecting to etcd or consul is given up.")
+	pflag.String("dcs-request-timeout", "5000", "Time in milliseconds after which a read from etcd or consul is given up and counted as a failure to reach the DCS.")
+	pflag.Bool("verify-arp-sent", false, "Check the transmit counter of the interface after sending gratuitous ARP messages and warn if nothing was sent. Only used for manager-type=basic and arp_only.")
+	pflag.Bool("verify-arp-capability", false, "Check at startup that gratuitous ARP messages can be sent, instead of failing on the first failover. Only used for manager-type=basic and arp_only.")
+	pflag.String("arp-announce-from", "vip", "Sender protocol address of gratuitous ARP messages. Supported values: vip, host. Only used for manager-type=basic.")
+	pflag.String("arp-interface", "", "Interface to send the gratuitous ARP messages on, e.g. the physical interface below a bridge. Defaults to interface. Only used for manager-type=basic.")
+	pflag.String("arp-source-mac", "", "Sender hardware address of ARP announcements, e.g. 02:00:00:00:00:01. Defaults to the hardware address of interface. Only used for manager-type=basic.")
+	pflag.String("verify-release-after", "0", "Time in milliseconds after releasing the virtual IP to check that it is no longer registered to this machine. Disabled if 0.")
+	pflag.String("release-grace-window", "0", "Time in milliseconds to keep the virtual IP after losing leadership, so the new leader can take over first.")
+	pflag.Bool("no-release-on-shutdown", false, "Leave the virtual IP in place when vip-manager is stopped, instead of releasing it.")
+	pflag.Bool("dry-run", false, "Only log what would be done to configure or release the virtual IP, without doing it. Hooks are not run.")
+	pflag.String("shutdown-drain-delay", "0", "Time in milliseconds to wait after releasing the virtual IP on shutdown, before exiting.")
+	pflag.Bool("fail-fast-on-configure-error", false, "Exit after configuring the virtual IP failed retry-num times in a row, instead of retrying forever.")
+	pflag.String("drift-correction-backoff", "30000", "Minimum time in milliseconds between re-configuring a virtual IP that went away while being leader.")
+	pflag.String("split-brain-check-interval", "0", "Time in milliseconds between checks whether another machine holds the virtual IP while this machine is the leader and holds it, 0 disables them. Only used for manager-type=hetzner, basic and arp_only.")
+	pflag.String("max-unconfigured-leader-time", "0", "Time in milliseconds after which failing to configure the virtual IP while being leader is reported as critical. Disabled if 0.")
+	pflag.String("query-retries", "0", "Number of times a failed query of the state of the virtual IP is retried right away.")
+	pflag.String("query-retry-after", "250", "Time in milliseconds to wait before the first retry of a failed query, doubled on every further retry.")
+	pflag.String("configure-retries", "0", "Number of times failing to configure the virtual IP is retried right away.")
+	pflag.String("configure-retry-after", "1000", "Time in milliseconds to wait before the first retry to configure the virtual IP, doubled on every further retry.")
+	pflag.String("deconfigure-retries", "0", "Number of times failing to release the virtual IP is retried right away.")
+	pflag.String("deconfigure-retry-after", "1000", "Time in milliseconds to wait before the first retry to release the virtual IP, doubled on every further retry.")
+	pflag.String("query-timeout", "0", "Time in milliseconds after which querying the state of the virtual IP is aborted. 0 uses configure-timeout, or a default depending on manager-type.")
+	pflag.String("configure-timeout", "0", "Time in milliseconds after which configuring or releasing the virtual IP is aborted. 0 uses query-timeout, or a default depending on manager-type.")
+	pflag.String("manager-type", "basic", "Type of VIP-management to be used. Supported values: basic, hetzner, hetzner_cloud, gcp, dns_cloudflare, equinix, azure, openstack, arp_only.")
+	pflag.String("arp-targets", "", "IPv4 address(es) that are sent a directed ARP reply after configuring the virtual IP, separate multiple addresses using commas. Only used for manager-type=basic.")
+
+	pflag.Bool("verbose", false, "Be verbose. Logs the decision of every check, and additional details for manager-type=hetzner . Same as log-level=debug.")
+	pflag.String("log-level", "info", "Minimum level of the logged messages. Supported values: debug, info, warn, error.")
+	pflag.String("log-format", "text", "Format of the log output. Supported values: text, json.")
+	pflag.String("region", "", "Region of the provider API used by the manager-type. Uses the default endpoint if empty.")
+	pflag.String("metadata-concurrency", "2", "Maximum number of concurrent requests to the metadata service, shared by all virtual IPs. Only used for manager-type=gcp and hetzner_cloud.")
+	pflag.String("hetzner-ip-version", "ipv4", "IP version used to reach the Hetzner API. Supported values: auto, ipv4, ipv6.")
+	pflag.String("hetzner-dns-cache-ttl", "0", "Time in milliseconds for which the resolved address of the Hetzner API is used when resolving it fails. Disabled if 0.")
+	pflag.String("hetzner-api-history-size", "10", "Number of recent Hetzner API calls that are kept and published on /debug/vars.")
+	pflag.String("hetzner-max-response-bytes", "65536", "Maximum size in bytes of a response from the Hetzner API, larger responses are rejected.")
+	pflag.String("hetzner-api-url", "", "Base URL of the Hetzner Robot API, e.g. of a mock server for testing. (default \"https://robot-ws.your-server.de\")")
+	pflag.String("outbound-ip-retries", "2", "Number of times determining this machine's outbound IP is retried, waiting retry-after in between.")
+	pflag.Bool("strict-source-check", false, "Refuse to use a preferred outbound IP that is not an address of the configured interface.")
+	pflag.Bool("require-up-interface-for-source", false, "Refuse to use a preferred outbound IP whose interface is down. Only used for manager-type=hetzner.")
+	pflag.Bool("prefer-interface-address", false, "Use the IPv4 address of the configured interface as this machine's IP instead of the preferred outbound IP.")
+	pflag.String("hetzner-outbound-probe", "8.8.8.8:80", "Address (host:port) used to determine the preferred outbound IP. Nothing is sent to it.")
+	pflag.String("hetzner-active-server-ip", "", "IP that the failover IP is routed to when this machine is the leader, instead of determining it.")
+	pflag.String("hetzner-server-number", "0", "Number of this server at Hetzner, whose main IP the failover IP is routed to when this machine is the leader, instead of determining it. Only for IPv4.")
+	pflag.String("hetzner-user", "", "Username for the Hetzner Robot API. Only used for manager-type=hetzner.")
+	pflag.String("hetzner-password", "", "Password for the Hetzner Robot API. Only used for manager-type=hetzner.")
+	pflag.String("hetzner-user-file", "", "File containing the username for the Hetzner Robot API, overrides hetzner-user.")
+	pflag.String("hetzner-password-file", "", "File containing the password for the Hetzner Robot API, overrides hetzner-password.")
+	pflag.String("hetzner-cloud-token", "", "API token of the Hetzner Cloud project. Only used for manager-type=hetzner_cloud.")
+	pflag.String("gcp-network-interface", "nic0", "Network interface of the GCP instance that gets the virtual IP as alias IP. Only used for manager-type=gcp.")
+	pflag.String("hetzner-cloud-floating-ip-id", "0", "ID of the Floating IP, looked up by the virtual IP if 0. Only used for manager-type=hetzner_cloud.")
+	pflag.String("cloudflare-api-token", "", "API token with DNS edit permission for the zone. Only used for manager-type=dns_cloudflare.")
+	pflag.String("cloudflare-zone-id", "", "ID of the Cloudflare zone of the record. Only used for manager-type=dns_cloudflare.")
+	pflag.String("cloudflare-record-name", "", "Name of the A or AAAA record that points to the leader, e.g. db.example.com. Only used for manager-type=dns_cloudflare.")
+	pflag.String("cloudflare-record-ttl", "60", "TTL in seconds that is set on the record, 1 means automatic. Only used for manager-type=dns_cloudflare.")
+	pflag.String("equinix-api-token", "", "Project API key with read/write access to the project of the elastic IP. Only used for manager-type=equinix.")
+	pflag.String("equinix-project-id", "", "ID of the Equinix Metal project the elastic IP is reserved in. Only used for manager-type=equinix.")
+	pflag.String("azure-ip-configuration-name", "vip-manager", "Name of the ip configuration that holds the virtual IP on the network interface of the leader. Only used for manager-type=azure.")
+	pflag.String("azure-client-id", "", "Client ID of the user-assigned managed identity to use, the system-assigned one if empty. Only used for manager-type=azure.")
+	pflag.String("openstack-cloud", "", "Entry of clouds.yaml that provides the OpenStack settings that aren't set. Only used for manager-type=openstack.")
+	pflag.String("openstack-auth-url", "", "URL of the Keystone identity API, e.g. https://keystone.example.com:5000/v3. Only used for manager-type=openstack.")
+	pflag.String("openstack-application-credential-id", "", "ID of the application credential to authenticate with. Only used for manager-type=openstack.")
+	pflag.String("openstack-application-credential-secret", "", "Secret of the application credential. Only used for manager-type=openstack.")
+	pflag.String("openstack-interface", "", "Interface of the Neutron endpoint in the service catalog: public, internal or admin. Defaults to the one of openstack-cloud, or public. Only used for manager-type=openstack.")
+	pflag.Bool("skip-configure-when-active", true, "Don't send a failover request if the Hetzner API was last seen routing the failover IP to this machine already.")
+	pflag.Bool("hetzner-bind-local", false, "Also add the failover IP to the interface, with the netmask reported by the Hetzner API, while it is routed to this machine.")
+	pflag.Bool("hetzner-adopt-on-startup", true, "Take over a route of the failover IP to this machine that exists at startup, instead of sending a failover request once more.")
+	pflag.String("hetzner-cache-ttl", "3600000", "Time in milliseconds the state of the failover IP is cached before the Hetzner API is queried again.")
+	pflag.String("hetzner-on-ip-not-found", "disable", "What to do when the Hetzner API reports that the failover IP doesn't exist. Supported values: disable (stop calling the API), fatal.")
+	pflag.String("hetzner-post-configure-backoff", "5000", "Time in milliseconds after a successful failover during which the Hetzner API is not queried.")
+
+	pflag.String("pre-configure-hook", "", "Command that must exit successfully before the virtual IP is configured.")
+	pflag.String("on-gain-hook", "", "Command that is run after the virtual IP was configured on this machine.")
+	pflag.String("on-loss-hook", "", "Command that is run after the virtual IP was released by this machine.")
+	pflag.String("connectivity-canary", "", "Address that must be reachable before the virtual IP is configured, host:port for tcp or host for ping.")
+	pflag.String("connectivity-canary-method", "tcp", "How connectivity-canary is checked. Supported values: tcp, ping.")
+	pflag.String("connectivity-canary-timeout", "1000", "Time in milliseconds after which connectivity-canary is considered unreachable.")
+	pflag.String("health-check-command", "", "Command that must exit successfully for this machine to take the virtual IP, checked on every recheck.")
+	pflag.String("health-check-url", "", "URL that must answer a GET with a 2xx status for this machine to take the virtual IP, checked on every recheck.")
+	pflag.String("health-check-min-healthy", "0", "Time in milliseconds the health check must pass in a row before the virtual IP is configured.")
+	pflag.String("hook-timeout", "30000", "Time in milliseconds after which hook commands are killed.")
+	pflag.String("fence-command", "", "Command that is run before the virtual IP is released after leadership was lost while this machine held it, e.g. to stop PostgreSQL.")
+	pflag.String("fence-timeout", "10000", "Time in milliseconds after which fence-command is killed.")
+	pflag.String("start-command", "", "Command that is run after the virtual IP was configured on this machine, e.g. to start pgbouncer.")
+	pflag.String("stop-command", "", "Command that is run before the virtual IP is released, if start-command succeeded.")
+	pflag.String("notify-url", "", "URL that is sent a JSON notification by POST whenever this machine gains or loses the virtual IP. Disabled if empty.")
+
+	pflag.String("http-listen-address", "", "Address (host:port) on which introspection endpoints like /debug/vars and /status are served. Disabled if empty.")
+	pflag.String("http-auth-token", "", "Bearer token required to access the HTTP endpoints. No authentication if empty.")
+	pflag.String("prometheus-endpoint", "", "Address (host:port) on which metrics are served for Prometheus on /metrics. Disabled if empty.")
+	pflag.String("primary-check-dsn", "", "Postgres connection string using the virtual IP as host. When set, vip-manager periodically checks that the virtual IP points to a primary.")
+	pflag.String("primary-check-interval", "10000", "Time in milliseconds between checks whether the virtual IP points to a primary.")
+	pflag.String("otlp-endpoint", "", "OpenTelemetry collector (OTLP/HTTP) that receives a span for every configure and deconfigure operation, e.g. \"http://127.0.0.1:4318\". Disabled if empty.")
+	pflag.String("dead-letter-file", "", "File that a JSON line is appended to for every attempt to configure or release the virtual IP that failed after all retries. Disabled if empty.")
+	pflag.String("state-file", "", "File that the role of this machine and the state of the virtual IP are written to whenever they change. Disabled if empty.")
+	pflag.String("log-sample-every", "1", "Only emit routine (non-error, unchanged) log lines every N-th time. Currently only implemented for manager-type=hetzner .")
 
 	pflag.CommandLine.SortFlags = false
 }
@@ -151,12 +451,72 @@ func mapDeprecated() error {
 }
 
 func setDefaults() {
+	// if only one of the timeouts is set, use it for both
+	if viper.IsSet("query-timeout") && !viper.IsSet("configure-timeout") {
+		viper.SetDefault("configure-timeout", viper.Get("query-timeout"))
+	} else if viper.IsSet("configure-timeout") && !viper.IsSet("query-timeout") {
+		viper.SetDefault("query-timeout", viper.Get("configure-timeout"))
+	}
+
 	defaults := map[string]string{
-		"dcs-type":    "etcd",
-		"interval":    "1000",
-		"hostingtype": "basic",
-		"retry-num":   "3",
-		"retry-after": "250",
+		"dcs-type":                       "etcd",
+		"kubernetes-lease-duration":      "15000",
+		"interval":                       "1000",
+		"dcs-max-backoff":                "30000",
+		"dcs-dial-timeout":               "5000",
+		"dcs-request-timeout":            "5000",
+		"recheck-interval":               "10000",
+		"max-ops-per-tick":               "0",
+		"hostingtype":                    "basic",
+		"retry-num":                      "3",
+		"retry-after":                    "250",
+		"query-retries":                  "0",
+		"query-retry-after":              "250",
+		"configure-retries":              "0",
+		"configure-retry-after":          "1000",
+		"deconfigure-retries":            "0",
+		"deconfigure-retry-after":        "1000",
+		"log-sample-every":               "1",
+		"log-level":                      "info",
+		"log-format":                     "text",
+		"hook-timeout":                   "30000",
+		"fence-timeout":                  "10000",
+		"hetzner-ip-version":             "ipv4",
+		"hetzner-post-configure-backoff": "5000",
+		"hetzner-cache-ttl":              "3600000",
+		"hetzner-on-ip-not-found":        "disable",
+		"skip-configure-when-active":     "true",
+		"hetzner-adopt-on-startup":       "true",
+		"gratuitous-arp":                 "true",
+		"gcp-network-interface":          "nic0",
+		"outbound-ip-retries":            "2",
+		"hetzner-api-history-size":       "10",
+		"hetzner-max-response-bytes":     "65536",
+		"hetzner-outbound-probe":         "8.8.8.8:80",
+		"tls-min-version":                "1.2",
+		"drift-correction-backoff":       "30000",
+		"split-brain-check-interval":     "0",
+		"max-unconfigured-leader-time":   "0",
+		"shutdown-drain-delay":           "0",
+		"dcs-read-consistency":           "linearizable",
+		"on-key-delete":                  "release",
+		"on-invalid-leader-value":        "release",
+		"initial-read-retries":           "0",
+		"initial-read-retry-after":       "1000",
+		"startup-stagger-step":           "1000",
+		"host-address-check":             "error",
+		"on-interface-gone":              "wait",
+		"interface-tie-break":            "error",
+		"connectivity-canary-method":     "tcp",
+		"connectivity-canary-timeout":    "1000",
+		"arp-announce-from":              "vip",
+		"arp-refresh-interval":           "0",
+		"arp-repeat-count":               "1",
+		"arp-repeat-interval":            "1000",
+		"min-arp-burst-interval":         "0",
+		"metadata-concurrency":           "2",
+		"cloudflare-record-ttl":          "60",
+		"azure-ip-configuration-name":    "vip-manager",
 	}
 
 	for k, v := range defaults {
@@ -178,10 +538,15 @@ func checkMandatory() error {
 	mandatory := []string{
 		"ip",
 		"netmask",
-		"interface",
-		"trigger-key",
 		"trigger-value",
-		"dcs-endpoints",
+	}
+	// patroni tells whether this node is the leader, no key is read
+	if viper.GetString("dcs-type") != "patroni" {
+		mandatory = append(mandatory, "trigger-key")
+	}
+	// kubernetes talks to the API server of the pod
+	if viper.GetString("dcs-type") != "kubernetes" {
+		mandatory = append(mandatory, "dcs-endpoints")
 	}
 	success := true
 	for _, v := range mandatory {
@@ -206,9 +571,12 @@ func checkImpliedSetting(implied string, reason string) bool {
 func checkImpliedMandatory() error {
 	mandatory := map[string]string{
 		// "implied" : "reason"
-		"etcd-user":     "etcd-password",
-		"etcd-key-file": "etcd-cert-file",
-		"etcd-ca-file":  "etcd-cert-file",
+		"etcd-user":        "etcd-password",
+		"etcd-key-file":    "etcd-cert-file",
+		"etcd-cert-file":   "etcd-key-file",
+		"etcd-ca-file":     "etcd-cert-file",
+		"consul-key-file":  "consul-cert-file",
+		"consul-cert-file": "consul-key-file",
 	}
 	success := true
 	for k, v := range mandatory {
@@ -226,9 +594,7 @@ func printSettings() {
 	for k, v := range viper.AllSettings() {
 		if v != "" {
 			switch k {
-			case "etcd-password":
-				fallthrough
-			case "consul-token":
+			case "etcd-password", "consul-token", "http-auth-token", "hetzner-cloud-token", "hetzner-password", "notify-url", "cloudflare-api-token", "equinix-api-token", "openstack-application-credential-secret":
 				s = append(s, fmt.Sprintf("\t%s : *****\n", k))
 			default:
 				s = append(s, fmt.Sprintf("\t%s : %v\n", k, v))
@@ -243,12 +609,72 @@ func printSettings() {
 	}
 }
 
+// checkHTTPListener validates the settings of the optional HTTP listeners.
+func (c *Config) checkHTTPListener() error {
+	if c.HTTPListenAddress == "" && c.PrometheusEndpoint == "" {
+		if c.HTTPAuthToken != "" {
+			return errors.New("http-auth-token is set, but neither http-listen-address nor prometheus-endpoint is")
+		}
+		return nil
+	}
+	for key, address := range map[string]string{"http-listen-address": c.HTTPListenAddress, "prometheus-endpoint": c.PrometheusEndpoint} {
+		if address == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", key, address, err)
+		}
+		if host != "" && net.ParseIP(host) == nil {
+			return fmt.Errorf("invalid %s %q: host must be an IP address", key, address)
+		}
+		if ip := net.ParseIP(host); (host == "" || ip.IsUnspecified()) && c.HTTPAuthToken == "" {
+			log.Printf("WARNING: %s serves HTTP endpoints on all interfaces without authentication, consider setting http-auth-token or binding to 127.0.0.1", key)
+		}
+	}
+	return nil
+}
+
 // NewConfig returns a new Config instance
 func NewConfig() (*Config, error) {
-	var err error
-
 	defineFlags()
 	pflag.Parse()
+	return readConfig()
+}
+
+// ReloadConfig reads the config file again, e.g. on SIGHUP, starting over
+// like at startup. Flags and environment variables keep taking precedence.
+func ReloadConfig() (*Config, error) {
+	if !viper.IsSet("config") {
+		return nil, errors.New("no config file to reload, vip-manager was started without config")
+	}
+	// forget the settings made while loading the config before
+	viper.Reset()
+	return readConfig()
+}
+
+// configFileType returns the format of the config file, json or yaml.
+// It is told by the extension, files with any other extension
+// (e.g. /etc/default/vip-manager) are JSON if they start with a brace.
+func configFileType(path string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		return "json", nil
+	case ".yaml", ".yml":
+		return "yaml", nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(strings.TrimSpace(strings.TrimPrefix(string(content), "\ufeff")), "{") {
+		return "json", nil
+	}
+	return "yaml", nil
+}
+
+// readConfig reads the settings from the flags, the environment and the config file
+func readConfig() (*Config, error) {
 	// import pflags into viper
 	_ = viper.BindPFlags(pflag.CommandLine)
 
@@ -272,14 +698,43 @@ func NewConfig() (*Config, error) {
 	// if a configfile has been passed, make viper read it
 	if viper.IsSet("config") {
 		viper.SetConfigFile(viper.GetString("config"))
+		configType, err := configFileType(viper.GetString("config"))
+		if err != nil {
+			return nil, fmt.Errorf("Fatal error reading config file: %w", err)
+		}
+		viper.SetConfigType(configType)
 
-		err := viper.ReadInConfig() // Find and read the config file
-		if err != nil {             // Handle errors reading the config file
+		err = viper.ReadInConfig() // Find and read the config file
+		if err != nil {            // Handle errors reading the config file
 			return nil, fmt.Errorf("Fatal error reading config file: %w", err)
 		}
 		log.Printf("Using config from file: %s\n", viper.ConfigFileUsed())
 	}
 
+	return loadConfig()
+}
+
+// Changed returns the settings whose values differ between c and other,
+// e.g. to tell which settings changed on reload.
+func (c *Config) Changed(other *Config) []string {
+	var changed []string
+	a, b := reflect.ValueOf(c).Elem(), reflect.ValueOf(other).Elem()
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Tag.Get("mapstructure")
+		if name == "" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// loadConfig checks the settings read by viper and decodes them
+func loadConfig() (*Config, error) {
+	var err error
+
 	if err = mapDeprecated(); err != nil {
 		return nil, err
 	}
@@ -287,10 +742,12 @@ func NewConfig() (*Config, error) {
 	setDefaults()
 
 	// convert string of csv to String Slice
-	if viper.IsSet("dcs-endpoints") {
-		endpointsString := viper.GetString("dcs-endpoints")
-		if strings.Contains(endpointsString, ",") {
-			viper.Set("dcs-endpoints", strings.Split(endpointsString, ","))
+	for _, k := range []string{"dcs-endpoints", "dcs-fallback-endpoints", "arp-targets", "expected-peers"} {
+		if viper.IsSet(k) {
+			csvString := viper.GetString(k)
+			if strings.Contains(csvString, ",") {
+				viper.Set(k, strings.Split(csvString, ","))
+			}
 		}
 	}
 
@@ -303,6 +760,8 @@ func NewConfig() (*Config, error) {
 			viper.Set("dcs-endpoints", []string{"http://127.0.0.1:8500"})
 		case "etcd":
 			viper.Set("dcs-endpoints", []string{"http://127.0.0.1:2379"})
+		case "patroni":
+			viper.Set("dcs-endpoints", []string{"http://127.0.0.1:8008"})
 		}
 	}
 
@@ -330,6 +789,22 @@ func NewConfig() (*Config, error) {
 	if err != nil {
 		log.Fatalf("unable to decode viper config into config struct, %v", err)
 	}
+	if conf.HostingType == "openstack" {
+		if err = conf.resolveOpenStackCloud(); err != nil {
+			return nil, err
+		}
+	}
+
+	RegisterSecret(conf.EtcdPassword)
+	RegisterSecret(conf.ConsulToken)
+	RegisterSecret(conf.HTTPAuthToken)
+	RegisterSecret(conf.HetznerCloudToken)
+	RegisterSecret(conf.HetznerPassword)
+	RegisterSecret(conf.CloudflareAPIToken)
+	RegisterSecret(conf.EquinixAPIToken)
+	RegisterSecret(conf.OpenStackApplicationCredentialSecret)
+	// webhook URLs, e.g. of Slack, contain the credentials
+	RegisterSecret(conf.NotifyURL)
 
 	printSettings()
 
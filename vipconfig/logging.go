@@ -0,0 +1,27 @@
+package vipconfig
+
+import (
+	"io"
+	"log/slog"
+)
+
+var logLevels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// NewLogger returns a logger writing to out, as configured by log-level and log-format.
+// verbose lowers the level to debug, as that is where the verbose details are logged.
+func (c *Config) NewLogger(out io.Writer) *slog.Logger {
+	level := logLevels[c.LogLevel]
+	if c.Verbose && level > slog.LevelDebug {
+		level = slog.LevelDebug
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if c.LogFormat == "json" {
+		return slog.New(slog.NewJSONHandler(out, opts))
+	}
+	return slog.New(slog.NewTextHandler(out, opts))
+}
@@ -0,0 +1,86 @@
+package vipconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+)
+
+// openStackCloudsFiles returns the locations of clouds.yaml in the order the
+// OpenStack clients search them, OS_CLIENT_CONFIG_FILE first.
+func openStackCloudsFiles() []string {
+	files := []string{}
+	if f := os.Getenv("OS_CLIENT_CONFIG_FILE"); f != "" {
+		files = append(files, f)
+	}
+	files = append(files, "clouds.yaml")
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".config", "openstack", "clouds.yaml"))
+	}
+	return append(files, "/etc/openstack/clouds.yaml")
+}
+
+// openStackCloud is the part of a clouds.yaml entry vip-manager uses
+type openStackCloud struct {
+	AuthType string `mapstructure:"auth_type"`
+	Auth     struct {
+		AuthURL                     string `mapstructure:"auth_url"`
+		ApplicationCredentialID     string `mapstructure:"application_credential_id"`
+		ApplicationCredentialSecret string `mapstructure:"application_credential_secret"`
+	} `mapstructure:"auth"`
+	RegionName string `mapstructure:"region_name"`
+	Interface  string `mapstructure:"interface"`
+}
+
+// resolveOpenStackCloud fills in the OpenStack settings that weren't set
+// from the openstack-cloud entry of clouds.yaml, if any.
+func (c *Config) resolveOpenStackCloud() error {
+	defer func() {
+		if c.OpenStackInterface == "" {
+			c.OpenStackInterface = "public"
+		}
+	}()
+	if c.OpenStackCloud == "" {
+		return nil
+	}
+	for _, file := range openStackCloudsFiles() {
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		v := viper.New()
+		v.SetConfigFile(file)
+		v.SetConfigType("yaml")
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("cannot read %s: %w", file, err)
+		}
+		if !v.IsSet("clouds." + c.OpenStackCloud) {
+			return fmt.Errorf("openstack-cloud %q not found in %s", c.OpenStackCloud, file)
+		}
+		var cloud openStackCloud
+		if err := v.UnmarshalKey("clouds."+c.OpenStackCloud, &cloud); err != nil {
+			return fmt.Errorf("cannot parse openstack-cloud %q in %s: %w", c.OpenStackCloud, file, err)
+		}
+		if cloud.AuthType != "v3applicationcredential" {
+			return fmt.Errorf("openstack-cloud %q in %s must use auth_type v3applicationcredential", c.OpenStackCloud, file)
+		}
+		if c.OpenStackAuthURL == "" {
+			c.OpenStackAuthURL = cloud.Auth.AuthURL
+		}
+		if c.OpenStackApplicationCredentialID == "" {
+			c.OpenStackApplicationCredentialID = cloud.Auth.ApplicationCredentialID
+		}
+		if c.OpenStackApplicationCredentialSecret == "" {
+			c.OpenStackApplicationCredentialSecret = cloud.Auth.ApplicationCredentialSecret
+		}
+		if c.Region == "" {
+			c.Region = cloud.RegionName
+		}
+		if c.OpenStackInterface == "" {
+			c.OpenStackInterface = cloud.Interface
+		}
+		return nil
+	}
+	return fmt.Errorf("openstack-cloud %q is set, but no clouds.yaml was found in %v", c.OpenStackCloud, openStackCloudsFiles())
+}
@@ -0,0 +1,65 @@
+package vipconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+)
+
+var (
+	secretsLock sync.RWMutex
+	secrets     [][]byte
+)
+
+// RegisterSecret adds a value that must never show up in the logs.
+// Empty values are ignored. The value is also masked in its escaped forms,
+// as it appears in quoted values of the text and json log formats.
+func RegisterSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	quoted := strconv.Quote(secret)
+	j, _ := json.Marshal(secret)
+
+	secretsLock.Lock()
+	defer secretsLock.Unlock()
+	for _, variant := range []string{secret, quoted[1 : len(quoted)-1], string(j[1 : len(j)-1])} {
+		registerVariant(variant)
+	}
+}
+
+func registerVariant(secret string) {
+	for _, s := range secrets {
+		if string(s) == secret {
+			return
+		}
+	}
+	secrets = append(secrets, []byte(secret))
+}
+
+type sanitizingWriter struct {
+	out io.Writer
+}
+
+// NewSanitizingWriter returns a writer that replaces all registered secrets
+// with asterisks before passing the output on to out.
+// It is meant to be used with log.SetOutput.
+func NewSanitizingWriter(out io.Writer) io.Writer {
+	return &sanitizingWriter{out: out}
+}
+
+func (w *sanitizingWriter) Write(p []byte) (int, error) {
+	sanitized := p
+	secretsLock.RLock()
+	for _, s := range secrets {
+		sanitized = bytes.ReplaceAll(sanitized, s, []byte("*****"))
+	}
+	secretsLock.RUnlock()
+
+	if _, err := w.out.Write(sanitized); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
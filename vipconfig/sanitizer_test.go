@@ -0,0 +1,59 @@
+package vipconfig
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestSanitizingWriterRedactsSecrets(t *testing.T) {
+	const secret = `s3cr"et\pass`
+	RegisterSecret(secret)
+
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			var out bytes.Buffer
+			c := &Config{LogLevel: "info", LogFormat: format}
+			logger := c.NewLogger(NewSanitizingWriter(&out))
+
+			logger.Info("Hetzner API request", "user", "admin", "password", secret)
+			logger.Info("connecting to http://admin:" + secret + "@127.0.0.1")
+
+			got := out.String()
+			if strings.Contains(got, "s3cr") {
+				t.Errorf("secret not redacted: %s", got)
+			}
+			if n := strings.Count(got, "*****"); n != 2 {
+				t.Errorf("want 2 redactions, got %d: %s", n, got)
+			}
+			if !strings.Contains(got, "admin") {
+				t.Errorf("non-secret value was removed: %s", got)
+			}
+		})
+	}
+}
+
+func TestSanitizingWriterRedactsLogPackage(t *testing.T) {
+	RegisterSecret("etcd-token-4711")
+
+	var out bytes.Buffer
+	logger := log.New(NewSanitizingWriter(&out), "", 0)
+	logger.Printf("etcd-password: %s", "etcd-token-4711")
+
+	if got := out.String(); got != "etcd-password: *****\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestRegisterSecretIgnoresEmpty(t *testing.T) {
+	RegisterSecret("")
+
+	var out bytes.Buffer
+	if _, err := NewSanitizingWriter(&out).Write([]byte("nothing to hide")); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "nothing to hide" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,36 @@
+package vipconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// minSafeTLSVersion is the oldest TLS version accepted without tls-allow-insecure-version
+const minSafeTLSVersion = tls.VersionTLS12
+
+// ParseTLSVersion returns the crypto/tls constant for a version like "1.2".
+func ParseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unsupported tls-min-version %q, use 1.0, 1.1, 1.2 or 1.3", version)
+	}
+	return v, nil
+}
+
+func checkTLSVersion(version string, allowInsecure bool) error {
+	v, err := ParseTLSVersion(version)
+	if err != nil {
+		return err
+	}
+	if v < minSafeTLSVersion && !allowInsecure {
+		return fmt.Errorf("tls-min-version %s is insecure, set tls-allow-insecure-version if it is really needed", version)
+	}
+	return nil
+}
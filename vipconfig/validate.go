@@ -0,0 +1,374 @@
+package vipconfig
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// HetznerCredentialsFile is read by manager-type hetzner if no credentials are configured
+const HetznerCredentialsFile = "/etc/hetzner"
+
+// Validate checks that the configuration is complete for the selected
+// manager-type and dcs-type, so problems are reported at startup instead
+// of failing while managing the virtual IP. All problems are returned at once.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	// the positions of the valid vips in ip, to report duplicates
+	var vips []net.IPNet
+	var positions []int
+	for i, entry := range strings.Split(c.IP, ",") {
+		vip, err := parseVIP(entry, c.Mask)
+		if err != nil {
+			add("%s", err)
+			continue
+		}
+		if j := indexOfVIP(vips, vip); j >= 0 {
+			add("%s", duplicateVIPError(positions[j], i, vip))
+		}
+		vips = append(vips, vip)
+		positions = append(positions, i)
+	}
+
+	if c.InterfaceTieBreak == "name" && c.InterfaceNamePattern == "" {
+		add("interface-tie-break name requires interface-name-pattern")
+	}
+	if _, err := path.Match(c.InterfaceNamePattern, ""); err != nil {
+		add("interface-name-pattern %q: %s", c.InterfaceNamePattern, err)
+	}
+
+	switch c.HostingType {
+	case "basic", "arp_only":
+		if c.HostingType == "arp_only" && !c.GratuitousArp {
+			add("manager-type arp_only only sends gratuitous ARP messages, it can't be used with gratuitous-arp disabled")
+		}
+		// getNetIface waits for the interface otherwise
+		// an empty interface is detected in main
+		if c.InterfaceWaitTimeout == 0 && c.Iface != "" {
+			if _, err := net.InterfaceByName(c.Iface); err != nil {
+				add("interface %q: %s", c.Iface, err)
+			}
+		}
+	case "hetzner":
+		user := c.HetznerUser != "" || c.HetznerUserFile != ""
+		password := c.HetznerPassword != "" || c.HetznerPasswordFile != ""
+		if user != password {
+			add("hetzner-user and hetzner-password (or their files) must be set together")
+		} else if !user {
+			if _, err := os.Stat(HetznerCredentialsFile); err != nil {
+				add("manager-type hetzner requires hetzner-user and hetzner-password, or the credentials in %s: %s", HetznerCredentialsFile, err)
+			}
+		}
+		// not quoted, it may contain credentials
+		if c.HetznerAPIURL != "" && !strings.HasPrefix(c.HetznerAPIURL, "http://") && !strings.HasPrefix(c.HetznerAPIURL, "https://") {
+			add("hetzner-api-url must be an http:// or https:// URL")
+		}
+		switch c.HetznerIPVersion {
+		case "auto", "ipv4", "ipv6":
+		default:
+			add("unsupported hetzner-ip-version %q, use auto, ipv4 or ipv6", c.HetznerIPVersion)
+		}
+		if c.HetznerServerNumber < 0 {
+			add("hetzner-server-number must not be negative")
+		} else if c.HetznerServerNumber > 0 {
+			if c.HetznerActiveServerIP != "" {
+				add("hetzner-server-number and hetzner-active-server-ip can't be combined")
+			}
+			for _, vip := range vips {
+				// the API only tells the main IPv4 address of a server
+				if vip.IP.To4() == nil {
+					add("hetzner-server-number can't be used for the IPv6 failover net %s, use hetzner-active-server-ip", vip.IP)
+				}
+			}
+		}
+	case "hetzner_cloud":
+		if c.HetznerCloudToken == "" {
+			add("manager-type hetzner_cloud requires hetzner-cloud-token")
+		}
+	case "gcp":
+		for _, vip := range vips {
+			if vip.IP.To4() == nil {
+				add("manager-type gcp only supports IPv4 virtual IPs, not %s", vip.IP)
+			}
+		}
+	case "dns_cloudflare":
+		if c.CloudflareAPIToken == "" || c.CloudflareZoneID == "" || c.CloudflareRecordName == "" {
+			add("manager-type dns_cloudflare requires cloudflare-api-token, cloudflare-zone-id and cloudflare-record-name")
+		}
+		// a single record points to the leader
+		if len(vips) > 1 {
+			add("manager-type dns_cloudflare only supports a single ip, the address of this machine")
+		}
+		if c.CloudflareRecordTTL != 1 && (c.CloudflareRecordTTL < 30 || c.CloudflareRecordTTL > 86400) {
+			add("cloudflare-record-ttl must be 1 (automatic) or between 30 and 86400 seconds")
+		}
+	case "equinix":
+		if c.EquinixAPIToken == "" || c.EquinixProjectID == "" {
+			add("manager-type equinix requires equinix-api-token and equinix-project-id")
+		}
+	case "azure":
+		if c.AzureIPConfigurationName == "" {
+			add("manager-type azure requires azure-ip-configuration-name")
+		}
+	case "openstack":
+		if c.OpenStackAuthURL == "" || c.OpenStackApplicationCredentialID == "" || c.OpenStackApplicationCredentialSecret == "" {
+			add("manager-type openstack requires openstack-auth-url, openstack-application-credential-id and openstack-application-credential-secret, or openstack-cloud")
+		}
+		switch c.OpenStackInterface {
+		case "public", "internal", "admin":
+		default:
+			add("unsupported openstack-interface %q, use public, internal or admin", c.OpenStackInterface)
+		}
+	default:
+		add("unsupported manager-type %q, use basic, hetzner, hetzner_cloud, gcp, dns_cloudflare, equinix, azure, openstack or arp_only", c.HostingType)
+	}
+
+	switch c.EndpointType {
+	case "etcd", "consul", "patroni":
+		if len(c.Endpoints) == 0 {
+			add("dcs-endpoints must not be empty")
+		}
+		for _, e := range c.Endpoints {
+			if strings.TrimSpace(e) == "" {
+				add("dcs-endpoints must not contain empty entries")
+				break
+			}
+		}
+	case "kubernetes":
+		// names the Lease object
+		if strings.Contains(c.Key, "/") {
+			add("trigger-key %q must be the name of a Lease for dcs-type kubernetes, without slashes", c.Key)
+		}
+		if c.KubernetesLeaseDuration <= 0 {
+			add("kubernetes-lease-duration must be positive")
+		}
+	default:
+		add("unsupported dcs-type %q, use etcd, consul, kubernetes or patroni", c.EndpointType)
+	}
+	if len(c.FallbackEndpoints) > 0 {
+		if c.EndpointType != "etcd" && c.EndpointType != "consul" {
+			add("dcs-fallback-endpoints can only be used with dcs-type etcd or consul")
+		}
+		for _, e := range c.FallbackEndpoints {
+			if strings.TrimSpace(e) == "" {
+				add("dcs-fallback-endpoints must not contain empty entries")
+				break
+			}
+			for _, p := range c.Endpoints {
+				if e == p {
+					add("%s is in both dcs-endpoints and dcs-fallback-endpoints", e)
+				}
+			}
+		}
+	}
+	if c.EndpointType == "patroni" && len(c.Endpoints) > 0 &&
+		!strings.HasPrefix(c.Endpoints[0], "http://") && !strings.HasPrefix(c.Endpoints[0], "https://") {
+		add("dcs-endpoints must be the http:// or https:// URL of the Patroni REST API for dcs-type patroni")
+	}
+	if c.Key == "" && c.EndpointType != "patroni" {
+		add("trigger-key must not be empty")
+	}
+	if c.VIPListKey != "" {
+		if c.EndpointType != "etcd" && c.EndpointType != "consul" {
+			add("vip-list-key can only be used with dcs-type etcd or consul")
+		}
+		if c.VIPListKey == c.Key {
+			add("vip-list-key must differ from trigger-key")
+		}
+		if c.HostingType == "dns_cloudflare" {
+			add("manager-type dns_cloudflare only supports a single ip, vip-list-key can't be used")
+		}
+	}
+	// not quoted, it usually contains credentials
+	if c.NotifyURL != "" && !strings.HasPrefix(c.NotifyURL, "http://") && !strings.HasPrefix(c.NotifyURL, "https://") {
+		add("notify-url must be an http:// or https:// URL")
+	}
+	// consul rejects sessions with a TTL outside of these bounds
+	if c.WriteDepartureMarker && c.EndpointType == "consul" && (c.DepartureMarkerTTL < 10 || c.DepartureMarkerTTL > 86400) {
+		add("departure-marker-ttl must be between 10 and 86400 for dcs-type consul")
+	} else if c.WriteDepartureMarker && c.DepartureMarkerTTL <= 0 {
+		add("departure-marker-ttl must be positive")
+	}
+	if c.Interval <= 0 {
+		add("interval must be positive")
+	}
+	if c.RecheckInterval <= 0 {
+		add("recheck-interval must be positive")
+	}
+	if c.MaxOpsPerTick < 0 {
+		add("max-ops-per-tick must not be negative")
+	}
+	if c.DCSDialTimeout <= 0 {
+		add("dcs-dial-timeout must be positive")
+	}
+	if c.DCSRequestTimeout <= 0 {
+		add("dcs-request-timeout must be positive")
+	}
+	if c.RoutingTable < 0 || c.RouteMetric < 0 {
+		add("routing-table and route-metric must not be negative")
+	}
+	if c.ArpSourceMAC != "" {
+		if mac, err := net.ParseMAC(c.ArpSourceMAC); err != nil || len(mac) != 6 {
+			add("arp-source-mac %q must be a MAC address like 02:00:00:00:00:01", c.ArpSourceMAC)
+		}
+	}
+	if c.ArpInterface != "" && c.ArpInterface == c.Iface {
+		add("arp-interface must differ from interface, leave it empty to announce on interface")
+	}
+	if c.SplitBrainCheckInterval < 0 {
+		add("split-brain-check-interval must not be negative")
+	}
+	if c.RoutingTable > 0 && c.NoPrefixRoute {
+		add("no-prefix-route can't be combined with routing-table, which needs the route for the subnet")
+	}
+	// a hanging fence command must not keep the virtual IP from being released
+	if c.FenceCommand != "" && c.FenceTimeout <= 0 {
+		add("fence-timeout must be positive when fence-command is set")
+	}
+	// likewise, releasing the virtual IP waits for stop-command
+	if c.StopCommand != "" && c.HookTimeout <= 0 {
+		add("hook-timeout must be positive when stop-command is set")
+	}
+	if c.HealthCheckCommand != "" && c.HealthCheckURL != "" {
+		add("health-check-command and health-check-url can't be combined")
+	}
+	if c.HealthCheckURL != "" && !strings.HasPrefix(c.HealthCheckURL, "http://") && !strings.HasPrefix(c.HealthCheckURL, "https://") {
+		add("health-check-url must be an http:// or https:// URL")
+	}
+	if (c.HealthCheckCommand != "" || c.HealthCheckURL != "") && c.HookTimeout <= 0 {
+		add("hook-timeout must be positive when a health check is set")
+	}
+	if c.HealthCheckMinHealthy < 0 {
+		add("health-check-min-healthy must not be negative")
+	}
+	if c.MetadataConcurrency < 1 {
+		add("metadata-concurrency must be at least 1")
+	}
+	for _, t := range c.ArpTargets {
+		if ip := net.ParseIP(t); ip == nil || ip.To4() == nil {
+			add("arp-targets entry %q is not a valid IPv4 address", t)
+		}
+	}
+	if err := c.checkHTTPListener(); err != nil {
+		add("%s", err)
+	}
+	if err := checkTLSVersion(c.TLSMinVersion, c.TLSAllowInsecureVersion); err != nil {
+		add("%s", err)
+	}
+	if _, _, err := net.SplitHostPort(c.HetznerOutboundProbe); err != nil {
+		add("hetzner-outbound-probe %q must be host:port: %s", c.HetznerOutboundProbe, err)
+	}
+	if c.HetznerActiveServerIP != "" && net.ParseIP(c.HetznerActiveServerIP) == nil {
+		add("hetzner-active-server-ip %q is not a valid IP address", c.HetznerActiveServerIP)
+	}
+	switch c.ConnectivityCanaryMethod {
+	case "tcp":
+		if c.ConnectivityCanary != "" {
+			if _, _, err := net.SplitHostPort(c.ConnectivityCanary); err != nil {
+				add("connectivity-canary %q must be host:port for connectivity-canary-method tcp: %s", c.ConnectivityCanary, err)
+			}
+		}
+	case "ping":
+	default:
+		add("unsupported connectivity-canary-method %q, use tcp or ping", c.ConnectivityCanaryMethod)
+	}
+
+	// NewLogger falls back to info, so the problems can still be logged
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		add("unsupported log-level %q, use debug, info, warn or error", c.LogLevel)
+	}
+
+	// the choices of the enumerated settings
+	for _, e := range []struct {
+		name, value string
+		choices     []string
+	}{
+		{"log-format", c.LogFormat, []string{"text", "json"}},
+		{"arp-announce-from", c.ArpAnnounceFrom, []string{"vip", "host"}},
+		{"on-key-delete", c.OnKeyDelete, []string{"release", "hold"}},
+		{"on-interface-gone", c.OnInterfaceGone, []string{"wait", "fatal"}},
+		{"interface-tie-break", c.InterfaceTieBreak, []string{"error", "address", "name"}},
+		{"hetzner-on-ip-not-found", c.HetznerOnIPNotFound, []string{"disable", "fatal"}},
+		{"host-address-check", c.HostAddressCheck, []string{"error", "warn"}},
+		{"on-invalid-leader-value", c.OnInvalidLeaderValue, []string{"release", "hold"}},
+		{"dcs-read-consistency", c.ConsensusReadConsistency, []string{"linearizable", "serializable"}},
+	} {
+		if !slices.Contains(e.choices, e.value) {
+			add("unsupported %s %q, use %s", e.name, e.value, strings.Join(e.choices, " or "))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n\t" + strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// VIPs returns the virtual IPs listed in ip, separated by commas. Each entry
+// may carry its own prefix length, e.g. 10.0.0.5/25, otherwise netmask is used.
+func (c *Config) VIPs() ([]net.IPNet, error) {
+	return ParseVIPs(c.IP, c.Mask)
+}
+
+// ParseVIPs parses a list of virtual IPs like ip, e.g. the value of vip-list-key.
+// An empty list holds no VIPs, and an address must not be listed twice.
+func ParseVIPs(list string, mask int) ([]net.IPNet, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	var vips []net.IPNet
+	for i, entry := range strings.Split(list, ",") {
+		vip, err := parseVIP(entry, mask)
+		if err != nil {
+			return nil, err
+		}
+		if j := indexOfVIP(vips, vip); j >= 0 {
+			return nil, duplicateVIPError(j, i, vip)
+		}
+		vips = append(vips, vip)
+	}
+	return vips, nil
+}
+
+// indexOfVIP returns the index of the address of vip in vips, or -1
+func indexOfVIP(vips []net.IPNet, vip net.IPNet) int {
+	return slices.IndexFunc(vips, func(other net.IPNet) bool { return other.IP.Equal(vip.IP) })
+}
+
+// duplicateVIPError reports that the entries first and second of a list are both vip
+func duplicateVIPError(first, second int, vip net.IPNet) error {
+	return fmt.Errorf("vips[%d] and vips[%d] are both %s", first, second, vip.IP)
+}
+
+// parseVIP parses a single entry of ip, see VIPs
+func parseVIP(entry string, mask int) (net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	address, prefix, hasPrefix := strings.Cut(entry, "/")
+	vip := net.ParseIP(address)
+	if vip == nil {
+		return net.IPNet{}, fmt.Errorf("ip %q is not a valid IP address", entry)
+	}
+	bits := 32
+	if vip.To4() == nil {
+		bits = 128
+	}
+	if hasPrefix {
+		var err error
+		if mask, err = strconv.Atoi(prefix); err != nil {
+			return net.IPNet{}, fmt.Errorf("ip %q has an invalid prefix length", entry)
+		}
+	}
+	if mask < 1 || mask > bits {
+		return net.IPNet{}, fmt.Errorf("netmask %d is out of range, use 1 to %d for %s", mask, bits, address)
+	}
+	return net.IPNet{IP: vip, Mask: net.CIDRMask(mask, bits)}, nil
+}
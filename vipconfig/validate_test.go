@@ -0,0 +1,38 @@
+package vipconfig
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseVIPsDuplicates(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		wantErr string
+	}{
+		{"distinct", "10.0.0.5,10.0.0.6/25", ""},
+		{"same address, other prefix", "10.0.0.5,10.0.0.6,10.0.0.7, 10.0.0.5/25", "vips[0] and vips[3] are both 10.0.0.5"},
+		{"IPv6 spelled differently", "2001:db8::5,2001:db8:0::5", "vips[0] and vips[1] are both 2001:db8::5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseVIPs(tt.list, 24)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("ParseVIPs() error = %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("ParseVIPs() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateReportsDuplicatePositions(t *testing.T) {
+	// the invalid entry still counts for the positions
+	c := &Config{IP: "10.0.0.5,nonsense,10.0.0.6,10.0.0.5", Mask: 24}
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "vips[0] and vips[3] are both 10.0.0.5") {
+		t.Errorf("Validate() error = %v, want the positions of the duplicates", err)
+	}
+}